@@ -2,44 +2,244 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"ksql/src/storage"
 	"os"
+	"sort"
+)
+
+const (
+	tablePath = "table/test_table_65535"
+	walDir    = tablePath + ".wal"
 )
 
 func main() {
+	// go run . checkpoint でログを再生してからチェックポイントを作り、要らなくなったセグメントを削除する
+	if len(os.Args) > 1 && os.Args[1] == "checkpoint" {
+		if err := checkpoint(); err != nil {
+			panic(err)
+		}
+		return
+	}
+	// go run . migrate でリトルエンディアンやスロットの数を持たないページで書かれた古いファイルを tablePath.migrated に書き直す
+	// リトルエンディアンの場合はvalueもNewBytesで作っているので、キーと同じように並べ替える
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrate(); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	// go run . freespace で空きページの数を表示する。truncateを付けると末尾の空きページを切り詰める
+	// WALに残っているページを書き戻してから切り詰めるように、先に go run . checkpoint を実行しておく
+	if len(os.Args) > 1 && os.Args[1] == "freespace" {
+		if err := freeSpace(len(os.Args) > 2 && os.Args[2] == "truncate"); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	// go run . verify で木の構造を確かめ、不整合があれば全て表示して終了コード1で終わる
+	// WALに残っているページを反映してから確かめるように、先に go run . checkpoint を実行しておく
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		ok, err := verify()
+		if err != nil {
+			panic(err)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// go run . stats で木の高さ・ページ数・充填率とページごとのitemの数の分布を表示する
+	if len(os.Args) > 1 && os.Args[1] == "stats" {
+		if err := stats(); err != nil {
+			panic(err)
+		}
+		return
+	}
+
 	// 0からインサート
-	// f, _ := os.Create("table/test_table_65535")
-	// dm := storage.NewDiskManager(f)
-	// btree := storage.NewBPlustTree()
-	// var i uint32
-	// for i = 0; i < 65535; i++ {
-	// 	btree.InsertPair(dm, storage.NewBytes(i), storage.NewBytes(i))
+	// f, _ := os.Create(tablePath)
+	// dm, _ := storage.NewDiskManager(f)
+	// bpm := storage.NewBufferPoolManager(dm, 64, storage.NewLRUKReplacer(2))
+	// storage.NewTable2(bpm, storage.ColumnSize)
+	// btree, _ := storage.NewBPlustTree(bpm)
+	// pairs := make([]storage.Pair, 65535)
+	// for i := range pairs {
+	// 	pairs[i] = storage.Pair{storage.NewBytes(uint32(i)), storage.NewBytes(uint32(i))}
 	// }
+	// btree.BulkLoad(bpm, storage.NewPairIterator(pairs), 1)
+	// bpm.Close()
 
 	// 既存のを使う
-	f, err := os.OpenFile("table/test_table_65535", os.O_RDWR, 0666)
+	f, err := os.OpenFile(tablePath, os.O_RDWR, 0666)
+	if err != nil {
+		panic(err)
+	}
+	dm, err := storage.NewDiskManager(f)
+	if err != nil {
+		panic(err)
+	}
+	bpm := storage.NewBufferPoolManager(dm, 64, storage.NewLRUKReplacer(2))
+	btree, err := storage.NewBPlustTree(bpm)
 	if err != nil {
 		panic(err)
 	}
-	dm := storage.NewDiskManager(f)
-	btree := storage.NewBPlustTree()
-	btree.RootNodeID = storage.PageID(1)
 
 	// リーフを全て表示
-	slice := btree.Slice(dm)
-	var sum int
-	var sumLeaf int
+	slice, err := btree.Slice(bpm)
+	if err != nil {
+		panic(err)
+	}
 	buf := bytes.Buffer{}
 	for _, p := range slice {
 		if p.NodeType == storage.NodeTypeBranch {
 			continue
 		}
-		sum += 1
-		sumLeaf += len(p.Items)
 		buf.WriteString(fmt.Sprintf("start: %+v, end: %+v, len: %+v, depth: %+v\n", p.Items[0].Key, p.Items[len(p.Items)-1].Key, len(p.Items), p.Depth))
 	}
-	buf.WriteString(fmt.Sprintf("sum: %+v leaf, item count: %+v \n", sum, sumLeaf))
+	st, err := btree.Stats(bpm)
+	if err != nil {
+		panic(err)
+	}
+	buf.WriteString(fmt.Sprintf("sum: %+v leaf, item count: %+v \n", st.Leaf.Pages, st.KeyCount))
 	f2, _ := os.Create("leaf_list")
 	fmt.Fprint(f2, buf.String())
+	if err := bpm.Close(); err != nil {
+		panic(err)
+	}
+}
+
+func checkpoint() error {
+	dm, err := storage.Open(tablePath)
+	if err != nil {
+		return err
+	}
+	store, err := storage.NewDirLogStore(walDir)
+	if err != nil {
+		return err
+	}
+	wal, err := storage.NewWAL(store)
+	if err != nil {
+		return err
+	}
+	wdm, err := storage.NewWALDiskManager(dm, wal)
+	if err != nil {
+		return err
+	}
+	btree, err := storage.NewBPlustTree(wdm)
+	if err != nil {
+		return err
+	}
+	// 実行中だったトランザクションを取り消してからチェックポイントを作る
+	if _, err := storage.NewTransactionManager(wdm, btree); err != nil {
+		return err
+	}
+	if err := wdm.Checkpoint(true); err != nil {
+		return err
+	}
+	fmt.Printf("checkpoint done. segments: %v\n", wal.Segments())
+	return wdm.Close()
+}
+
+func migrate() error {
+	src, err := storage.Open(tablePath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	f, err := os.Create(tablePath + ".migrated")
+	if err != nil {
+		return err
+	}
+	dst, err := storage.NewDiskManager(f)
+	if err != nil {
+		return err
+	}
+	err = storage.MigrateLittleEndian(src, dst, storage.SwapColumns)
+	if errors.Is(err, storage.ErrNotLittleEndianFile) {
+		err = storage.MigrateUnslotted(src, dst)
+	}
+	if err != nil {
+		dst.Close()
+		return err
+	}
+	fmt.Printf("migrated to %s\n", tablePath+".migrated")
+	return dst.Close()
+}
+
+func freeSpace(truncate bool) error {
+	dm, err := storage.Open(tablePath)
+	if err != nil {
+		return err
+	}
+	disk := dm.(*storage.DiskManagerImpl)
+	report := disk.FreeSpace()
+	fmt.Printf("total: %d pages, used: %d, free: %d, trailing free: %d\n", report.TotalPages, report.UsedPages, report.FreePages, report.TrailingFreePages)
+	if truncate {
+		n, err := disk.TruncateFreePages()
+		if err != nil {
+			dm.Close()
+			return err
+		}
+		fmt.Printf("truncated %d pages\n", n)
+	}
+	return dm.Close()
+}
+
+func verify() (bool, error) {
+	dm, err := storage.Open(tablePath)
+	if err != nil {
+		return false, err
+	}
+	defer dm.Close()
+	btree, err := storage.NewBPlustTree(dm)
+	if err != nil {
+		return false, err
+	}
+	violations, err := btree.Verify(dm)
+	if err != nil {
+		return false, err
+	}
+	for _, v := range violations {
+		fmt.Println(v)
+	}
+	fmt.Printf("%d violations\n", len(violations))
+	return len(violations) == 0, nil
+}
+
+func stats() error {
+	dm, err := storage.Open(tablePath)
+	if err != nil {
+		return err
+	}
+	defer dm.Close()
+	btree, err := storage.NewBPlustTree(dm)
+	if err != nil {
+		return err
+	}
+	st, err := btree.Stats(dm)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("height: %d, keys: %d, limit: %d bytes, split: %s, fill factor: %.2f\n", st.Height, st.KeyCount, st.LimitBytes, st.Split.Policy, st.Split.FillFactor)
+	for _, s := range []struct {
+		name  string
+		pages storage.PageStats
+	}{{"branch", st.Branch}, {"leaf", st.Leaf}} {
+		p := s.pages
+		fmt.Printf("%s: %d pages, bytes min/avg/max: %d/%.1f/%d, fill min/avg/max: %.2f/%.2f/%.2f\n", s.name, p.Pages, p.MinBytes, p.AvgBytes, p.MaxBytes, p.MinFill, p.AvgFill, p.MaxFill)
+		items := make([]int, 0, len(p.Items))
+		for n := range p.Items {
+			items = append(items, n)
+		}
+		sort.Ints(items)
+		for _, n := range items {
+			fmt.Printf("  %d items: %d pages\n", n, p.Items[n])
+		}
+	}
+	return nil
 }
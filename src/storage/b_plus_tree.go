@@ -1,88 +1,377 @@
 package storage
 
 import (
-	"encoding/binary"
-	"errors"
+	"fmt"
 )
 
 type (
 	BPlustTree struct {
 		RootNodeID PageID
-		KeyLen     uint32
+		KeyLen     uint32 // 可変長のカラムがある場合はVariableKeyLen
+		RowIDLen   uint32 // 0より大きい場合は重複キーを許すインデックスで、キーの後ろに行IDを付けて一意にする
+		KeySchema  KeySchema
+		Height     uint32 // rootからleafまでのページ数。rootが無い場合は0
+		KeyCount   uint64
+		Split      SplitConfig // 挿入でページを分割する方法
+
+		header       FileHeader // 最後に読み書きしたファイルヘッダー。saveHeaderでページ0を読み直さずに済むように持っておく
+		restructured bool       // 分割・併合をしたので、saveHeaderで高さを数え直す
 	}
 )
 
 // ファイルはすでに作らている前提
 // Tableクラス作る？
 // ということでCreate,Insertの動線を整えたい
-func NewBPlustTree(dm DiskManager) *BPlustTree {
-	metaBytes := dm.ReadPageData(PageID(0))
-	keyLen := binary.NativeEndian.Uint32(metaBytes[:4])
-
-	// PageID1がルートの情報なので
-	// ファイルサイズが4KBを超える場合はルートのーどが存在すると判断してセットする
-	fSize := dm.FSize()
-	rootPageID := InvalidPageID
-	if fSize > PageSize {
-		rootPageID = RootPageID
+// rootのPageID・高さ・キーの数はファイルヘッダーから読む
+// ファイルヘッダーのマジックナンバーやバージョンが合わない場合はエラーを返す
+func NewBPlustTree(dm DiskManager) (*BPlustTree, error) {
+	header, err := ReadFileHeader(dm)
+	if err != nil {
+		return nil, err
 	}
 	return &BPlustTree{
-		rootPageID,
-		keyLen,
-	}
+		header.RootPageID,
+		header.KeyLen,
+		header.RowIDLen,
+		header.KeySchema,
+		header.Height,
+		header.KeyCount,
+		header.Split,
+		*header,
+		false,
+	}, nil
 }
 
-func (b *BPlustTree) PrintAll(dm DiskManager) {
+func (b *BPlustTree) PrintAll(dm DiskManager) error {
 	if b.RootNodeID == InvalidPageID {
-		return
+		return nil
 	}
-	bytes := dm.ReadPageData(b.RootNodeID)
-	root, err := NewPage(bytes)
+	root, err := fetchPage(dm, b.RootNodeID)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	root.PrintAll(dm, "")
+	return root.PrintAll(dm, "")
 }
 
-func (b *BPlustTree) Slice(dm DiskManager) []Page {
+func (b *BPlustTree) Slice(dm DiskManager) ([]Page, error) {
 	if b.RootNodeID == InvalidPageID {
-		return nil
+		return nil, nil
 	}
-	bytes := dm.ReadPageData(b.RootNodeID)
-	root, err := NewPage(bytes)
+	root, err := fetchPage(dm, b.RootNodeID)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	var ps []Page
-	root.Walk(dm, &ps, 0)
-	return ps
+	if err := root.Walk(dm, &ps, 0); err != nil {
+		return nil, err
+	}
+	return ps, nil
 }
 
+// 既に同じキーが存在する場合はErrDuplicateKeyを返す
+// 変更するページが複数ある場合、dmがAtomicDiskManagerであればまとめて1つの単位として書き込む。Put,Update,Deleteも同様
+// leafに収まる場合はデコードせずにバッファのまま挿入し、収まらない場合だけPageにして分割する
 func (b *BPlustTree) InsertPair(dm DiskManager, key, value Bytes) error {
-	// rootがnilの場合
+	if err := b.checkKeyLen(key); err != nil {
+		return err
+	}
+	return b.atomically(dm, func() error {
+		// rootがnilの場合
+		if b.RootNodeID == InvalidPageID {
+			err := b.CreateRoot(dm)
+			if err != nil {
+				return err
+			}
+		}
+
+		// 該当するleafを探す
+		leaf, err := b.findLeafSlotted(dm, key)
+		if err != nil {
+			return err
+		}
+		index, found := b.search(leaf, key)
+		if found {
+			return ErrDuplicateKey
+		}
+		if err := b.insertAt(dm, leaf, index, key, value); err != nil {
+			return err
+		}
+		return b.saveHeader(dm, 1)
+	})
+}
+
+// キーが存在する場合はvalueを置き換え、存在しない場合は新しく挿入する
+func (b *BPlustTree) Put(dm DiskManager, key, value Bytes) error {
+	if err := b.checkKeyLen(key); err != nil {
+		return err
+	}
+	return b.atomically(dm, func() error {
+		if b.RootNodeID == InvalidPageID {
+			if err := b.CreateRoot(dm); err != nil {
+				return err
+			}
+		}
+
+		leaf, err := b.findLeafSlotted(dm, key)
+		if err != nil {
+			return err
+		}
+		var keyDelta int64
+		if index, found := b.search(leaf, key); found {
+			err = b.updateAt(dm, leaf, index, value)
+		} else {
+			err = b.insertAt(dm, leaf, index, key, value)
+			keyDelta = 1
+		}
+		if err != nil {
+			return err
+		}
+		return b.saveHeader(dm, keyDelta)
+	})
+}
+
+// 既存のキーのvalueを置き換える。キーが存在しない場合はErrKeyNotFoundを返す
+func (b *BPlustTree) Update(dm DiskManager, key, value Bytes) error {
+	if err := b.checkKeyLen(key); err != nil {
+		return err
+	}
+	return b.atomically(dm, func() error {
+		if b.RootNodeID == InvalidPageID {
+			return ErrKeyNotFound
+		}
+		leaf, err := b.findLeafSlotted(dm, key)
+		if err != nil {
+			return err
+		}
+		index, found := b.search(leaf, key)
+		if !found {
+			return ErrKeyNotFound
+		}
+		// valueが大きくなると分割されて高さが変わることがある
+		if err := b.updateAt(dm, leaf, index, value); err != nil {
+			return err
+		}
+		return b.saveHeader(dm, 0)
+	})
+}
+
+// keyに一致するpairのvalueを返す
+// 見つからない場合はfalseを返す
+func (b *BPlustTree) Get(dm DiskManager, key Bytes) (Bytes, bool, error) {
 	if b.RootNodeID == InvalidPageID {
-		err := b.CreateRoot(dm)
+		return nil, false, nil
+	}
+	leaf, err := b.findLeafSlotted(dm, key)
+	if err != nil {
+		return nil, false, err
+	}
+	index, found := b.search(leaf, key)
+	if !found {
+		return nil, false, nil
+	}
+	value, err := readValue(dm, leaf.Value(index))
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+// keyに一致するpairを削除する
+// 削除によってページが小さくなりすぎた場合は兄弟ページとの再分配・併合を行う
+func (b *BPlustTree) Delete(dm DiskManager, key Bytes) error {
+	if err := b.checkKeyLen(key); err != nil {
+		return err
+	}
+	return b.atomically(dm, func() error {
+		if b.RootNodeID == InvalidPageID {
+			return ErrKeyNotFound
+		}
+		leaf, err := b.findLeafSlotted(dm, key)
+		if err != nil {
+			return err
+		}
+		index, found := b.search(leaf, key)
+		if !found {
+			return ErrKeyNotFound
+		}
+		old := append(Bytes{}, leaf.Value(index)...)
+		_, keyLen, valueLen := leaf.slot(index)
+		if leaf.ParentID() == InvalidPageID || leaf.NBytes()-SlotNByte-keyLen-valueLen >= MinBytesSize() {
+			leaf.Delete(index)
+			err = b.writeSlotted(dm, leaf)
+		} else {
+			err = b.decode(leaf, func(p *Page) error {
+				return p.DeletePair(dm, key, b.internalKeyLen())
+			})
+		}
 		if err != nil {
 			return err
 		}
+		if err := freeValue(dm, old); err != nil {
+			return err
+		}
+		return b.saveHeader(dm, -1)
+	})
+}
+
+// 重複キーを許すインデックスにkeyとrowIDの組を挿入する
+func (b *BPlustTree) InsertRow(dm DiskManager, key, rowID, value Bytes) error {
+	internalKey, err := b.InternalKey(key, rowID)
+	if err != nil {
+		return err
+	}
+	return b.InsertPair(dm, internalKey, value)
+}
+
+// 重複キーを許すインデックスからkeyとrowIDの組を削除する
+func (b *BPlustTree) DeleteRow(dm DiskManager, key, rowID Bytes) error {
+	internalKey, err := b.InternalKey(key, rowID)
+	if err != nil {
+		return err
+	}
+	return b.Delete(dm, internalKey)
+}
+
+// keyに一致する全てのpairを返す。leafをまたいで重複している場合も全て返す
+// 重複キーを許すインデックスの場合、返るpairのキーは行IDが付いた内部的なキーになる
+func (b *BPlustTree) GetAll(dm DiskManager, key Bytes) ([]Pair, error) {
+	cursor := b.Scan(dm, &Bound{key, true}, &Bound{key, true})
+	pairs := []Pair{}
+	for cursor.Next() {
+		pairs = append(pairs, Pair{cursor.Key(), cursor.Value()})
+	}
+	return pairs, cursor.Err()
+}
+
+// keyの後ろに行IDを付けて木の中で使う一意なキーにする
+// 可変長のキーは終端が付いているので、そのまま後ろに付けても順序が変わらない
+// keyがKeyLenより短い場合や、rowIDがRowIDLenより短い場合はErrInvalidKeyLenを返す
+func (b *BPlustTree) InternalKey(key, rowID Bytes) (Bytes, error) {
+	if b.KeyLen != VariableKeyLen {
+		if key.Len() < b.KeyLen {
+			return nil, fmt.Errorf("%w: key has %d bytes, expected %d", ErrInvalidKeyLen, key.Len(), b.KeyLen)
+		}
+		key = key[:b.KeyLen]
+	}
+	if rowID.Len() < b.RowIDLen {
+		return nil, fmt.Errorf("%w: row ID has %d bytes, expected %d", ErrInvalidKeyLen, rowID.Len(), b.RowIDLen)
 	}
+	internalKey := make(Bytes, 0, len(key)+int(b.RowIDLen))
+	internalKey = append(internalKey, key...)
+	return append(internalKey, rowID[:b.RowIDLen]...), nil
+}
 
-	// 該当するleafを探す
-	bytes := dm.ReadPageData(b.RootNodeID)
-	root, err := NewPage(bytes)
+// 固定長のキーの木に書き込むキーが、行IDも含めてinternalKeyLenバイトちょうどかを確かめる
+// 短いキーは比較の結果が決まらないので、同じキーが2回挿入されたり、ページ内の順序が崩れたりする
+func (b *BPlustTree) checkKeyLen(key Bytes) error {
+	if n := b.internalKeyLen(); n != VariableKeyLen && key.Len() != n {
+		return fmt.Errorf("%w: key has %d bytes, expected %d", ErrInvalidKeyLen, key.Len(), n)
+	}
+	return nil
+}
+
+// 木の中でpairを一意に特定するために比較するキーの長さ
+func (b *BPlustTree) internalKeyLen() uint32 {
+	if b.KeyLen == VariableKeyLen {
+		return VariableKeyLen
+	}
+	return b.KeyLen + b.RowIDLen
+}
+
+// keyが含まれうるleafを返す。rootがない場合はnilを返す
+func (b *BPlustTree) findLeaf(dm DiskManager, key Bytes) (*Page, error) {
+	if b.RootNodeID == InvalidPageID {
+		return nil, nil
+	}
+	root, err := fetchPage(dm, b.RootNodeID)
+	if err != nil {
+		return nil, err
+	}
+	return root.FindLeaf(dm, key, b.internalKeyLen())
+}
+
+// rootからkeyが含まれうるleafまで、ページをデコードせずに降りる。rootがある場合だけ呼ぶ
+func (b *BPlustTree) findLeafSlotted(dm DiskManager, key Bytes) (SlottedPage, error) {
+	pageID := b.RootNodeID
+	for {
+		page, err := readSlottedPage(dm, pageID)
+		if err != nil {
+			return SlottedPage{}, err
+		}
+		if page.NodeType() == NodeTypeLeaf {
+			return page, nil
+		}
+		if pageID = page.Child(key, b.internalKeyLen()); pageID == InvalidPageID {
+			return SlottedPage{}, fmt.Errorf("page %d has no child for the key", page.PageID())
+		}
+	}
+}
+
+// keyを挿入する位置と、同じキーが既にあるかを返す
+func (b *BPlustTree) search(leaf SlottedPage, key Bytes) (int, bool) {
+	index := leaf.Search(key, b.internalKeyLen())
+	return index, index < leaf.NumSlots() && leaf.Key(index).Compare(key, b.internalKeyLen()) == ComparisonResultEqual
+}
+
+// leafのindex番目に挿入する。上限やPageSizeを超える場合はPageにして分割する
+// 大きいvalueはオーバーフローページに書いて、leafには参照だけを置く
+func (b *BPlustTree) insertAt(dm DiskManager, leaf SlottedPage, index int, key, value Bytes) error {
+	value, err := writeValue(dm, key, value)
 	if err != nil {
 		return err
 	}
+	if leaf.NBytes()+SlotNByte+key.Len()+value.Len() <= LimitBytesSize() && leaf.Insert(index, key, value) {
+		return b.writeSlotted(dm, leaf)
+	}
+	return b.decode(leaf, func(p *Page) error {
+		return p.InsertPairWith(dm, key, value, b.Split)
+	})
+}
 
-	pages, err := root.SearchByV3(dm, key, key, b.KeyLen)
+// leafのindex番目のvalueを置き換える。上限やPageSizeを超える場合はPageにして分割する
+// 元のvalueがオーバーフローページにある場合は、置き換えた後に解放する
+func (b *BPlustTree) updateAt(dm DiskManager, leaf SlottedPage, index int, value Bytes) error {
+	key := append(Bytes{}, leaf.Key(index)...)
+	old := append(Bytes{}, leaf.Value(index)...)
+	value, err := writeValue(dm, key, value)
 	if err != nil {
 		return err
 	}
-	if len(pages) == 0 {
-		return errors.New("not found correnponding page")
+	fits := leaf.NBytes()-old.Len()+value.Len() <= LimitBytesSize()
+	if fits {
+		leaf.Delete(index)
+		// ページに収まらない場合は元のvalueに戻してから分割する。decodeで検証するのでチェックサムも合わせる
+		if fits = leaf.Insert(index, key, value); !fits {
+			leaf.Insert(index, key, old)
+			leaf.Finish()
+		}
+	}
+	if fits {
+		err = b.writeSlotted(dm, leaf)
+	} else {
+		err = b.decode(leaf, func(p *Page) error {
+			return p.UpdatePair(dm, index, value, b.Split)
+		})
 	}
-	p := pages[0]
-	return p.InsertPair(dm, key, value)
+	if err != nil {
+		return err
+	}
+	return freeValue(dm, old)
+}
+
+func (b *BPlustTree) writeSlotted(dm DiskManager, page SlottedPage) error {
+	page.Finish()
+	return dm.WritePageData(page.PageID(), *page.b)
+}
+
+// 分割や併合が必要な場合はPageにデコードしてから変更する
+func (b *BPlustTree) decode(page SlottedPage, fn func(p *Page) error) error {
+	p, err := NewPage(*page.b)
+	if err != nil {
+		return err
+	}
+	b.restructured = true
+	return fn(p)
 }
 
 func (b *BPlustTree) CreateRoot(dm DiskManager) error {
@@ -101,5 +390,66 @@ func (b *BPlustTree) CreateRoot(dm DiskManager) error {
 		return err
 	}
 	b.RootNodeID = rootPageID
+	b.restructured = true
+	return b.saveHeader(dm, 0)
+}
+
+// 木を変更した後に呼び、rootのPageID・高さ・キーの数をファイルヘッダーに書く
+// 変更したページと同じ単位で書き込むので、dmがAtomicDiskManagerであればクラッシュしてもずれない
+// 高さは分割・併合をした場合だけ数え直す。どれも変わっていない場合は書き込まない
+func (b *BPlustTree) saveHeader(dm DiskManager, keyDelta int64) error {
+	height := b.header.Height
+	if b.restructured {
+		var err error
+		if height, err = treeHeight(dm, b.RootNodeID); err != nil {
+			return err
+		}
+	}
+	if b.header.RootPageID == b.RootNodeID && b.header.Height == height && keyDelta == 0 {
+		b.restructured = false
+		return nil
+	}
+	header := b.header
+	header.RootPageID = b.RootNodeID
+	header.Height = height
+	header.KeyCount = uint64(int64(header.KeyCount) + keyDelta)
+	if err := header.Flush(dm); err != nil {
+		return err
+	}
+	b.header, b.restructured = header, false
+	b.Height, b.KeyCount = header.Height, header.KeyCount
 	return nil
 }
+
+// atomicallyと同じく書き込み、失敗した場合はメモリ上のrootのPageID・高さ・キーの数・ファイルヘッダーも元に戻す
+// CreateRootやsaveHeaderはfnの中でメモリ上の値を進めるので、ログへのコミットに失敗するとファイルとずれたまま残ってしまう
+func (b *BPlustTree) atomically(dm DiskManager, fn func() error) error {
+	saved := *b
+	if err := atomically(dm, fn); err != nil {
+		*b = saved
+		return err
+	}
+	return nil
+}
+
+// 一番左の子を辿ってleafまでのページ数を数える
+func treeHeight(dm DiskManager, rootPageID PageID) (uint32, error) {
+	var height uint32
+	pageID := rootPageID
+	for pageID != InvalidPageID {
+		page, err := fetchPage(dm, pageID)
+		if err != nil {
+			return 0, err
+		}
+		height += 1
+		if page.NodeType == NodeTypeLeaf {
+			break
+		}
+		children := page.Children()
+		if len(children) == 0 {
+			break
+		}
+		pageID = children[0]
+	}
+	return height, nil
+}
@@ -1,7 +1,9 @@
 package storage
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"os"
 	"strconv"
 
@@ -21,24 +23,24 @@ var _ = Describe("BPustTreeのテスト", func() {
 			res []Page
 		)
 		BeforeEach(func() {
-			f, _ := os.Create("insert_test_table")
-			dm = NewDiskManager(f)
+			f := createTestFile("insert_test_table")
+			dm, _ = NewDiskManager(f)
 			NewTable2(dm, 4)
 		})
 		JustBeforeEach(func() {
-			btree = NewBPlustTree(dm)
+			btree, _ = NewBPlustTree(dm)
 			os.Setenv(BytesSizeLimitKey, pageSize)
 			var i uint32
 			for i = 0; i < max; i++ {
 				btree.InsertPair(dm, NewBytes(i), NewBytes(i))
 			}
-			res = btree.Slice(dm)
+			res, _ = btree.Slice(dm)
 			btree.PrintAll(dm)
 		})
 		Context("0から順番に6まで挿入した場合", func() {
 			BeforeEach(func() {
 				max = 7
-				pageSize = strconv.Itoa(64)
+				pageSize = strconv.Itoa(84)
 			})
 			It("深さが2のB+Treeになる", func() {
 				fmt.Println(res)
@@ -178,12 +180,12 @@ var _ = Describe("BPustTreeのテスト", func() {
 			res []Page
 		)
 		BeforeEach(func() {
-			f, _ := os.Create("insert_multi_column_table")
-			dm = NewDiskManager(f)
+			f := createTestFile("insert_multi_column_table")
+			dm, _ = NewDiskManager(f)
 			NewTable2(dm, ColumnSize*2)
 		})
 		JustBeforeEach(func() {
-			btree = NewBPlustTree(dm)
+			btree, _ = NewBPlustTree(dm)
 			os.Setenv(BytesSizeLimitKey, pageSize)
 			var i uint32
 			for i = 0; i < max; i++ {
@@ -191,13 +193,13 @@ var _ = Describe("BPustTreeのテスト", func() {
 					btree.InsertPair(dm, NewBytes(i, j), NewBytes(i*j))
 				}
 			}
-			res = btree.Slice(dm)
+			res, _ = btree.Slice(dm)
 			btree.PrintAll(dm)
 		})
 		Context("0から3まで挿入した場合", func() {
 			BeforeEach(func() {
 				max = 3
-				pageSize = strconv.Itoa(72)
+				pageSize = strconv.Itoa(92)
 			})
 			It("深さが2のB+Treeになる", func() {
 				Expect(len(res)).To(Equal(10))
@@ -378,4 +380,664 @@ var _ = Describe("BPustTreeのテスト", func() {
 			})
 		})
 	})
+	Describe("InsertPair(ディスクエラー)", func() {
+		var (
+			btree *BPlustTree
+			dm    *failingDiskManager
+			err   error
+		)
+		BeforeEach(func() {
+			f := createTestFile("disk_error_test_table")
+			disk, _ := NewDiskManager(f)
+			dm = &failingDiskManager{disk, 100}
+			NewTable2(dm, ColumnSize)
+			os.Setenv(BytesSizeLimitKey, strconv.Itoa(84))
+			btree, _ = NewBPlustTree(dm)
+			var i uint32
+			for i = 0; i < 100 && err == nil; i++ {
+				err = btree.InsertPair(dm, NewBytes(i), NewBytes(i))
+			}
+		})
+		It("書き込みのエラーが呼び出し元に返る", func() {
+			Expect(err).To(MatchError(errInjectedWrite))
+		})
+	})
+	Describe("NewBPlustTree", func() {
+		Context("メタデータが書き込まれていない場合", func() {
+			It("errが返る", func() {
+				f := createTestFile("empty_test_table")
+				dm, _ := NewDiskManager(f)
+				_, err := NewBPlustTree(dm)
+				Expect(err).NotTo(BeNil())
+			})
+		})
+	})
+	Describe("InsertPair(重複キー)", func() {
+		var (
+			btree *BPlustTree
+			dm    DiskManager
+			err   error
+		)
+		BeforeEach(func() {
+			f := createTestFile("duplicate_test_table")
+			dm, _ = NewDiskManager(f)
+			NewTable2(dm, ColumnSize)
+			os.Setenv(BytesSizeLimitKey, strconv.Itoa(84))
+			btree, _ = NewBPlustTree(dm)
+			btree.InsertPair(dm, NewBytes(1), NewBytes(10))
+			err = btree.InsertPair(dm, NewBytes(1), NewBytes(20))
+		})
+		It("ErrDuplicateKeyが返り元のvalueが残る", func() {
+			Expect(err).To(Equal(ErrDuplicateKey))
+			value, _, _ := btree.Get(dm, NewBytes(1))
+			Expect(value).To(Equal(NewBytes(10)))
+			Expect(leafKeys(sliceOf(btree, dm))).To(Equal([]uint32{1}))
+		})
+	})
+	Describe("Put", func() {
+		var (
+			btree *BPlustTree
+			dm    DiskManager
+			max   uint32
+
+			key, value Bytes
+			err        error
+		)
+		BeforeEach(func() {
+			f := createTestFile("put_test_table")
+			dm, _ = NewDiskManager(f)
+			NewTable2(dm, ColumnSize)
+			os.Setenv(BytesSizeLimitKey, strconv.Itoa(84))
+			max = 7
+		})
+		JustBeforeEach(func() {
+			btree, _ = NewBPlustTree(dm)
+			var i uint32
+			for i = 0; i < max; i++ {
+				btree.InsertPair(dm, NewBytes(i), NewBytes(i))
+			}
+			err = btree.Put(dm, key, value)
+		})
+		Context("キーが存在する場合", func() {
+			BeforeEach(func() {
+				key = NewBytes(4)
+				value = NewBytes(400)
+			})
+			It("valueが置き換わりキーは重複しない", func() {
+				Expect(err).To(BeNil())
+				res, found, _ := btree.Get(dm, key)
+				Expect(found).To(BeTrue())
+				Expect(res).To(Equal(value))
+				Expect(leafKeys(sliceOf(btree, dm))).To(Equal([]uint32{0, 1, 2, 3, 4, 5, 6}))
+			})
+		})
+		Context("キーが存在しない場合", func() {
+			BeforeEach(func() {
+				key = NewBytes(7)
+				value = NewBytes(700)
+			})
+			It("新しく挿入される", func() {
+				Expect(err).To(BeNil())
+				res, found, _ := btree.Get(dm, key)
+				Expect(found).To(BeTrue())
+				Expect(res).To(Equal(value))
+				Expect(leafKeys(sliceOf(btree, dm))).To(Equal([]uint32{0, 1, 2, 3, 4, 5, 6, 7}))
+			})
+		})
+		Context("rootがない場合", func() {
+			BeforeEach(func() {
+				max = 0
+				key = NewBytes(1)
+				value = NewBytes(100)
+			})
+			It("rootが作られて挿入される", func() {
+				Expect(err).To(BeNil())
+				res, found, _ := btree.Get(dm, key)
+				Expect(found).To(BeTrue())
+				Expect(res).To(Equal(value))
+			})
+		})
+	})
+	Describe("Update", func() {
+		var (
+			btree *BPlustTree
+			dm    DiskManager
+
+			key, value Bytes
+			err        error
+			res        []Page
+		)
+		BeforeEach(func() {
+			f := createTestFile("update_test_table")
+			dm, _ = NewDiskManager(f)
+			NewTable2(dm, ColumnSize)
+			os.Setenv(BytesSizeLimitKey, strconv.Itoa(84))
+		})
+		JustBeforeEach(func() {
+			btree, _ = NewBPlustTree(dm)
+			var i uint32
+			for i = 0; i < 7; i++ {
+				btree.InsertPair(dm, NewBytes(i), NewBytes(i))
+			}
+			err = btree.Update(dm, key, value)
+			res, _ = btree.Slice(dm)
+		})
+		Context("キーが存在しない場合", func() {
+			BeforeEach(func() {
+				key = NewBytes(100)
+				value = NewBytes(1)
+			})
+			It("ErrKeyNotFoundが返り挿入されない", func() {
+				Expect(err).To(Equal(ErrKeyNotFound))
+				Expect(leafKeys(res)).To(Equal([]uint32{0, 1, 2, 3, 4, 5, 6}))
+			})
+		})
+		Context("valueが大きくなりページに収まらなくなる場合", func() {
+			BeforeEach(func() {
+				key = NewBytes(0)
+				value = NewBytes(0, 1, 2)
+			})
+			It("ページが分割されても全てのキーが残る", func() {
+				Expect(err).To(BeNil())
+				Expect(len(res)).To(Equal(9))
+				Expect(leafKeys(res)).To(Equal([]uint32{0, 1, 2, 3, 4, 5, 6}))
+				updated, _, _ := btree.Get(dm, key)
+				Expect(updated).To(Equal(value))
+				for _, p := range res {
+					Expect(p.NBytes()).To(BeNumerically("<=", 84))
+				}
+				assertLinks(res)
+			})
+		})
+	})
+	Describe("大きさのばらつくvalueで分割する場合", func() {
+		var (
+			btree *BPlustTree
+			dm    DiskManager
+		)
+		BeforeEach(func() {
+			os.Setenv(BytesSizeLimitKey, strconv.Itoa(PageSize))
+			dm, _ = NewDiskManager(newCrashableFile())
+			NewTable2(dm, ColumnSize)
+			btree, _ = NewBPlustTree(dm)
+			for i := uint32(0); i < 24; i++ {
+				Expect(btree.InsertPair(dm, NewBytes(i), make(Bytes, 10))).To(Succeed())
+			}
+		})
+		// 数で半分に分けると大きいvalueが全て右のページに入り、上限を超える
+		It("右端の4つを大きいvalueに置き換えても、分割後のページが上限に収まる", func() {
+			for i := uint32(20); i < 24; i++ {
+				Expect(btree.Update(dm, NewBytes(i), make(Bytes, 990))).To(Succeed())
+			}
+			res := sliceOf(btree, dm)
+			Expect(leafKeys(res)).To(HaveLen(24))
+			for _, p := range res {
+				Expect(p.NBytes()).To(BeNumerically("<=", PageSize))
+			}
+			assertLinks(res)
+			value, _, _ := btree.Get(dm, NewBytes(23))
+			Expect(value).To(Equal(make(Bytes, 990)))
+		})
+		It("置き換えでもrightmost-appendの分割の方法を使う", func() {
+			Expect(btree.SetSplit(dm, SplitConfig{SplitPolicyRightmostAppend, 1})).To(Succeed())
+			for i := uint32(24); i < 300; i++ {
+				Expect(btree.InsertPair(dm, NewBytes(i), make(Bytes, 10))).To(Succeed())
+			}
+			Expect(btree.Update(dm, NewBytes(299), make(Bytes, 900))).To(Succeed())
+			res := sliceOf(btree, dm)
+			leaves := []Page{}
+			for _, p := range res {
+				if p.NodeType == NodeTypeLeaf {
+					leaves = append(leaves, p)
+				}
+			}
+			// 右端の1つだけが新しいページに移り、左のページは詰まったまま残る
+			Expect(leaves[len(leaves)-1].Items).To(HaveLen(1))
+			Expect(leafKeys(res)).To(HaveLen(300))
+		})
+	})
+	Describe("上限がPageSizeより大きい場合", func() {
+		var (
+			btree *BPlustTree
+			dm    DiskManager
+		)
+		BeforeEach(func() {
+			os.Setenv(BytesSizeLimitKey, strconv.Itoa(2*PageSize))
+			dm, _ = NewDiskManager(newCrashableFile())
+			NewTable2(dm, ColumnSize)
+			btree, _ = NewBPlustTree(dm)
+			// 上限の半分に収まるのでleafは1つのまま、PageSizeの近くまで詰まる
+			for i := uint32(0); i < 5; i++ {
+				Expect(btree.InsertPair(dm, NewBytes(i), make(Bytes, 700))).To(Succeed())
+			}
+		})
+		It("ページに収まらない挿入は捨てられずにErrPageTooLargeが返る", func() {
+			err := btree.InsertPair(dm, NewBytes(5), make(Bytes, 700))
+			Expect(errors.Is(err, ErrPageTooLarge)).To(BeTrue())
+			Expect(btree.KeyCount).To(Equal(uint64(5)))
+			_, found, _ := btree.Get(dm, NewBytes(5))
+			Expect(found).To(BeFalse())
+			Expect(leafKeys(sliceOf(btree, dm))).To(HaveLen(5))
+		})
+		It("ページに収まらない置き換えは元のvalueを残してErrPageTooLargeが返る", func() {
+			Expect(btree.InsertPair(dm, NewBytes(5), make(Bytes, 10))).To(Succeed())
+			err := btree.Update(dm, NewBytes(5), make(Bytes, 700))
+			Expect(errors.Is(err, ErrPageTooLarge)).To(BeTrue())
+			value, found, _ := btree.Get(dm, NewBytes(5))
+			Expect(found).To(BeTrue())
+			Expect(value).To(Equal(make(Bytes, 10)))
+		})
+	})
+	Describe("重複キーを許すインデックス", func() {
+		var (
+			btree *BPlustTree
+			dm    DiskManager
+			max   uint32
+
+			key   Bytes
+			pairs []Pair
+			err   error
+		)
+		BeforeEach(func() {
+			f := createTestFile("non_unique_test_table")
+			dm, _ = NewDiskManager(f)
+			NewNonUniqueTable(dm, ColumnSize, ColumnSize)
+			os.Setenv(BytesSizeLimitKey, strconv.Itoa(148))
+			max = 30
+		})
+		JustBeforeEach(func() {
+			btree, _ = NewBPlustTree(dm)
+			// キーは0,1,2の繰り返しで行IDは挿入順
+			var i uint32
+			for i = 0; i < max; i++ {
+				Expect(btree.InsertRow(dm, NewBytes(i%3), NewBytes(i), NewBytes(i*10))).To(Succeed())
+			}
+			pairs, err = btree.GetAll(dm, key)
+		})
+		rowIDs := func(ps []Pair) []uint32 {
+			ids := []uint32{}
+			for _, p := range ps {
+				ids = append(ids, p.Key.Uint32(ColumnSize))
+			}
+			return ids
+		}
+		Context("同じキーが複数のleafにまたがる場合", func() {
+			BeforeEach(func() {
+				key = NewBytes(1)
+			})
+			It("全ての行が行IDの昇順で返る", func() {
+				Expect(err).To(BeNil())
+				Expect(rowIDs(pairs)).To(Equal([]uint32{1, 4, 7, 10, 13, 16, 19, 22, 25, 28}))
+				Expect(pairs[0].Value).To(Equal(NewBytes(10)))
+				leaves := 0
+				for _, p := range sliceOf(btree, dm) {
+					if p.NodeType == NodeTypeLeaf {
+						leaves += 1
+					}
+				}
+				Expect(leaves).To(BeNumerically(">", 3))
+			})
+		})
+		Context("キーが存在しない場合", func() {
+			BeforeEach(func() {
+				key = NewBytes(3)
+			})
+			It("空で返る", func() {
+				Expect(err).To(BeNil())
+				Expect(pairs).To(BeEmpty())
+			})
+		})
+		Context("同じキーと行IDの組を挿入した場合", func() {
+			BeforeEach(func() {
+				key = NewBytes(0)
+			})
+			It("ErrDuplicateKeyが返る", func() {
+				Expect(btree.InsertRow(dm, NewBytes(0), NewBytes(3), NewBytes(0))).To(Equal(ErrDuplicateKey))
+			})
+		})
+		Context("行を削除した場合", func() {
+			BeforeEach(func() {
+				key = NewBytes(2)
+			})
+			It("その行だけが消える", func() {
+				Expect(btree.DeleteRow(dm, NewBytes(2), NewBytes(5))).To(Succeed())
+				Expect(btree.DeleteRow(dm, NewBytes(2), NewBytes(6))).To(Equal(ErrKeyNotFound))
+				pairs, err = btree.GetAll(dm, key)
+				Expect(err).To(BeNil())
+				Expect(rowIDs(pairs)).To(Equal([]uint32{2, 8, 11, 14, 17, 20, 23, 26, 29}))
+			})
+		})
+		It("行IDが4バイトの倍数でない場合も行IDの昇順で返る", func() {
+			dm, _ = NewDiskManager(newCrashableFile())
+			Expect(NewNonUniqueTable(dm, ColumnSize, 3)).To(Succeed())
+			btree, _ = NewBPlustTree(dm)
+			var i uint32
+			for i = 0; i < 30; i++ {
+				Expect(btree.InsertRow(dm, NewBytes(i%3), Bytes{0, byte(i >> 8), byte(i)}, NewBytes(i*10))).To(Succeed())
+			}
+			Expect(btree.InsertRow(dm, NewBytes(1), Bytes{0, 0, 1}, NewBytes(0))).To(Equal(ErrDuplicateKey))
+			pairs, err = btree.GetAll(dm, NewBytes(1))
+			Expect(err).To(BeNil())
+			ids := []byte{}
+			for _, p := range pairs {
+				Expect(p.Key).To(HaveLen(7))
+				ids = append(ids, p.Key[6])
+			}
+			Expect(ids).To(Equal([]byte{1, 4, 7, 10, 13, 16, 19, 22, 25, 28}))
+		})
+		It("キーや行IDが短い場合はErrInvalidKeyLenが返る", func() {
+			Expect(errors.Is(btree.InsertRow(dm, Bytes{0, 0}, NewBytes(100), NewBytes(0)), ErrInvalidKeyLen)).To(BeTrue())
+			Expect(errors.Is(btree.InsertRow(dm, NewBytes(1), Bytes{0}, NewBytes(0)), ErrInvalidKeyLen)).To(BeTrue())
+			Expect(errors.Is(btree.DeleteRow(dm, NewBytes(1), Bytes{0}), ErrInvalidKeyLen)).To(BeTrue())
+			// 行IDの無いキーを直接書き込むと比較の結果が決まらないので、同じキーが2回挿入されないように弾く
+			for i := 0; i < 2; i++ {
+				Expect(errors.Is(btree.InsertPair(dm, NewBytes(1), NewBytes(0)), ErrInvalidKeyLen)).To(BeTrue())
+			}
+			Expect(errors.Is(btree.Put(dm, NewBytes(1), NewBytes(0)), ErrInvalidKeyLen)).To(BeTrue())
+			Expect(errors.Is(btree.Update(dm, NewBytes(1), NewBytes(0)), ErrInvalidKeyLen)).To(BeTrue())
+			Expect(errors.Is(btree.Delete(dm, NewBytes(1)), ErrInvalidKeyLen)).To(BeTrue())
+			Expect(btree.KeyCount).To(Equal(uint64(max)))
+			violations, err := btree.Verify(dm)
+			Expect(err).To(BeNil())
+			Expect(violations).To(BeEmpty())
+		})
+		It("行IDを付けたキーがleafに書けない長さの場合はErrInvalidKeyLenが返る", func() {
+			dm, _ = NewDiskManager(newCrashableFile())
+			Expect(errors.Is(NewNonUniqueTable(dm, 0, ColumnSize), ErrInvalidKeyLen)).To(BeTrue())
+			Expect(errors.Is(NewNonUniqueTable(dm, ColumnSize, MaxInlinePairNByte), ErrInvalidKeyLen)).To(BeTrue())
+			Expect(errors.Is(NewNonUniqueTable(dm, ColumnSize, math.MaxUint32), ErrInvalidKeyLen)).To(BeTrue())
+			Expect(errors.Is(NewTypedTable(dm, KeySchema{{Type: ColumnTypeString}}, MaxInlinePairNByte), ErrInvalidKeyLen)).To(BeTrue())
+		})
+	})
+	Describe("Get", func() {
+		var (
+			btree *BPlustTree
+
+			dm  DiskManager
+			max uint32
+			key Bytes
+
+			value Bytes
+			found bool
+			err   error
+		)
+		BeforeEach(func() {
+			f := createTestFile("get_test_table")
+			dm, _ = NewDiskManager(f)
+			NewTable2(dm, ColumnSize)
+			os.Setenv(BytesSizeLimitKey, strconv.Itoa(84))
+		})
+		JustBeforeEach(func() {
+			btree, _ = NewBPlustTree(dm)
+			var i uint32
+			for i = 0; i < max; i++ {
+				btree.InsertPair(dm, NewBytes(i), NewBytes(i*10))
+			}
+			value, found, err = btree.Get(dm, key)
+		})
+		Context("rootがない場合", func() {
+			BeforeEach(func() {
+				max = 0
+				key = NewBytes(1)
+			})
+			It("見つからない", func() {
+				Expect(err).To(BeNil())
+				Expect(found).To(BeFalse())
+				Expect(value).To(BeNil())
+			})
+		})
+		Context("キーが存在する場合", func() {
+			BeforeEach(func() {
+				max = 30
+				key = NewBytes(17)
+			})
+			It("対応するvalueが返る", func() {
+				Expect(err).To(BeNil())
+				Expect(found).To(BeTrue())
+				Expect(value).To(Equal(NewBytes(170)))
+			})
+		})
+		Context("ページの境界にあるキーの場合", func() {
+			BeforeEach(func() {
+				max = 7
+				key = NewBytes(3)
+			})
+			It("対応するvalueが返る", func() {
+				Expect(err).To(BeNil())
+				Expect(found).To(BeTrue())
+				Expect(value).To(Equal(NewBytes(30)))
+			})
+		})
+		Context("キーが存在しない場合", func() {
+			BeforeEach(func() {
+				max = 30
+				key = NewBytes(100)
+			})
+			It("見つからない", func() {
+				Expect(err).To(BeNil())
+				Expect(found).To(BeFalse())
+				Expect(value).To(BeNil())
+			})
+		})
+	})
+	Describe("Delete", func() {
+		var (
+			btree *BPlustTree
+
+			dm      DiskManager
+			max     uint32
+			targets []uint32
+
+			err error
+			res []Page
+		)
+		BeforeEach(func() {
+			f := createTestFile("delete_test_table")
+			dm, _ = NewDiskManager(f)
+			NewTable2(dm, ColumnSize)
+			os.Setenv(BytesSizeLimitKey, strconv.Itoa(84))
+		})
+		JustBeforeEach(func() {
+			btree, _ = NewBPlustTree(dm)
+			var i uint32
+			for i = 0; i < max; i++ {
+				btree.InsertPair(dm, NewBytes(i), NewBytes(i))
+			}
+			for _, t := range targets {
+				if err = btree.Delete(dm, NewBytes(t)); err != nil {
+					break
+				}
+			}
+			res, _ = btree.Slice(dm)
+		})
+		Context("存在しないキーを削除した場合", func() {
+			BeforeEach(func() {
+				max = 7
+				targets = []uint32{100}
+			})
+			It("ErrKeyNotFoundが返る", func() {
+				Expect(err).To(Equal(ErrKeyNotFound))
+			})
+		})
+		Context("リーフが下限を下回らない場合", func() {
+			BeforeEach(func() {
+				max = 7
+				targets = []uint32{0}
+			})
+			It("ページ数は変わらずキーだけ削除される", func() {
+				Expect(err).To(BeNil())
+				Expect(len(res)).To(Equal(7))
+				Expect(leafKeys(res)).To(Equal([]uint32{1, 2, 3, 4, 5, 6}))
+			})
+		})
+		Context("リーフが空になり兄弟と併合される場合", func() {
+			BeforeEach(func() {
+				max = 7
+				targets = []uint32{6}
+			})
+			It("中間ノードも併合されrootの子が1つになるため高さが1つ減る", func() {
+				Expect(err).To(BeNil())
+				Expect(leafKeys(res)).To(Equal([]uint32{0, 1, 2, 3, 4, 5}))
+				Expect(len(res)).To(Equal(4))
+				Expect(res[0]).To(Equal(Page{
+					PageID(1),
+					NodeTypeBranch,
+					PageID(0),
+					PageID(0),
+					PageID(0),
+					PageID(3),
+					[]Pair{
+						{
+							NewBytes(1),
+							NewBytes(2),
+						},
+						{
+							NewBytes(3),
+							NewBytes(4),
+						},
+					},
+					0,
+				}))
+				Expect(res[3]).To(Equal(Page{
+					PageID(3),
+					NodeTypeLeaf,
+					PageID(1),
+					PageID(4),
+					PageID(0),
+					PageID(0),
+					[]Pair{
+						{
+							NewBytes(4),
+							NewBytes(4),
+						},
+						{
+							NewBytes(5),
+							NewBytes(5),
+						},
+					},
+					1,
+				}))
+				assertLinks(res)
+			})
+		})
+		Context("兄弟から再分配される場合", func() {
+			BeforeEach(func() {
+				max = 20
+				targets = []uint32{0, 1}
+			})
+			It("キーの順序と親子・兄弟のリンクが保たれる", func() {
+				Expect(err).To(BeNil())
+				expected := []uint32{}
+				for i := uint32(2); i < max; i++ {
+					expected = append(expected, i)
+				}
+				Expect(leafKeys(res)).To(Equal(expected))
+				assertLinks(res)
+			})
+		})
+		Context("全てのキーを削除した場合", func() {
+			BeforeEach(func() {
+				max = 30
+				targets = []uint32{}
+				for i := uint32(0); i < max; i++ {
+					targets = append(targets, (i*7)%max)
+				}
+			})
+			It("rootが空のリーフに戻る", func() {
+				Expect(err).To(BeNil())
+				Expect(res).To(Equal([]Page{
+					{
+						PageID(1),
+						NodeTypeLeaf,
+						PageID(0),
+						PageID(0),
+						PageID(0),
+						PageID(0),
+						nil,
+						0,
+					},
+				}))
+			})
+			It("root以外のページが全て解放され、挿入し直すと再利用される", func() {
+				report := dm.(*DiskManagerImpl).FreeSpace()
+				Expect(report.UsedPages).To(Equal(uint32(2)))
+				fSize, _ := dm.FSize()
+				for i := uint32(0); i < max; i++ {
+					Expect(btree.InsertPair(dm, NewBytes(i), NewBytes(i))).To(Succeed())
+				}
+				Expect(dm.FSize()).To(Equal(fSize))
+				assertLinks(sliceOf(btree, dm))
+			})
+		})
+		Context("一部のキーを削除した後に挿入した場合", func() {
+			BeforeEach(func() {
+				max = 40
+				targets = []uint32{}
+				for i := uint32(0); i < max; i += 2 {
+					targets = append(targets, i)
+				}
+			})
+			It("削除したキーを再び挿入できる", func() {
+				Expect(err).To(BeNil())
+				for _, t := range targets {
+					Expect(btree.InsertPair(dm, NewBytes(t), NewBytes(t))).To(Succeed())
+				}
+				res, _ = btree.Slice(dm)
+				expected := []uint32{}
+				for i := uint32(0); i < max; i++ {
+					expected = append(expected, i)
+				}
+				Expect(leafKeys(res)).To(Equal(expected))
+				assertLinks(res)
+			})
+		})
+	})
 })
+
+func sliceOf(btree *BPlustTree, dm DiskManager) []Page {
+	ps, err := btree.Slice(dm)
+	Expect(err).To(BeNil())
+	return ps
+}
+
+// Sliceの結果からリーフのキーを左から順に取り出す
+func leafKeys(ps []Page) []uint32 {
+	keys := []uint32{}
+	for _, p := range ps {
+		if p.NodeType != NodeTypeLeaf {
+			continue
+		}
+		for _, item := range p.Items {
+			keys = append(keys, item.Key.Uint32(0))
+		}
+	}
+	return keys
+}
+
+// 子のParentIDが親を指していること、同じ深さのページがPrev/Nextで双方向に繋がっていることを確認する
+func assertLinks(ps []Page) {
+	pages := map[PageID]Page{}
+	levels := map[int32][]PageID{}
+	for _, p := range ps {
+		pages[p.PageID] = p
+		levels[p.Depth] = append(levels[p.Depth], p.PageID)
+	}
+	for _, p := range ps {
+		for _, child := range p.Children() {
+			Expect(pages[child].ParentID).To(Equal(p.PageID))
+		}
+	}
+	for _, ids := range levels {
+		for i, id := range ids {
+			prev, next := InvalidPageID, InvalidPageID
+			if i > 0 {
+				prev = ids[i-1]
+			}
+			if i+1 < len(ids) {
+				next = ids[i+1]
+			}
+			Expect(pages[id].PrevPageID).To(Equal(prev))
+			Expect(pages[id].NextPageID).To(Equal(next))
+		}
+	}
+}
@@ -1,186 +1,311 @@
 package storage
 
-// "ksql/src/disk"
+import (
+	"errors"
+	"fmt"
+)
 
 type (
-	BufferID uint64 // BufferPool.buffersのインデックスに使われる
-	// Page     [disk.PageSize]byte
-
-	// Buffer struct {
-	// 	pageID  disk.PageID
-	// 	page    Page
-	// 	isDirty bool
-	// }
-
-	// Frame struct {
-	// 	buffer         Buffer
-	// 	referencedTime time.Time // 最後に参照された時間
-	// }
-
-	// BufferPool struct {
-	// 	buffers []Frame
-	// 	cap     uint8 // buffersは際限なく増えるのでcapを決める
-	// }
-
-	// BufferPoolManager interface {
-	// 	FetchPage(pageID disk.PageID) (*Buffer, error)
-	// 	CreatePage() (*Buffer, error)
-	// 	Flush() error
-	// }
-
-	// BufferPoolManagerImpl struct {
-	// 	disk      disk.DiskManager
-	// 	pool      BufferPool
-	// 	pageTable map[disk.PageID]BufferID
-	// }
+	BufferID uint64 // BufferPool.framesのインデックスに使われる
+
+	Buffer struct {
+		PageID  PageID
+		Data    [PageSize]byte
+		IsDirty bool
+	}
+
+	Frame struct {
+		buffer   Buffer
+		pinCount uint32 // 0より大きい間は追い出し対象にならない
+	}
+
+	BufferPool struct {
+		frames   []Frame
+		cap      int // framesは際限なく増えるのでcapを決める
+		replacer Replacer
+	}
+
+	// 置き換えアルゴリズムを比較するための統計
+	BufferPoolStats struct {
+		Hits      uint64
+		Misses    uint64
+		Evictions uint64
+	}
+
+	// ページをメモリ上のフレームにキャッシュし、追い出す時にだけディスクに書き戻す
+	// DiskManagerも満たすので、PageやBPlustTreeにはDiskManagerの代わりに渡して使う
+	// SyncはFlushAllと同じで、Closeはdirtyなページを全て書き戻して永続化してからディスクを閉じる
+	BufferPoolManager interface {
+		DiskManager
+		FetchPage(pageID PageID) (*Buffer, error)
+		NewPage() (*Buffer, error)
+		UnpinPage(pageID PageID, isDirty bool) error
+		FlushPage(pageID PageID) error
+		FlushAll() error
+		Stats() BufferPoolStats
+	}
+
+	BufferPoolManagerImpl struct {
+		disk      DiskManager
+		pool      *BufferPool
+		pageTable map[PageID]BufferID
+		stats     BufferPoolStats
+		size      int64 // ディスクにまだ書き込まれていないページも含めたファイルサイズ
+	}
+)
+
+var (
+	ErrNoFreeFrame   = errors.New("all frames are pinned")
+	ErrPageNotPinned = errors.New("page is not pinned")
 )
 
 // BufferPool
-// func NewBufferPool(cap uint8) *BufferPool {
-// 	return &BufferPool{
-// 		make([]Frame, 0),
-// 		cap,
-// 	}
-// }
-
-// // 参照日時が一番古いbufferを削除対象とする
-// // LRUキャッシュは本来ダブル連結リストとハッシュを使った複雑なアルゴリズムだが本実装はO(n)を許容するため下記のようにした
-// func (bp *BufferPool) Evict() (*BufferID, error) {
-// 	// キャパに余裕がある場合はバッファは削除しない
-// 	if bp.HasRoom() {
-// 		return nil, nil
-// 	}
-
-// 	var (
-// 		refTime  time.Time = time.Now()
-// 		victimID BufferID
-// 		hasFound bool = false
-// 	)
-// 	for i, f := range bp.buffers {
-// 		if f.referencedTime.Before(refTime) {
-// 			refTime = f.referencedTime
-// 			victimID = BufferID(i)
-// 			hasFound = hasFound || true
-// 		}
-// 	}
-// 	if !hasFound {
-// 		return nil, errors.New("faied to find victim id")
-// 	}
-// 	return &victimID, nil
-// }
-
-// func (bp *BufferPool) HasRoom() bool {
-// 	return len(bp.buffers) < int(bp.cap)
-// }
-
-// func (bp *BufferPool) AddFrame(pageID disk.PageID, data Page) (BufferID, error) {
-// 	if bp.HasRoom() {
-// 		frame := Frame{
-// 			buffer: Buffer{
-// 				pageID:  pageID,
-// 				page:    data,
-// 				isDirty: false,
-// 			},
-// 			referencedTime: time.Now(),
-// 		}
-// 		bp.buffers = append(bp.buffers, frame)
-// 		return BufferID(len(bp.buffers) - 1), nil
-// 	}
-// 	return BufferID(0), errors.New("no room for new frame")
-// }
-
-// // BufferPoolManager
-// // 内部でpageTable作ろうとすると is not a type でる
-// // pageTable渡したらどうなる
-// // func NewBufferPoolManager(disk disk.DiskManager, pool BufferPool) BufferPoolManager {
-// // 	var pageTable map[disk.PageID]BufferID // disk.PageID is not a type
-// // 	return &BufferPoolManagerImpl{
-// // 		disk,
-// // 		pool,
-// // 		pageTable,
-// // 	}
-// // }
-
-// // FetchPageとCreatePageが似たような処理になっている
-// // バッファに新しくスペースを確保する処理を書く？
-// // というかCreatePageいる？？
-// func (bpm *BufferPoolManagerImpl) FetchPage(pageID disk.PageID) (*Buffer, error) {
-// 	if bufferID, ok := bpm.pageTable[pageID]; ok {
-// 		frame := bpm.pool.buffers[bufferID]
-// 		frame.referencedTime = time.Now()
-// 		return &frame.buffer, nil
-// 	}
-
-// 	var bufferID *BufferID
-// 	bufferID, err := bpm.pool.Evict()
-// 	if err != nil {
-// 		return nil, err
-// 	}
-
-// 	// 削除対象のバッファがなかったら新しく発番して、対象がある場合はディスクに書き込んでバッファから削除する
-// 	page := Page(bpm.disk.ReadPageData(pageID))
-// 	if bufferID == nil {
-// 		newBufferID, err := bpm.pool.AddFrame(pageID, page)
-// 		if err != nil {
-// 			return nil, err
-// 		}
-// 		bufferID = &newBufferID
-// 	} else {
-// 		bpm.EvictPage(*bufferID)
-// 		// 既存のframeを上書きするためポインタで取得する
-// 		frame := &bpm.pool.buffers[*bufferID]
-// 		frame.buffer.pageID = pageID
-// 		frame.buffer.isDirty = false
-// 		frame.buffer.page = page
-// 		frame.referencedTime = time.Now()
-// 	}
-
-// 	bpm.pageTable[pageID] = *bufferID
-// 	return &bpm.pool.buffers[*bufferID].buffer, nil
-// }
-
-// func (bpm *BufferPoolManagerImpl) CreatePage() (*Buffer, error) {
-// 	var bufferID *BufferID
-// 	bufferID, err := bpm.pool.Evict()
-// 	if err != nil {
-// 		return nil, err
-// 	}
-
-// 	// 削除対象があったらそれを置き換える
-// 	if bufferID != nil {
-// 		bpm.EvictPage(*bufferID)
-// 		frame := &bpm.pool.buffers[*bufferID]
-// 		frame.buffer = Buffer{
-// 			pageID: bpm.disk.AllocatePage(),
-// 		}
-// 		frame.referencedTime = time.Now()
-// 	} else {
-// 		newBufferID := BufferID(len(bpm.pool.buffers))
-// 		bufferID = &newBufferID
-// 	}
-// 	frame := Frame{
-// 		buffer: Buffer{
-// 			pageID: bpm.disk.AllocatePage(),
-// 		},
-// 		referencedTime: time.Now(),
-// 	}
-// 	bpm.pageTable[frame.buffer.pageID] = *bufferID
-// 	return &frame.buffer, nil
-// }
-
-// // ディスクに書き込んでバッファから削除する？
-// // 一旦後回し
-// func (bpm *BufferPoolManagerImpl) Flush() error {
-// 	return fmt.Errorf("")
-// }
-
-// func (bpm *BufferPoolManagerImpl) EvictPage(bufferID BufferID) {
-// 	frame := bpm.pool.buffers[bufferID]
-// 	evictPageID := frame.buffer.pageID
-
-// 	if frame.buffer.isDirty {
-// 		bpm.disk.WritePageData(evictPageID, frame.buffer.page[:])
-// 	}
-
-// 	delete(bpm.pageTable, evictPageID)
-// }
+func NewBufferPool(cap int, replacer Replacer) *BufferPool {
+	return &BufferPool{
+		make([]Frame, 0, cap),
+		cap,
+		replacer,
+	}
+}
+
+// pinされていないフレームの中からreplacerが選んだものを追い出し対象とする
+func (bp *BufferPool) Evict() (BufferID, error) {
+	victimID, ok := bp.replacer.Evict()
+	if !ok {
+		return 0, ErrNoFreeFrame
+	}
+	return victimID, nil
+}
+
+func (bp *BufferPool) HasRoom() bool {
+	return len(bp.frames) < bp.cap
+}
+
+// BufferPoolManager
+// replacerはcap個のフレームを扱えるものを渡す
+func NewBufferPoolManager(disk DiskManager, cap int, replacer Replacer) BufferPoolManager {
+	return &BufferPoolManagerImpl{
+		disk:      disk,
+		pool:      NewBufferPool(cap, replacer),
+		pageTable: map[PageID]BufferID{},
+	}
+}
+
+// ページをpinして返す。使い終わったらUnpinPageを呼ぶ必要がある
+func (bpm *BufferPoolManagerImpl) FetchPage(pageID PageID) (*Buffer, error) {
+	if bufferID, ok := bpm.pageTable[pageID]; ok {
+		bpm.stats.Hits += 1
+		bpm.pin(bufferID)
+		return &bpm.pool.frames[bufferID].buffer, nil
+	}
+
+	bpm.stats.Misses += 1
+	data, err := bpm.disk.ReadPageData(pageID)
+	if err != nil {
+		return nil, err
+	}
+	bufferID, err := bpm.allocateFrame(pageID)
+	if err != nil {
+		return nil, err
+	}
+	frame := &bpm.pool.frames[bufferID]
+	frame.buffer.Data = data
+	bpm.pin(bufferID)
+	return &frame.buffer, nil
+}
+
+// ディスク上に新しいページを割り当ててpinした状態で返す
+func (bpm *BufferPoolManagerImpl) NewPage() (*Buffer, error) {
+	pageID := bpm.AllocatePage()
+	bufferID, err := bpm.allocateFrame(pageID)
+	if err != nil {
+		return nil, err
+	}
+	frame := &bpm.pool.frames[bufferID]
+	frame.buffer.IsDirty = true
+	bpm.pin(bufferID)
+	return &frame.buffer, nil
+}
+
+// isDirtyがtrueの場合は追い出す時にディスクに書き戻す
+func (bpm *BufferPoolManagerImpl) UnpinPage(pageID PageID, isDirty bool) error {
+	bufferID, ok := bpm.pageTable[pageID]
+	if !ok {
+		return fmt.Errorf("page %d is not in buffer pool", pageID)
+	}
+	frame := &bpm.pool.frames[bufferID]
+	if frame.pinCount == 0 {
+		return ErrPageNotPinned
+	}
+	frame.pinCount -= 1
+	frame.buffer.IsDirty = frame.buffer.IsDirty || isDirty
+	if frame.pinCount == 0 {
+		bpm.pool.replacer.SetEvictable(bufferID, true)
+	}
+	return nil
+}
+
+func (bpm *BufferPoolManagerImpl) FlushPage(pageID PageID) error {
+	bufferID, ok := bpm.pageTable[pageID]
+	if !ok {
+		return fmt.Errorf("page %d is not in buffer pool", pageID)
+	}
+	return bpm.writeBack(bufferID)
+}
+
+// dirtyなページを全て書き戻してからディスクをSyncする
+func (bpm *BufferPoolManagerImpl) FlushAll() error {
+	for i := range bpm.pool.frames {
+		if err := bpm.writeBack(BufferID(i)); err != nil {
+			return err
+		}
+	}
+	return bpm.disk.Sync()
+}
+
+func (bpm *BufferPoolManagerImpl) Stats() BufferPoolStats {
+	return bpm.stats
+}
+
+func (bpm *BufferPoolManagerImpl) AllocatePage() PageID {
+	pageID := bpm.disk.AllocatePage()
+	bpm.grow(pageID)
+	return pageID
+}
+
+// すぐにディスク側で割り当て直せるように、追い出しを待たずにディスクに解放済みの印を書く
+// フレームに残っている場合は、書き戻さずにディスクと同じ内容に置き換える
+func (bpm *BufferPoolManagerImpl) DeallocatePage(pageID PageID) error {
+	if bufferID, ok := bpm.pageTable[pageID]; ok {
+		if bpm.pool.frames[bufferID].pinCount > 0 {
+			return fmt.Errorf("page %d is pinned", pageID)
+		}
+		buffer := &bpm.pool.frames[bufferID].buffer
+		buffer.Data = freePageData(pageID)
+		buffer.IsDirty = false
+	}
+	return bpm.disk.DeallocatePage(pageID)
+}
+
+// フレームにコピーしてすぐにunpinする
+func (bpm *BufferPoolManagerImpl) ReadPageData(pageID PageID) ([PageSize]byte, error) {
+	buffer, err := bpm.FetchPage(pageID)
+	if err != nil {
+		return [PageSize]byte{}, err
+	}
+	data := buffer.Data
+	return data, bpm.UnpinPage(pageID, false)
+}
+
+// ページ全体を上書きするのでディスクからは読み込まずにフレームを確保する
+// 全てのフレームがpinされている場合はディスクに直接書き込む
+func (bpm *BufferPoolManagerImpl) WritePageData(pageID PageID, data [PageSize]byte) error {
+	bpm.grow(pageID)
+	bufferID, ok := bpm.pageTable[pageID]
+	if !ok {
+		var err error
+		if bufferID, err = bpm.allocateFrame(pageID); err == ErrNoFreeFrame {
+			return bpm.disk.WritePageData(pageID, data)
+		} else if err != nil {
+			return err
+		}
+	}
+	frame := &bpm.pool.frames[bufferID]
+	frame.buffer.Data = data
+	frame.buffer.IsDirty = true
+	bpm.pool.replacer.RecordAccess(bufferID)
+	if frame.pinCount == 0 {
+		bpm.pool.replacer.SetEvictable(bufferID, true)
+	}
+	return nil
+}
+
+func (bpm *BufferPoolManagerImpl) Sync() error {
+	return bpm.FlushAll()
+}
+
+// 書き戻しに失敗した場合もディスクは閉じる
+func (bpm *BufferPoolManagerImpl) Close() error {
+	if err := bpm.FlushAll(); err != nil {
+		bpm.disk.Close()
+		return err
+	}
+	return bpm.disk.Close()
+}
+
+// まだディスクに書き戻されていないページも含めたサイズを返す
+func (bpm *BufferPoolManagerImpl) FSize() (int64, error) {
+	fSize, err := bpm.disk.FSize()
+	if err != nil {
+		return 0, err
+	}
+	if fSize > bpm.size {
+		return fSize, nil
+	}
+	return bpm.size, nil
+}
+
+// pageIDのためのフレームを確保する。空きがない場合は追い出してから確保する
+// 確保したフレームはpinされておらず、中身は空になっている
+func (bpm *BufferPoolManagerImpl) allocateFrame(pageID PageID) (BufferID, error) {
+	var bufferID BufferID
+	if bpm.pool.HasRoom() {
+		bpm.pool.frames = append(bpm.pool.frames, Frame{})
+		bufferID = BufferID(len(bpm.pool.frames) - 1)
+	} else {
+		victimID, err := bpm.pool.Evict()
+		if err != nil {
+			return 0, err
+		}
+		if err := bpm.evictPage(victimID); err != nil {
+			return 0, err
+		}
+		bufferID = victimID
+	}
+	bpm.pool.frames[bufferID] = Frame{
+		buffer: Buffer{
+			PageID: pageID,
+		},
+	}
+	bpm.pageTable[pageID] = bufferID
+	return bufferID, nil
+}
+
+// ディスクに書き込んでバッファから削除する
+// 書き込みに失敗した場合はフレームを追い出し可能に戻してそのまま残す
+func (bpm *BufferPoolManagerImpl) evictPage(bufferID BufferID) error {
+	if err := bpm.writeBack(bufferID); err != nil {
+		bpm.pool.replacer.RecordAccess(bufferID)
+		bpm.pool.replacer.SetEvictable(bufferID, true)
+		return err
+	}
+	bpm.stats.Evictions += 1
+	bpm.pool.replacer.Remove(bufferID)
+	delete(bpm.pageTable, bpm.pool.frames[bufferID].buffer.PageID)
+	return nil
+}
+
+func (bpm *BufferPoolManagerImpl) writeBack(bufferID BufferID) error {
+	buffer := &bpm.pool.frames[bufferID].buffer
+	if !buffer.IsDirty {
+		return nil
+	}
+	if err := bpm.disk.WritePageData(buffer.PageID, buffer.Data); err != nil {
+		return err
+	}
+	buffer.IsDirty = false
+	return nil
+}
+
+func (bpm *BufferPoolManagerImpl) grow(pageID PageID) {
+	if size := int64(pageID+1) * PageSize; size > bpm.size {
+		bpm.size = size
+	}
+}
+
+// 参照を記録してpinする。pinされている間は追い出されない
+func (bpm *BufferPoolManagerImpl) pin(bufferID BufferID) {
+	bpm.pool.frames[bufferID].pinCount += 1
+	bpm.pool.replacer.RecordAccess(bufferID)
+	bpm.pool.replacer.SetEvictable(bufferID, false)
+}
@@ -1,287 +1,215 @@
 package storage
 
 import (
+	"os"
+	"strconv"
+
 	. "github.com/onsi/ginkgo/v2"
-	// . "github.com/onsi/gomega"
+	. "github.com/onsi/gomega"
 )
 
-var _ = Describe("", func() {})
+// ディスクへの読み書きの回数を数える
+type countingDiskManager struct {
+	DiskManager
+	reads  map[PageID]int
+	writes map[PageID]int
+}
+
+func newCountingDiskManager(dm DiskManager) *countingDiskManager {
+	return &countingDiskManager{dm, map[PageID]int{}, map[PageID]int{}}
+}
+
+func (dm *countingDiskManager) ReadPageData(pageID PageID) ([PageSize]byte, error) {
+	dm.reads[pageID] += 1
+	return dm.DiskManager.ReadPageData(pageID)
+}
 
-// var _ = Describe("BufferPoolのテスト", func() {
-// 	Describe("Evictのテスト", func() {
-// 		var (
-// 			bp BufferPool
+func (dm *countingDiskManager) WritePageData(pageID PageID, data [PageSize]byte) error {
+	dm.writes[pageID] += 1
+	return dm.DiskManager.WritePageData(pageID, data)
+}
 
-// 			buffers []Frame
-// 			cap     uint8
+var _ = Describe("BufferPoolManagerのテスト", func() {
+	var (
+		disk *countingDiskManager
+		bpm  BufferPoolManager
+	)
+	BeforeEach(func() {
+		f := createTestFile("buffer_pool_test_table")
+		dm, _ := NewDiskManager(f)
+		disk = newCountingDiskManager(dm)
+		// PageID0~3にページの番号を書き込んでおく
+		for i := 0; i < 4; i++ {
+			var data [PageSize]byte
+			data[0] = byte(i)
+			disk.DiskManager.WritePageData(disk.AllocatePage(), data)
+		}
+		bpm = NewBufferPoolManager(disk, 2, NewLRUReplacer())
+	})
+	Describe("FetchPage", func() {
+		Context("同じページを2回取得した場合", func() {
+			It("ディスクからは1回だけ読み込まれる", func() {
+				buffer, err := bpm.FetchPage(PageID(1))
+				Expect(err).To(BeNil())
+				Expect(buffer.Data[0]).To(Equal(byte(1)))
+				Expect(bpm.UnpinPage(PageID(1), false)).To(Succeed())
 
-// 			bufferIDp *BufferID
-// 		)
-// 		JustBeforeEach(func() {
-// 			bp = BufferPool{
-// 				buffers,
-// 				cap,
-// 			}
-// 			bufferIDp, _ = bp.Evict()
-// 		})
-// 		Context("buffersが空の場合", func() {
-// 			BeforeEach(func() {
-// 				buffers = []Frame{}
-// 				cap = 1
-// 			})
-// 			It("bufferIDはnil", func() {
-// 				Expect(bufferIDp).To(BeNil())
-// 			})
-// 		})
-// 		Context("bufferが一杯の場合場合", func() {
-// 			BeforeEach(func() {
-// 				buffers = []Frame{
-// 					{
-// 						referencedTime: time.Date(2024, time.January, 31, 23, 10, 10, 1, time.Local),
-// 					},
-// 					{
-// 						referencedTime: time.Date(2024, time.January, 30, 23, 10, 10, 1, time.Local),
-// 					},
-// 					{
-// 						referencedTime: time.Date(2024, time.January, 31, 13, 10, 10, 1, time.Local),
-// 					},
-// 				}
-// 				cap = 3
-// 			})
-// 			It("2つ目のbufferが返される", func() {
-// 				Expect(*bufferIDp).To(Equal(BufferID(1)))
-// 			})
-// 		})
-// 	})
-// })
+				buffer, err = bpm.FetchPage(PageID(1))
+				Expect(err).To(BeNil())
+				Expect(buffer.Data[0]).To(Equal(byte(1)))
+				Expect(disk.reads[PageID(1)]).To(Equal(1))
+			})
+		})
+		Context("フレームが一杯の場合", func() {
+			It("参照が一番古いページが追い出され、dirtyなら書き戻される", func() {
+				buffer, _ := bpm.FetchPage(PageID(1))
+				buffer.Data[1] = 100
+				Expect(bpm.UnpinPage(PageID(1), true)).To(Succeed())
+				bpm.FetchPage(PageID(2))
+				bpm.UnpinPage(PageID(2), false)
 
-// var _ = Describe("BufferPoolManagerのテスト", func() {
-// 	Describe("FetchPageのテスト", func() {
-// 		var (
-// 			bpm *BufferPoolManagerImpl
+				_, err := bpm.FetchPage(PageID(3))
+				Expect(err).To(BeNil())
+				Expect(disk.writes[PageID(1)]).To(Equal(1))
+				Expect(disk.writes[PageID(2)]).To(Equal(0))
+				data, _ := disk.DiskManager.ReadPageData(PageID(1))
+				Expect(data[1]).To(Equal(byte(100)))
+				Expect(bpm.Stats()).To(Equal(BufferPoolStats{Hits: 0, Misses: 3, Evictions: 1}))
+			})
+		})
+		Context("pinされているページがある場合", func() {
+			It("pinされているページは追い出されない", func() {
+				bpm.FetchPage(PageID(1))
+				bpm.FetchPage(PageID(2))
+				bpm.UnpinPage(PageID(2), false)
 
-// 			pool      BufferPool
-// 			pageTable map[disk.PageID]BufferID
+				_, err := bpm.FetchPage(PageID(3))
+				Expect(err).To(BeNil())
+				buffer, err := bpm.FetchPage(PageID(1))
+				Expect(err).To(BeNil())
+				Expect(buffer.Data[0]).To(Equal(byte(1)))
+				Expect(disk.reads[PageID(1)]).To(Equal(1))
+			})
+		})
+		Context("ディスクからの読み込みに失敗した場合", func() {
+			It("errが返りフレームは確保されない", func() {
+				_, err := bpm.FetchPage(PageID(10))
+				Expect(err).NotTo(BeNil())
+				Expect(bpm.UnpinPage(PageID(10), false)).NotTo(Succeed())
+			})
+		})
+		Context("全てのページがpinされている場合", func() {
+			It("ErrNoFreeFrameが返る", func() {
+				bpm.FetchPage(PageID(1))
+				bpm.FetchPage(PageID(2))
 
-// 			pageID disk.PageID
+				_, err := bpm.FetchPage(PageID(3))
+				Expect(err).To(Equal(ErrNoFreeFrame))
+			})
+		})
+	})
+	Describe("NewPage", func() {
+		It("新しいPageIDのページがpinされた状態で返る", func() {
+			buffer, err := bpm.NewPage()
+			Expect(err).To(BeNil())
+			Expect(buffer.PageID).To(Equal(PageID(4)))
+			Expect(bpm.FSize()).To(Equal(int64(5 * PageSize)))
+			bpm.FetchPage(PageID(1))
+			_, err = bpm.FetchPage(PageID(2))
+			Expect(err).To(Equal(ErrNoFreeFrame))
+		})
+	})
+	Describe("UnpinPage", func() {
+		Context("バッファにないページの場合", func() {
+			It("errが返る", func() {
+				Expect(bpm.UnpinPage(PageID(1), false)).NotTo(Succeed())
+			})
+		})
+		Context("pinされていないページの場合", func() {
+			It("ErrPageNotPinnedが返る", func() {
+				bpm.FetchPage(PageID(1))
+				Expect(bpm.UnpinPage(PageID(1), false)).To(Succeed())
+				Expect(bpm.UnpinPage(PageID(1), false)).To(Equal(ErrPageNotPinned))
+			})
+		})
+	})
+	Describe("FlushPage・FlushAll", func() {
+		It("dirtyなページだけがディスクに書き込まれる", func() {
+			buffer, _ := bpm.FetchPage(PageID(1))
+			buffer.Data[1] = 10
+			bpm.UnpinPage(PageID(1), true)
+			buffer, _ = bpm.FetchPage(PageID(2))
+			buffer.Data[1] = 20
+			bpm.UnpinPage(PageID(2), true)
 
-// 			buffer *Buffer
-// 			err    error
-// 		)
-// 		JustBeforeEach(func() {
-// 			bpm = &BufferPoolManagerImpl{
-// 				disk.MockDiskManagerImpl{},
-// 				pool,
-// 				pageTable,
-// 			}
-// 			buffer, err = bpm.FetchPage(pageID)
-// 		})
-// 		Context("取得対象がすでにbufferにある場合", func() {
-// 			BeforeEach(func() {
-// 				pool = BufferPool{
-// 					[]Frame{
-// 						{
-// 							buffer: Buffer{
-// 								disk.PageID(4),
-// 								[disk.PageSize]byte{2},
-// 								false,
-// 							},
-// 						},
-// 						{
-// 							buffer: Buffer{
-// 								disk.PageID(1),
-// 								[disk.PageSize]byte{1},
-// 								false,
-// 							},
-// 						},
-// 					},
-// 					2,
-// 				}
-// 				pageTable = map[disk.PageID]BufferID{
-// 					disk.PageID(4): BufferID(0),
-// 					disk.PageID(1): BufferID(1),
-// 				}
-// 				pageID = disk.PageID(1)
-// 			})
-// 			It("pageID1のbufferが取得される", func() {
-// 				Expect(buffer.pageID).To(Equal(pageID))
-// 				Expect(buffer.page[0]).To(Equal(byte(1)))
-// 			})
-// 			It("errはnil", func() {
-// 				Expect(err).To(BeNil())
-// 			})
-// 		})
-// 		Context("取得対象がbufferに存在しない場合", func() {
-// 			Context("キャパに余裕がある場合", func() {
-// 				BeforeEach(func() {
-// 					pool = BufferPool{
-// 						[]Frame{
-// 							{
-// 								buffer: Buffer{
-// 									disk.PageID(4),
-// 									[disk.PageSize]byte{2},
-// 									false,
-// 								},
-// 							},
-// 							{
-// 								buffer: Buffer{
-// 									disk.PageID(1),
-// 									[disk.PageSize]byte{3},
-// 									false,
-// 								},
-// 							},
-// 						},
-// 						3,
-// 					}
-// 					pageTable = map[disk.PageID]BufferID{
-// 						disk.PageID(4): BufferID(0),
-// 						disk.PageID(1): BufferID(1),
-// 					}
-// 					pageID = disk.PageID(3)
-// 				})
-// 				It("pageID3のbufferが取得される", func() {
-// 					Expect(buffer.pageID).To(Equal(pageID))
-// 					Expect(buffer.page[0]).To(Equal(byte(1)))
-// 				})
-// 				It("pageIDのbufferが作成される", func() {
-// 					Expect(bpm.pageTable[disk.PageID(0)]).To(Equal(BufferID(0)))
-// 				})
-// 				It("errはnil", func() {
-// 					Expect(err).To(BeNil())
-// 				})
-// 			})
-// 			Context("キャパに余裕がない場合", func() {
-// 				BeforeEach(func() {
-// 					pool = BufferPool{
-// 						[]Frame{
-// 							{
-// 								buffer: Buffer{
-// 									disk.PageID(4),
-// 									[disk.PageSize]byte{2},
-// 									false,
-// 								},
-// 								referencedTime: time.Date(2024, time.January, 31, 0, 0, 0, 0, time.Local),
-// 							},
-// 							{
-// 								buffer: Buffer{
-// 									disk.PageID(1),
-// 									[disk.PageSize]byte{2},
-// 									false,
-// 								},
-// 								referencedTime: time.Date(2024, time.January, 30, 0, 0, 0, 0, time.Local),
-// 							},
-// 						},
-// 						2,
-// 					}
-// 					pageTable = map[disk.PageID]BufferID{
-// 						disk.PageID(4): BufferID(0),
-// 						disk.PageID(1): BufferID(1),
-// 					}
-// 					pageID = disk.PageID(0)
-// 				})
-// 				It("pageID0のbufferが取得される", func() {
-// 					Expect(buffer.pageID).To(Equal(pageID))
-// 					Expect(buffer.page[0]).To(Equal(byte(1)))
-// 				})
-// 				It("page1のバッファが削除されて、代わりにpageID0のバッファが作成される", func() {
-// 					_, ok := bpm.pageTable[disk.PageID(1)]
-// 					Expect(ok).To(BeFalse())
-// 					Expect(bpm.pageTable[pageID]).To(Equal(BufferID(1)))
-// 				})
-// 				It("errはnil", func() {
-// 					Expect(err).To(BeNil())
-// 				})
-// 			})
-// 		})
-// 	})
-// 	Describe("CreatePageのテスト", func() {
-// 		var (
-// 			bpm *BufferPoolManagerImpl
+			Expect(bpm.FlushPage(PageID(1))).To(Succeed())
+			Expect(disk.writes[PageID(1)]).To(Equal(1))
+			Expect(disk.writes[PageID(2)]).To(Equal(0))
 
-// 			pool      BufferPool
-// 			pageTable map[disk.PageID]BufferID
+			Expect(bpm.FlushAll()).To(Succeed())
+			Expect(disk.writes[PageID(1)]).To(Equal(1))
+			Expect(disk.writes[PageID(2)]).To(Equal(1))
+			data, _ := disk.DiskManager.ReadPageData(PageID(2))
+			Expect(data[1]).To(Equal(byte(20)))
+		})
+	})
+	Describe("Close", func() {
+		It("dirtyなページを書き戻して永続化してからディスクを閉じる", func() {
+			f := newCrashableFile()
+			dm, _ := NewDiskManager(f)
+			bpm = NewBufferPoolManager(dm, 16, NewLRUReplacer())
+			NewTable2(bpm, ColumnSize)
+			os.Setenv(BytesSizeLimitKey, strconv.Itoa(84))
+			btree, _ := NewBPlustTree(bpm)
+			var i uint32
+			for i = 0; i < 100; i++ {
+				Expect(btree.InsertPair(bpm, NewBytes(i), NewBytes(i))).To(Succeed())
+			}
+			Expect(bpm.Close()).To(Succeed())
+			Expect(f.closed).To(BeTrue())
 
-// 			buffer *Buffer
-// 			err    error
-// 		)
-// 		JustBeforeEach(func() {
-// 			bpm = &BufferPoolManagerImpl{
-// 				disk.MockDiskManagerImpl{},
-// 				pool,
-// 				pageTable,
-// 			}
-// 			buffer, err = bpm.CreatePage()
-// 		})
-// 		Context("キャパが一杯の場合", func() {
-// 			BeforeEach(func() {
-// 				pool = BufferPool{
-// 					[]Frame{
-// 						{
-// 							buffer: Buffer{
-// 								pageID: disk.PageID(2),
-// 							},
-// 							referencedTime: time.Date(2024, time.February, 1, 0, 0, 0, 0, time.Local),
-// 						},
-// 						{
-// 							buffer: Buffer{
-// 								pageID: disk.PageID(1),
-// 							},
-// 							referencedTime: time.Date(2024, time.February, 1, 1, 0, 0, 0, time.Local),
-// 						},
-// 					},
-// 					2,
-// 				}
-// 				pageTable = map[disk.PageID]BufferID{
-// 					disk.PageID(2): BufferID(0),
-// 					disk.PageID(1): BufferID(1),
-// 				}
-// 			})
-// 			It("pageTableからpageID:0に対するバッファがなくなっている", func() {
-// 				fmt.Println("bpm.pageTable: ", bpm.pageTable)
-// 				_, ok := bpm.pageTable[disk.PageID(0)]
-// 				Expect(ok).To(BeFalse())
-// 			})
-// 			It("pageID: 3に対するバッファが新しく作られている", func() {
-// 				Expect(bpm.pageTable[disk.PageID(3)]).To(Equal(BufferID(0)))
-// 			})
-// 			It("errはnil", func() {
-// 				Expect(err).To(BeNil())
-// 			})
-// 		})
-// 		Context("キャパに余裕がある場合", func() {
-// 			BeforeEach(func() {
-// 				pool = BufferPool{
-// 					[]Frame{
-// 						{
-// 							buffer: Buffer{
-// 								pageID: disk.PageID(2),
-// 							},
-// 							referencedTime: time.Date(2024, time.February, 1, 0, 0, 0, 0, time.Local),
-// 						},
-// 						{
-// 							buffer: Buffer{
-// 								pageID: disk.PageID(1),
-// 							},
-// 							referencedTime: time.Date(2024, time.February, 1, 1, 0, 0, 0, time.Local),
-// 						},
-// 					},
-// 					3,
-// 				}
-// 				pageTable = map[disk.PageID]BufferID{
-// 					disk.PageID(2): BufferID(0),
-// 					disk.PageID(1): BufferID(1),
-// 				}
-// 			})
-// 			It("pageID: 1に対するバッファが残っている", func() {
-// 				Expect(bpm.pageTable[disk.PageID(1)]).To(Equal(BufferID(1)))
-// 			})
-// 			It("pageID: 3に対するバッファが新しく作成される", func() {
-// 				Expect(bpm.pageTable[disk.PageID(3)]).To(Equal(BufferID(2)))
-// 				Expect(buffer.pageID).To(Equal(disk.PageID(3)))
-// 			})
-// 			It("errはnil", func() {
-// 				Expect(err).To(BeNil())
-// 			})
-// 		})
-// 	})
-// })
+			f.crash()
+			reopened, _ := NewDiskManager(f)
+			btree, err := NewBPlustTree(reopened)
+			Expect(err).To(BeNil())
+			for i = 0; i < 100; i++ {
+				value, found, err := btree.Get(reopened, NewBytes(i))
+				Expect(err).To(BeNil())
+				Expect(found).To(BeTrue())
+				Expect(value).To(Equal(NewBytes(i)))
+			}
+		})
+	})
+	Describe("BPlustTreeから使う場合", func() {
+		var (
+			btree *BPlustTree
+		)
+		BeforeEach(func() {
+			f := createTestFile("buffer_pool_btree_test_table")
+			dm, _ := NewDiskManager(f)
+			disk = newCountingDiskManager(dm)
+			bpm = NewBufferPoolManager(disk, 16, NewLRUReplacer())
+			NewTable2(bpm, ColumnSize)
+			os.Setenv(BytesSizeLimitKey, strconv.Itoa(84))
+			btree, _ = NewBPlustTree(bpm)
+			var i uint32
+			for i = 0; i < 100; i++ {
+				Expect(btree.InsertPair(bpm, NewBytes(i), NewBytes(i))).To(Succeed())
+			}
+		})
+		It("rootは毎回ディスクから読み込まれない", func() {
+			Expect(disk.reads[RootPageID]).To(BeNumerically("<", 10))
+		})
+		It("FlushAllの後はディスクから全てのキーが読める", func() {
+			Expect(bpm.FlushAll()).To(Succeed())
+			reopened, _ := NewBPlustTree(disk.DiskManager)
+			var i uint32
+			for i = 0; i < 100; i++ {
+				value, found, err := reopened.Get(disk.DiskManager, NewBytes(i))
+				Expect(err).To(BeNil())
+				Expect(found).To(BeTrue())
+				Expect(value).To(Equal(NewBytes(i)))
+			}
+		})
+	})
+})
@@ -0,0 +1,272 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+)
+
+type (
+	// BulkLoadに渡す、キーの昇順にpairを返すイテレータ。Cursorもこれを満たす
+	PairIterator interface {
+		Next() bool
+		Key() Bytes
+		Value() Bytes
+		Err() error
+	}
+
+	pairSliceIterator struct {
+		pairs []Pair
+		index int
+	}
+
+	// BulkLoadで組み立てている途中の1つの階層
+	// curに詰めている途中のページ、doneに詰め終わって右隣のcurが閉じるまで書き込みを待っているページを持つ
+	// doneを残しておくことで、最後のページが小さい場合にdoneと併合・再分配できる
+	bulkLevel struct {
+		nodeType NodeType
+		cur      *Page
+		done     *Page
+		count    int // この階層に作ったページの数
+	}
+
+	bulkLoader struct {
+		dm     DiskManager
+		target uint32
+		levels []*bulkLevel
+	}
+)
+
+var (
+	ErrTreeNotEmpty      = errors.New("tree is not empty")
+	ErrUnsortedInput     = errors.New("input is not sorted")
+	ErrInvalidFillFactor = errors.New("fill factor must be in (0, 1]")
+)
+
+// pairsを順に返すPairIteratorを作る
+func NewPairIterator(pairs []Pair) PairIterator {
+	return &pairSliceIterator{pairs, -1}
+}
+
+func (it *pairSliceIterator) Next() bool {
+	it.index += 1
+	return it.index < len(it.pairs)
+}
+
+func (it *pairSliceIterator) Key() Bytes {
+	return it.pairs[it.index].Key
+}
+
+func (it *pairSliceIterator) Value() Bytes {
+	return it.pairs[it.index].Value
+}
+
+func (it *pairSliceIterator) Err() error {
+	return nil
+}
+
+// キーの昇順に並んだpairから空の木を組み立てる
+// leafを左から順にLimitBytesSizeのfillFactorの割合まで詰め、いっぱいになったページのキーを1つ上の階層に渡して中間ノードも同時に組み立てる
+// 各ページはPrevPageID・NextPageID・ParentID・RightPointerが決まった時点で1度だけ書き込む
+// 右端のページが下限を下回る場合は、書き込む前に左隣のページと併合・再分配する
+// キーが昇順でない(同じキーが続く場合も含む)場合はErrUnsortedInputを返す
+func (b *BPlustTree) BulkLoad(dm DiskManager, it PairIterator, fillFactor float64) error {
+	if fillFactor <= 0 || fillFactor > 1 {
+		return fmt.Errorf("%w: %v", ErrInvalidFillFactor, fillFactor)
+	}
+	if b.RootNodeID != InvalidPageID {
+		return ErrTreeNotEmpty
+	}
+	return b.atomically(dm, func() error {
+		l := &bulkLoader{
+			dm:     dm,
+			target: fillTarget(fillFactor),
+		}
+		var prev Bytes
+		var count int64
+		for it.Next() {
+			key := it.Key()
+			if err := b.checkKeyLen(key); err != nil {
+				return err
+			}
+			if count > 0 && prev.Compare(key, b.internalKeyLen()) != ComparisonResultSmall {
+				return fmt.Errorf("%w: key %d is not greater than the previous key", ErrUnsortedInput, count)
+			}
+			value, err := writeValue(dm, key, it.Value())
+			if err != nil {
+				return err
+			}
+			prev = append(prev[:0], key...)
+			if err := l.add(0, append(Bytes{}, key...), value); err != nil {
+				return err
+			}
+			count += 1
+		}
+		if err := it.Err(); err != nil {
+			return err
+		}
+		if count == 0 {
+			return b.CreateRoot(dm)
+		}
+		rootID, err := l.finish()
+		if err != nil {
+			return err
+		}
+		b.RootNodeID, b.restructured = rootID, true
+		return b.saveHeader(dm, count)
+	})
+}
+
+// depthの階層(0がleaf)にpairを追加する。ページがtargetを超える場合は新しいページに移る
+func (l *bulkLoader) add(depth int, key, value Bytes) error {
+	if depth == len(l.levels) {
+		nodeType := NodeTypeBranch
+		if depth == 0 {
+			nodeType = NodeTypeLeaf
+		}
+		l.levels = append(l.levels, &bulkLevel{nodeType: nodeType})
+	}
+	level := l.levels[depth]
+	if cur := level.cur; cur != nil && l.full(cur, key, value) {
+		if err := l.seal(depth); err != nil {
+			return err
+		}
+	}
+	if level.cur == nil {
+		l.open(depth)
+	}
+	level.cur.Items = append(level.cur.Items, Pair{key, value})
+	return nil
+}
+
+// key,valueを追加するとtargetを超えるか。中間ノードには少なくとも2つの子を持たせる
+func (l *bulkLoader) full(page *Page, key, value Bytes) bool {
+	if page.NodeType == NodeTypeBranch && len(page.Items) < 2 {
+		return false
+	}
+	return len(page.Items) > 0 && sealedNBytes(page)+SlotNByte+key.Len()+value.Len() > l.target
+}
+
+// 詰めている途中のページを閉じた後のバイト数
+// 中間ノードは最後のitemをRightPointerにするので、その分を除いて数える
+func sealedNBytes(page *Page) uint32 {
+	nBytes := page.NBytes()
+	if page.NodeType == NodeTypeBranch && len(page.Items) > 0 {
+		last := page.Items[len(page.Items)-1]
+		nBytes -= SlotNByte + last.Key.Len() + last.Value.Len()
+	}
+	return nBytes
+}
+
+// 新しいページを割り当て、doneと双方向に繋ぐ
+func (l *bulkLoader) open(depth int) {
+	level := l.levels[depth]
+	level.cur = &Page{
+		PageID:   l.dm.AllocatePage(),
+		NodeType: level.nodeType,
+		Items:    []Pair{},
+	}
+	level.count += 1
+	if level.done != nil {
+		level.cur.PrevPageID = level.done.PageID
+		level.done.NextPageID = level.cur.PageID
+	}
+}
+
+// 詰め終わったページを1つ上の階層に渡してdoneにする。それまでのdoneはもう変わらないので書き込む
+func (l *bulkLoader) seal(depth int) error {
+	level := l.levels[depth]
+	if level.done != nil {
+		if err := level.done.Flush(l.dm); err != nil {
+			return err
+		}
+	}
+	page := level.cur
+	last := page.Items[len(page.Items)-1]
+	if page.NodeType == NodeTypeBranch {
+		page.RightPointer = PageID(last.Value.Uint32(0))
+		page.Items = page.Items[:len(page.Items)-1]
+	}
+	if err := l.add(depth+1, last.Key, NewBytes(uint32(page.PageID))); err != nil {
+		return err
+	}
+	page.ParentID = l.levels[depth+1].cur.PageID
+	level.cur = nil
+	level.done = page
+	return nil
+}
+
+// 入力の終わりに、下の階層から順に残っているページを閉じてrootのPageIDを返す
+// ページが1つしかない一番上の階層がrootになる
+func (l *bulkLoader) finish() (PageID, error) {
+	for depth := 0; ; depth++ {
+		if err := l.balanceLast(depth); err != nil {
+			return InvalidPageID, err
+		}
+		level := l.levels[depth]
+		if depth == len(l.levels)-1 && level.count == 1 {
+			root := level.cur
+			if root.NodeType == NodeTypeBranch {
+				root.RightPointer = PageID(root.Items[len(root.Items)-1].Value.Uint32(0))
+				root.Items = root.Items[:len(root.Items)-1]
+			}
+			root.ParentID = InvalidPageID
+			return root.PageID, root.Flush(l.dm)
+		}
+		if err := l.seal(depth); err != nil {
+			return InvalidPageID, err
+		}
+		if err := level.done.Flush(l.dm); err != nil {
+			return InvalidPageID, err
+		}
+	}
+}
+
+// 最後のページは入力の残りだけで作るので、下限を下回ることがある
+// その場合はdoneを閉じる前の状態に戻し、1ページに収まれば併合し、収まらなければバイト数が同じくらいになるように再分配する
+// 子が移ったページはLinkToChildで子のParentIDを付け替える
+func (l *bulkLoader) balanceLast(depth int) error {
+	level := l.levels[depth]
+	cur, done := level.cur, level.done
+	if done == nil || sealedNBytes(cur) >= MinBytesSize() {
+		return nil
+	}
+	upper := l.levels[depth+1]
+	separator := upper.cur.Items[len(upper.cur.Items)-1].Key
+	upper.cur.Items = upper.cur.Items[:len(upper.cur.Items)-1]
+	if done.NodeType == NodeTypeBranch {
+		done.Items = append(done.Items, Pair{separator, NewBytes(uint32(done.RightPointer))})
+		done.RightPointer = InvalidPageID
+	}
+
+	items := append(append([]Pair{}, done.Items...), cur.Items...)
+	if sealedNBytes(&Page{NodeType: cur.NodeType, Items: items}) <= LimitBytesSize() {
+		done.Items = items
+		done.NextPageID = InvalidPageID
+		if err := l.dm.DeallocatePage(cur.PageID); err != nil {
+			return err
+		}
+		level.cur, level.done = done, nil
+		level.count -= 1
+		// doneだけを持っていた一番上の階層は不要になる
+		if upper.count == 1 && len(upper.cur.Items) == 0 {
+			if err := l.dm.DeallocatePage(upper.cur.PageID); err != nil {
+				return err
+			}
+			l.levels = l.levels[:depth+1]
+		}
+		return done.LinkToChild(l.dm)
+	}
+
+	for sealedNBytes(cur) < sealedNBytes(done) {
+		last := done.Items[len(done.Items)-1]
+		done.Items = done.Items[:len(done.Items)-1]
+		cur.Items = append([]Pair{last}, cur.Items...)
+	}
+	// doneを閉じ直す。doneの左隣は既に書き込んであるのでdoneを空にしておく
+	level.cur, level.done = done, nil
+	if err := l.seal(depth); err != nil {
+		return err
+	}
+	level.cur = cur
+	return cur.LinkToChild(l.dm)
+}
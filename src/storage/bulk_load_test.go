@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("BulkLoadのテスト", func() {
+	var (
+		dm    DiskManager
+		btree *BPlustTree
+	)
+	// 0からn-1までのキーとその10倍のvalue
+	sequence := func(n uint32) []Pair {
+		pairs := make([]Pair, n)
+		for i := range pairs {
+			pairs[i] = Pair{NewBytes(uint32(i)), NewBytes(uint32(i) * 10)}
+		}
+		return pairs
+	}
+	// 挿入で作った木と同じ形になっていることを確認する
+	expectValidTree := func(n uint32) {
+		res := sliceOf(btree, dm)
+		keys := leafKeys(res)
+		Expect(keys).To(HaveLen(int(n)))
+		for i, key := range keys {
+			Expect(key).To(Equal(uint32(i)))
+		}
+		assertLinks(res)
+		var height uint32
+		for _, p := range res {
+			// 中間ノードは1つのitemがRightPointerになる分、rebalanceと同じく再分配しても下限に届かないことがあるので子の数だけを確かめる
+			if p.PageID != btree.RootNodeID {
+				if p.NodeType == NodeTypeLeaf {
+					Expect(p.IsUnderflow()).To(BeFalse(), "page %d", p.PageID)
+				} else {
+					Expect(len(p.Children())).To(BeNumerically(">=", 2), "page %d", p.PageID)
+				}
+				Expect(p.NBytes()).To(BeNumerically("<=", LimitBytesSize()))
+			}
+			if uint32(p.Depth)+1 > height {
+				height = uint32(p.Depth) + 1
+			}
+		}
+		Expect(btree.KeyCount).To(Equal(uint64(n)))
+		Expect(btree.Height).To(Equal(height))
+		reopened, _ := NewBPlustTree(dm)
+		Expect(reopened.RootNodeID).To(Equal(btree.RootNodeID))
+		Expect(reopened.KeyCount).To(Equal(uint64(n)))
+		for i := uint32(0); i < n; i++ {
+			value, found, err := btree.Get(dm, NewBytes(i))
+			Expect(err).To(BeNil())
+			Expect(found).To(BeTrue())
+			Expect(value).To(Equal(NewBytes(i * 10)))
+		}
+	}
+	BeforeEach(func() {
+		os.Setenv(BytesSizeLimitKey, strconv.Itoa(148))
+		dm, _ = NewDiskManager(newCrashableFile())
+		NewTable2(dm, ColumnSize)
+		btree, _ = NewBPlustTree(dm)
+	})
+	It("キーの数に関わらず、リンクが繋がり下限を満たす木ができる", func() {
+		for n := uint32(1); n <= 120; n++ {
+			dm, _ = NewDiskManager(newCrashableFile())
+			NewTable2(dm, ColumnSize)
+			btree, _ = NewBPlustTree(dm)
+			Expect(btree.BulkLoad(dm, NewPairIterator(sequence(n)), 1)).To(Succeed())
+			expectValidTree(n)
+		}
+	})
+	It("fillFactorが小さいほどleafが多くなる", func() {
+		Expect(btree.BulkLoad(dm, NewPairIterator(sequence(1000)), 1)).To(Succeed())
+		expectValidTree(1000)
+		full := len(sliceOf(btree, dm))
+
+		dm, _ = NewDiskManager(newCrashableFile())
+		NewTable2(dm, ColumnSize)
+		btree, _ = NewBPlustTree(dm)
+		Expect(btree.BulkLoad(dm, NewPairIterator(sequence(1000)), 0.6)).To(Succeed())
+		expectValidTree(1000)
+		Expect(len(sliceOf(btree, dm))).To(BeNumerically(">", full))
+	})
+	It("組み立てた木に挿入・削除できる", func() {
+		Expect(btree.BulkLoad(dm, NewPairIterator(sequence(200)), 1)).To(Succeed())
+		for i := uint32(200); i < 300; i++ {
+			Expect(btree.InsertPair(dm, NewBytes(i), NewBytes(i*10))).To(Succeed())
+		}
+		for i := uint32(0); i < 100; i++ {
+			Expect(btree.Delete(dm, NewBytes(i*3))).To(Succeed())
+		}
+		res := sliceOf(btree, dm)
+		assertLinks(res)
+		Expect(leafKeys(res)).To(HaveLen(200))
+		Expect(btree.KeyCount).To(Equal(uint64(200)))
+	})
+	It("空の入力の場合は空のrootを作る", func() {
+		Expect(btree.BulkLoad(dm, NewPairIterator(nil), 1)).To(Succeed())
+		Expect(btree.RootNodeID).NotTo(Equal(InvalidPageID))
+		expectValidTree(0)
+	})
+	It("他の木をCursorで読んで組み立てられる", func() {
+		Expect(btree.BulkLoad(dm, NewPairIterator(sequence(500)), 1)).To(Succeed())
+		src := btree
+		srcDM := dm
+		dm, _ = NewDiskManager(newCrashableFile())
+		NewTable2(dm, ColumnSize)
+		btree, _ = NewBPlustTree(dm)
+		Expect(btree.BulkLoad(dm, src.Scan(srcDM, nil, nil), 0.8)).To(Succeed())
+		expectValidTree(500)
+	})
+	It("大きいvalueはオーバーフローページに書く", func() {
+		pairs := sequence(10)
+		pairs[3].Value = make(Bytes, PageSize*2)
+		Expect(btree.BulkLoad(dm, NewPairIterator(pairs), 1)).To(Succeed())
+		value, _, _ := btree.Get(dm, NewBytes(3))
+		Expect(value).To(Equal(pairs[3].Value))
+	})
+	Context("キーが昇順でない場合", func() {
+		It("ErrUnsortedInputが返る", func() {
+			pairs := sequence(10)
+			pairs[4], pairs[5] = pairs[5], pairs[4]
+			err := btree.BulkLoad(dm, NewPairIterator(pairs), 1)
+			Expect(errors.Is(err, ErrUnsortedInput)).To(BeTrue())
+			Expect(btree.RootNodeID).To(Equal(InvalidPageID))
+		})
+		It("同じキーが続く場合もErrUnsortedInputが返る", func() {
+			pairs := append(sequence(3), Pair{NewBytes(2), NewBytes(0)})
+			err := btree.BulkLoad(dm, NewPairIterator(pairs), 1)
+			Expect(errors.Is(err, ErrUnsortedInput)).To(BeTrue())
+		})
+	})
+	It("空でない木にはErrTreeNotEmptyが返る", func() {
+		Expect(btree.InsertPair(dm, NewBytes(1), NewBytes(1))).To(Succeed())
+		Expect(btree.BulkLoad(dm, NewPairIterator(sequence(3)), 1)).To(Equal(ErrTreeNotEmpty))
+	})
+	It("fillFactorが範囲外の場合はErrInvalidFillFactorが返る", func() {
+		err := btree.BulkLoad(dm, NewPairIterator(sequence(3)), 0)
+		Expect(errors.Is(err, ErrInvalidFillFactor)).To(BeTrue())
+		err = btree.BulkLoad(dm, NewPairIterator(sequence(3)), 1.5)
+		Expect(errors.Is(err, ErrInvalidFillFactor)).To(BeTrue())
+	})
+})
+
+// go test -bench Build で、main.goと同じ65535個のキーを1つずつ挿入する場合とBulkLoadを比べる
+func BenchmarkBuild(b *testing.B) {
+	os.Setenv(BytesSizeLimitKey, strconv.Itoa(PageSize))
+	const n = 65535
+	pairs := make([]Pair, n)
+	for i := range pairs {
+		pairs[i] = Pair{NewBytes(uint32(i)), NewBytes(uint32(i))}
+	}
+	newTree := func() (DiskManager, *BPlustTree) {
+		dm, _ := NewDiskManager(newCrashableFile())
+		NewTable2(dm, ColumnSize)
+		btree, _ := NewBPlustTree(dm)
+		return dm, btree
+	}
+	b.Run("InsertPair", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			dm, btree := newTree()
+			for _, pair := range pairs {
+				btree.InsertPair(dm, pair.Key, pair.Value)
+			}
+		}
+	})
+	b.Run("BulkLoad", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			dm, btree := newTree()
+			btree.BulkLoad(dm, NewPairIterator(pairs), 1)
+		}
+	})
+}
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"bytes"
 	"encoding/binary"
 )
 
@@ -11,7 +12,9 @@ type (
 )
 
 const (
-	ColumnSize uint32 = 4 // 全てのカラムを4Byte(uint32)に統一
+	// NewBytesで作るuint32のカラム1つのバイト数。KeySchemaを使わない木のキーや行IDはこの幅で並べる
+	// KeySchemaを使う木では型ごとの幅でエンコードし、可変長のカラムはエスケープして終端を付ける
+	ColumnSize uint32 = 4
 )
 
 const (
@@ -21,24 +24,26 @@ const (
 	ComparisonResultUnKnown = ComparisonResult(-2)
 )
 
+// 大小関係がバイト列の順序と一致するように、各カラムはビッグエンディアンでエンコードする
 func NewBytes(val ...uint32) Bytes {
 	b := make([]byte, 4*len(val))
 	for i, n := range val {
-		binary.NativeEndian.PutUint32(b[i*4:(i+1)*4], n)
+		binary.BigEndian.PutUint32(b[i*4:(i+1)*4], n)
 	}
 	return b
 }
 
 // TODO []uint32を返すようにする
 func (b Bytes) Uint32(start uint32) uint32 {
-	return binary.NativeEndian.Uint32(b[start : start+4])
+	return binary.BigEndian.Uint32(b[start : start+4])
 }
 
-// 先頭lenBytesを4byteずつ比較して等しいなら0,selfが小さいなら-1,othersが大きいなら1を返す
-// keyLengthはColumnSizeの倍数でなければならない
+// 先頭keyLengthバイトを比較して等しいなら0,selfが小さいなら-1,othersが大きいなら1を返す
+// keyLengthはColumnSizeの倍数でなくてもよい(KeySchemaのboolや奇数バイトの固定長カラムなど)
+// VariableKeyLenの場合は長さの違うキーも含めて全体を比較する
 func (b Bytes) Compare(others Bytes, keyLength uint32) ComparisonResult {
-	if keyLength%ColumnSize != 0 {
-		return ComparisonResultUnKnown
+	if keyLength == VariableKeyLen {
+		return compare(b, others)
 	}
 	if len(b) < int(keyLength) || len(others) < int(keyLength) {
 		return ComparisonResultUnKnown
@@ -46,20 +51,9 @@ func (b Bytes) Compare(others Bytes, keyLength uint32) ComparisonResult {
 	return compare(b[:keyLength], others[:keyLength])
 }
 
+// カラムはビッグエンディアンでエンコードしているので、バイト列のまま比較すれば数値の大小と一致する
 func compare(self []byte, other []byte) ComparisonResult {
-	for i := 0; i < len(self); i += int(ColumnSize) {
-		upper := i + int(ColumnSize)
-		b1 := binary.NativeEndian.Uint32(self[i:upper])
-		b2 := binary.NativeEndian.Uint32(other[i:upper])
-		if b1 == b2 {
-			continue
-		} else if b1 > b2 {
-			return ComparisonResultBig
-		} else {
-			return ComparisonResultSmall
-		}
-	}
-	return ComparisonResultEqual
+	return ComparisonResult(bytes.Compare(self, other))
 }
 
 func (b Bytes) Len() uint32 {
@@ -19,7 +19,7 @@ var _ = Describe("Bytesのテスト", func() {
 				original = []uint32{256, 256, 1}
 			})
 			It("エンコードされた値が返る", func() {
-				Expect(res).To(Equal(Bytes([]byte{0, 1, 0, 0, 0, 1, 0, 0, 1, 0, 0, 0})))
+				Expect(res).To(Equal(Bytes([]byte{0, 0, 1, 0, 0, 0, 1, 0, 0, 0, 0, 1})))
 			})
 		})
 	})
@@ -38,12 +38,12 @@ var _ = Describe("Bytesのテスト", func() {
 		Context("lenが4byteの倍数の時", func() {
 			Context("1カラム分で比較", func() {
 				BeforeEach(func() {
-					self = []byte{255, 255, 0, 0} // 65535
+					self = []byte{0, 0, 255, 255} // 65535
 					len = ColumnSize
 				})
 				Context("等しい", func() {
 					BeforeEach(func() {
-						other = []byte{255, 255, 0, 0}
+						other = []byte{0, 0, 255, 255}
 					})
 					It("ComparisonResultEqualが返る", func() {
 						Expect(res).To(Equal(ComparisonResultEqual))
@@ -51,7 +51,7 @@ var _ = Describe("Bytesのテスト", func() {
 				})
 				Context("selfが小さい", func() {
 					BeforeEach(func() {
-						other = []byte{0, 0, 1, 0} // 65536
+						other = []byte{0, 1, 0, 0} // 65536
 					})
 					It("ComparisonResultSmallが返る", func() {
 						Expect(res).To(Equal(ComparisonResultSmall))
@@ -59,7 +59,7 @@ var _ = Describe("Bytesのテスト", func() {
 				})
 				Context("selfが大きい", func() {
 					BeforeEach(func() {
-						other = []byte{255, 254, 0, 0}
+						other = []byte{0, 0, 255, 254}
 					})
 					It("ComparisonResultBigが返る", func() {
 						Expect(res).To(Equal(ComparisonResultBig))
@@ -68,16 +68,16 @@ var _ = Describe("Bytesのテスト", func() {
 			})
 			Context("2カラム分で比較", func() {
 				BeforeEach(func() {
-					self = []byte{255, 255, 0, 0, 255, 255, 0, 0} // 65535, 65535
+					self = []byte{0, 0, 255, 255, 0, 0, 255, 255} // 65535, 65535
 					len = ColumnSize * 2
 				})
 				Context("1カラムは等しい", func() {
 					BeforeEach(func() {
-						other = []byte{255, 255, 0, 0}
+						other = []byte{0, 0, 255, 255}
 					})
 					Context("2カラム目も等しい", func() {
 						BeforeEach(func() {
-							other = append(other, 255, 255, 0, 0)
+							other = append(other, 0, 0, 255, 255)
 						})
 						It("ComparisonResultEqualが返る", func() {
 							Expect(res).To(Equal(ComparisonResultEqual))
@@ -85,7 +85,7 @@ var _ = Describe("Bytesのテスト", func() {
 					})
 					Context("2カラム目はselfが大きい", func() {
 						BeforeEach(func() {
-							other = append(other, 255, 254, 0, 0)
+							other = append(other, 0, 0, 255, 254)
 						})
 						It("ComparisonResultBigが返る", func() {
 							Expect(res).To(Equal(ComparisonResultBig))
@@ -94,8 +94,8 @@ var _ = Describe("Bytesのテスト", func() {
 				})
 				Context("1カラム目でselfが小さい", func() {
 					BeforeEach(func() {
-						self = []byte{255, 255, 0, 0, 0, 0, 1, 0}  // 65535, 65536
-						other = []byte{0, 0, 1, 0, 255, 255, 0, 0} // 65536, 65535
+						self = []byte{0, 0, 255, 255, 0, 1, 0, 0}  // 65535, 65536
+						other = []byte{0, 1, 0, 0, 0, 0, 255, 255} // 65536, 65535
 						len = ColumnSize * 2
 					})
 					It("ComparisonResultSmallが返る", func() {
@@ -106,16 +106,18 @@ var _ = Describe("Bytesのテスト", func() {
 		})
 		Context("lenが4byteの倍数でない時", func() {
 			BeforeEach(func() {
+				self = []byte{0, 0, 255, 255, 0, 9}
+				other = []byte{0, 0, 255, 255, 1, 0}
 				len = ColumnSize + 1
 			})
-			It("ComparisonResultUnKnownが返る", func() {
-				Expect(res).To(Equal(ComparisonResultUnKnown))
+			It("先頭lenバイトを比較する", func() {
+				Expect(res).To(Equal(ComparisonResultSmall))
 			})
 		})
 		Context("lenがキーの長さをオーバーしている時", func() {
 			BeforeEach(func() {
-				self = []byte{255, 255, 0, 0} // 65535
-				other = []byte{0, 0, 1, 0}    // 65536
+				self = []byte{0, 0, 255, 255} // 65535
+				other = []byte{0, 1, 0, 0}    // 65536
 				len = ColumnSize * 2
 			})
 			It("ComparisonResultUnKnownが返る", func() {
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+type (
+	// チェックポイントの時点で永続化されていなかったページと、実行中だったトランザクション
+	CheckpointRecord struct {
+		DirtyPages map[PageID]LSN // ページを最初に変更したレコードのLSN(recLSN)
+		ActiveTxns map[TxnID]LSN  // トランザクションの最初のUndoのLSN
+	}
+)
+
+var (
+	ErrCheckpointInAtomic = errors.New("cannot checkpoint inside Atomic")
+)
+
+// チェックポイントを新しいセグメントの先頭に書き、復旧に要らなくなった古いセグメントを削除する
+// flushがfalseの場合はページを書き戻さずに、永続化されていないページ(dirty page table)をそのまま記録する(ファジーチェックポイント)
+// 復旧はそれらのページを最初に変更したレコードから始まるので、それより古いセグメントだけが削除される
+// flushがtrueの場合は先にSyncしてから記録するので、実行中のトランザクションが使うもの以外の古いセグメントは全て削除される
+func (dm *WALDiskManager) Checkpoint(flush bool) error {
+	if dm.depth > 0 {
+		return ErrCheckpointInAtomic
+	}
+	if flush {
+		if err := dm.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := dm.wal.Rotate(); err != nil {
+		return err
+	}
+	record := CheckpointRecord{
+		DirtyPages: map[PageID]LSN{},
+		ActiveTxns: map[TxnID]LSN{},
+	}
+	for pageID, lsn := range dm.dirty {
+		record.DirtyPages[pageID] = lsn
+	}
+	if dm.activeTxns != nil {
+		record.ActiveTxns = dm.activeTxns()
+	}
+	lsn := dm.wal.append(LogRecordTypeCheckpoint, InvalidPageID, record.encode())
+	dm.wal.AppendCommit()
+	if err := dm.wal.Flush(); err != nil {
+		return err
+	}
+	return dm.wal.RemoveBefore(record.oldestLSN(lsn))
+}
+
+// 再生を始めるLSN。lsnはチェックポイント自身のLSN
+func (c CheckpointRecord) redoLSN(lsn LSN) LSN {
+	for _, recLSN := range c.DirtyPages {
+		if recLSN < lsn {
+			lsn = recLSN
+		}
+	}
+	return lsn
+}
+
+// 復旧に必要な一番古いLSN。これより前のレコードしか持たないセグメントは削除できる
+func (c CheckpointRecord) oldestLSN(lsn LSN) LSN {
+	lsn = c.redoLSN(lsn)
+	for _, firstLSN := range c.ActiveTxns {
+		if firstLSN < lsn {
+			lsn = firstLSN
+		}
+	}
+	return lsn
+}
+
+// ページの数(4) + (PageID(4) + LSN(8))... + トランザクションの数(4) + (TxnID(8) + LSN(8))...
+func (c CheckpointRecord) encode() []byte {
+	pageIDs := []PageID{}
+	for pageID := range c.DirtyPages {
+		pageIDs = append(pageIDs, pageID)
+	}
+	sort.Slice(pageIDs, func(i, j int) bool { return pageIDs[i] < pageIDs[j] })
+	txnIDs := []TxnID{}
+	for txnID := range c.ActiveTxns {
+		txnIDs = append(txnIDs, txnID)
+	}
+	sort.Slice(txnIDs, func(i, j int) bool { return txnIDs[i] < txnIDs[j] })
+
+	data := binary.BigEndian.AppendUint32(nil, uint32(len(pageIDs)))
+	for _, pageID := range pageIDs {
+		data = binary.BigEndian.AppendUint32(data, uint32(pageID))
+		data = binary.BigEndian.AppendUint64(data, uint64(c.DirtyPages[pageID]))
+	}
+	data = binary.BigEndian.AppendUint32(data, uint32(len(txnIDs)))
+	for _, txnID := range txnIDs {
+		data = binary.BigEndian.AppendUint64(data, uint64(txnID))
+		data = binary.BigEndian.AppendUint64(data, uint64(c.ActiveTxns[txnID]))
+	}
+	return data
+}
+
+func decodeCheckpoint(data []byte) CheckpointRecord {
+	c := CheckpointRecord{
+		DirtyPages: map[PageID]LSN{},
+		ActiveTxns: map[TxnID]LSN{},
+	}
+	n := binary.BigEndian.Uint32(data[:4])
+	data = data[4:]
+	for i := uint32(0); i < n; i++ {
+		c.DirtyPages[PageID(binary.BigEndian.Uint32(data[:4]))] = LSN(binary.BigEndian.Uint64(data[4:12]))
+		data = data[12:]
+	}
+	n = binary.BigEndian.Uint32(data[:4])
+	data = data[4:]
+	for i := uint32(0); i < n; i++ {
+		c.ActiveTxns[TxnID(binary.BigEndian.Uint64(data[:8]))] = LSN(binary.BigEndian.Uint64(data[8:16]))
+		data = data[16:]
+	}
+	return c
+}
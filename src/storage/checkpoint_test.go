@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"os"
+	"strconv"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("チェックポイントのテスト", func() {
+	var (
+		dataFile *crashableFile
+		logStore *memLogStore
+		disk     *countingDiskManager
+		wal      *WAL
+		dm       *WALDiskManager
+		btree    *BPlustTree
+		tm       *TransactionManager
+	)
+	// diskはSyncした時だけ永続化されるので、クラッシュするとSyncしていないページは失われる
+	open := func() {
+		d, err := NewDiskManager(dataFile)
+		Expect(err).To(BeNil())
+		disk = newCountingDiskManager(d)
+		wal, err = NewWAL(logStore)
+		Expect(err).To(BeNil())
+		dm, err = NewWALDiskManager(disk, wal)
+		Expect(err).To(BeNil())
+		btree, err = NewBPlustTree(dm)
+		Expect(err).To(BeNil())
+		tm, err = NewTransactionManager(dm, btree)
+		Expect(err).To(BeNil())
+	}
+	crashAndReopen := func() {
+		dataFile.crash()
+		logStore.crash()
+		open()
+	}
+	insert := func(from, to uint32) {
+		for i := from; i < to; i++ {
+			Expect(btree.InsertPair(dm, NewBytes(i), NewBytes(i))).To(Succeed())
+		}
+	}
+	keysUpTo := func(max uint32) []uint32 {
+		keys := []uint32{}
+		var i uint32
+		for i = 0; i <= max; i++ {
+			keys = append(keys, i)
+		}
+		return keys
+	}
+	expectKeys := func(keys []uint32) {
+		res := sliceOf(btree, dm)
+		Expect(leafKeys(res)).To(Equal(keys))
+		assertLinks(res)
+	}
+	BeforeEach(func() {
+		os.Setenv(BytesSizeLimitKey, strconv.Itoa(84))
+		dataFile = newCrashableFile()
+		logStore = newMemLogStore()
+		d, _ := NewDiskManager(dataFile)
+		wal, _ = NewWAL(logStore)
+		dm, _ = NewWALDiskManager(d, wal)
+		NewTable2(dm, ColumnSize)
+		open()
+		insert(0, 30)
+	})
+	Context("ページを書き戻してからチェックポイントを作った場合", func() {
+		BeforeEach(func() {
+			Expect(dm.Checkpoint(true)).To(Succeed())
+		})
+		It("古いセグメントが削除され、復旧ではページを書き直さない", func() {
+			Expect(wal.Segments()).To(Equal([]uint64{2}))
+			crashAndReopen()
+			Expect(disk.writes).To(BeEmpty())
+			expectKeys(keysUpTo(29))
+		})
+		It("チェックポイントより後の変更はログから戻る", func() {
+			insert(30, 40)
+			crashAndReopen()
+			Expect(disk.writes).NotTo(BeEmpty())
+			expectKeys(keysUpTo(39))
+		})
+	})
+	Context("ページを書き戻さずにチェックポイントを作った場合", func() {
+		BeforeEach(func() {
+			Expect(dm.Checkpoint(false)).To(Succeed())
+		})
+		It("永続化されていないページを変更したセグメントは残り、そこから復旧する", func() {
+			Expect(wal.Segments()).To(Equal([]uint64{1, 2}))
+			record, ok := wal.LastCheckpoint()
+			Expect(ok).To(BeTrue())
+			Expect(decodeCheckpoint(record.Data).DirtyPages).NotTo(BeEmpty())
+
+			insert(30, 40)
+			crashAndReopen()
+			expectKeys(keysUpTo(39))
+		})
+		It("Syncした後のチェックポイントで古いセグメントが削除される", func() {
+			insert(30, 40)
+			Expect(dm.Sync()).To(Succeed())
+			Expect(dm.Checkpoint(false)).To(Succeed())
+			Expect(wal.Segments()).To(Equal([]uint64{3}))
+			crashAndReopen()
+			expectKeys(keysUpTo(39))
+		})
+	})
+	Context("実行中のトランザクションがある場合", func() {
+		It("トランザクションのレコードがあるセグメントは残り、復旧で取り消される", func() {
+			txn := tm.Begin()
+			var i uint32
+			for i = 100; i < 120; i++ {
+				Expect(txn.InsertPair(NewBytes(i), NewBytes(i))).To(Succeed())
+			}
+			Expect(dm.Checkpoint(true)).To(Succeed())
+			Expect(wal.Segments()).To(Equal([]uint64{1, 2}))
+			record, _ := wal.LastCheckpoint()
+			Expect(decodeCheckpoint(record.Data).ActiveTxns).To(HaveKey(txn.ID))
+
+			crashAndReopen()
+			expectKeys(keysUpTo(29))
+			Expect(dm.Checkpoint(true)).To(Succeed())
+			Expect(wal.Segments()).To(Equal([]uint64{3}))
+		})
+	})
+	Context("Atomicの中で呼んだ場合", func() {
+		It("ErrCheckpointInAtomicが返る", func() {
+			err := dm.Atomic(func() error {
+				return dm.Checkpoint(true)
+			})
+			Expect(err).To(Equal(ErrCheckpointInAtomic))
+		})
+	})
+})
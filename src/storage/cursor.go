@@ -0,0 +1,318 @@
+package storage
+
+import (
+	"fmt"
+)
+
+type (
+	// 範囲検索の上限・下限
+	// Keyが木のキーより短い場合は先頭の一致する部分だけで比較する
+	Bound struct {
+		Key       Bytes
+		Inclusive bool // trueの場合はKeyと等しいキーも範囲に含める
+	}
+
+	// leafをNextPageID(昇順)またはPrevPageID(降順)で辿りながら1ペアずつ返すイテレータ
+	// 保持するのは現在のページだけなので広い範囲を走査してもメモリは増えない
+	Cursor struct {
+		dm     DiskManager
+		keyLen uint32
+		rootID PageID
+		lower  *Bound
+		upper  *Bound
+
+		page    *Page
+		index   int
+		started bool
+		done    bool
+		err     error
+	}
+)
+
+// startKey以上のキーを昇順に返すCursorを作成する
+func (b *BPlustTree) Seek(dm DiskManager, startKey Bytes) *Cursor {
+	return b.Scan(dm, &Bound{startKey, true}, nil)
+}
+
+// 末尾のキーから降順に返すCursorを作成する。Prevで走査する
+func (b *BPlustTree) SeekLast(dm DiskManager) *Cursor {
+	return b.Scan(dm, nil, nil)
+}
+
+// key以下のキーを降順に返すCursorを作成する。Prevで走査する
+func (b *BPlustTree) SeekLE(dm DiskManager, key Bytes) *Cursor {
+	return b.Scan(dm, nil, &Bound{key, true})
+}
+
+// lowerからupperまでのキーを返すCursorを作成する
+// Nextで走査するとlowerから昇順に、Prevで走査するとupperから降順に返す
+// lower,upperがnilの場合はそれぞれ先頭・末尾まで走査する
+func (b *BPlustTree) Scan(dm DiskManager, lower, upper *Bound) *Cursor {
+	return &Cursor{
+		dm:     dm,
+		keyLen: b.internalKeyLen(),
+		rootID: b.RootNodeID,
+		lower:  lower,
+		upper:  upper,
+	}
+}
+
+// 次のペアに進む。範囲の終わりに達した場合やエラーが起きた場合はfalseを返す
+// 最初の呼び出しで範囲の先頭のペアに位置する
+func (c *Cursor) Next() bool {
+	if c.done || c.err != nil {
+		return false
+	}
+	if !c.started {
+		c.started = true
+		if !c.seekLower() {
+			return false
+		}
+	} else {
+		c.index += 1
+	}
+	if !c.skipForward() {
+		return false
+	}
+	if !c.withinUpper() {
+		c.done = true
+		return false
+	}
+	return true
+}
+
+// 前のペアに戻る。範囲の先頭に達した場合やエラーが起きた場合はfalseを返す
+// 最初の呼び出しで範囲の末尾のペアに位置する
+func (c *Cursor) Prev() bool {
+	if c.done || c.err != nil {
+		return false
+	}
+	if !c.started {
+		c.started = true
+		if !c.seekUpper() {
+			return false
+		}
+	} else {
+		c.index -= 1
+	}
+	if !c.skipBackward() {
+		return false
+	}
+	if !c.withinLower() {
+		c.done = true
+		return false
+	}
+	return true
+}
+
+func (c *Cursor) Key() Bytes {
+	return c.page.Items[c.index].Key
+}
+
+// valueがオーバーフローページにある場合は読み出して返す。読めなかった場合はnilを返し、Errでエラーを返す
+func (c *Cursor) Value() Bytes {
+	value, err := readValue(c.dm, c.page.Items[c.index].Value)
+	if err != nil {
+		c.err = err
+		return nil
+	}
+	return value
+}
+
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// 下限を満たす最初のペアに位置する
+func (c *Cursor) seekLower() bool {
+	if c.rootID == InvalidPageID {
+		c.done = true
+		return false
+	}
+	root, err := fetchPage(c.dm, c.rootID)
+	if err != nil {
+		c.err = err
+		return false
+	}
+	if c.lower == nil {
+		c.page, c.err = root.firstLeaf(c.dm)
+		return c.err == nil
+	}
+	if c.page, c.err = root.FindLeaf(c.dm, c.lower.Key, c.boundLen(c.lower)); c.err != nil {
+		return false
+	}
+	for {
+		if !c.skipForward() {
+			return false
+		}
+		if c.withinLower() {
+			return true
+		}
+		c.index += 1
+	}
+}
+
+// 上限を満たす最後のペアに位置する
+// 上限を満たすキーがFindLeafで見つかるページにない場合は前のleafに戻って探す
+func (c *Cursor) seekUpper() bool {
+	if c.rootID == InvalidPageID {
+		c.done = true
+		return false
+	}
+	root, err := fetchPage(c.dm, c.rootID)
+	if err != nil {
+		c.err = err
+		return false
+	}
+	// 上限で始まるキーが複数のleafにまたがっていても最後のものから探せるように、それらより大きい最初のキーを含むleafまで降りる
+	end, ok := Bytes(nil), false
+	if c.upper != nil {
+		end, ok = prefixEnd(c.upper.Key)
+	}
+	if !ok {
+		if c.page, c.err = root.lastLeaf(c.dm); c.err != nil {
+			return false
+		}
+	} else if c.page, c.err = root.FindLeaf(c.dm, end, c.boundLen(c.upper)); c.err != nil {
+		return false
+	}
+	c.index = len(c.page.Items) - 1
+	if c.upper == nil {
+		return true
+	}
+	for {
+		if !c.skipBackward() {
+			return false
+		}
+		if c.withinUpper() {
+			return true
+		}
+		c.index -= 1
+	}
+}
+
+// 現在のページを読み終えていたら次のleafに移る
+func (c *Cursor) skipForward() bool {
+	for c.index >= len(c.page.Items) {
+		if c.page.NextPageID == InvalidPageID {
+			c.done = true
+			return false
+		}
+		nextPage, err := fetchPage(c.dm, c.page.NextPageID)
+		if err != nil {
+			c.err = err
+			return false
+		}
+		c.page = nextPage
+		c.index = 0
+	}
+	return true
+}
+
+// 現在のページの先頭より前に出ていたら前のleafの末尾に移る
+// 一番左のleafはPrevPageIDがInvalidPageIDなのでそこで終了する
+func (c *Cursor) skipBackward() bool {
+	for c.index < 0 {
+		if c.page.PrevPageID == InvalidPageID {
+			c.done = true
+			return false
+		}
+		prevPage, err := fetchPage(c.dm, c.page.PrevPageID)
+		if err != nil {
+			c.err = err
+			return false
+		}
+		c.page = prevPage
+		c.index = len(c.page.Items) - 1
+	}
+	return true
+}
+
+func (c *Cursor) withinLower() bool {
+	if c.lower == nil {
+		return true
+	}
+	res := c.compareBound(c.lower)
+	return res == ComparisonResultBig || (res == ComparisonResultEqual && c.lower.Inclusive)
+}
+
+func (c *Cursor) withinUpper() bool {
+	if c.upper == nil {
+		return true
+	}
+	res := c.compareBound(c.upper)
+	return res == ComparisonResultSmall || (res == ComparisonResultEqual && c.upper.Inclusive)
+}
+
+// 一番左のleafまで降りる
+func (p *Page) firstLeaf(dm DiskManager) (*Page, error) {
+	page := p
+	for page.NodeType == NodeTypeBranch {
+		children := page.Children()
+		if len(children) == 0 {
+			return nil, fmt.Errorf("page %d has no child", page.PageID)
+		}
+		nextPage, err := fetchPage(dm, children[0])
+		if err != nil {
+			return nil, err
+		}
+		page = nextPage
+	}
+	return page, nil
+}
+
+// 一番右のleafまで降りる
+func (p *Page) lastLeaf(dm DiskManager) (*Page, error) {
+	page := p
+	for page.NodeType == NodeTypeBranch {
+		children := page.Children()
+		if len(children) == 0 {
+			return nil, fmt.Errorf("page %d has no child", page.PageID)
+		}
+		nextPage, err := fetchPage(dm, children[len(children)-1])
+		if err != nil {
+			return nil, err
+		}
+		page = nextPage
+	}
+	return page, nil
+}
+
+// 現在のキーの先頭を境界のキーと比較する
+// 可変長のキーは境界のキーの長さまでで比較する。短いキーは境界より小さい
+func (c *Cursor) compareBound(bound *Bound) ComparisonResult {
+	if c.keyLen == VariableKeyLen {
+		key := c.Key()
+		if key.Len() > bound.Key.Len() {
+			key = key[:bound.Key.Len()]
+		}
+		return compare(key, bound.Key)
+	}
+	return c.Key().Compare(bound.Key, c.boundLen(bound))
+}
+
+// 境界のキーで比較する長さ
+// 重複キーを許すインデックスで行IDを除いたキーを渡すと、同じキーを持つpairが全て範囲に含まれる
+// 可変長のキーはFindLeafで全体を比較しても、境界のキーで始まる最初のキーを含むleafが見つかる
+func (c *Cursor) boundLen(bound *Bound) uint32 {
+	if c.keyLen == VariableKeyLen {
+		return VariableKeyLen
+	}
+	if bound.Key.Len() < c.keyLen {
+		return bound.Key.Len()
+	}
+	return c.keyLen
+}
+
+// keyで始まる全てのキーより大きい最小の同じ長さのバイト列を返す
+// keyが全て0xFFの場合はそのようなバイト列が無いのでfalseを返す
+func prefixEnd(key Bytes) (Bytes, bool) {
+	end := append(Bytes{}, key...)
+	for i := len(end) - 1; i >= 0; i-- {
+		end[i]++
+		if end[i] != 0 {
+			return end, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,284 @@
+package storage
+
+import (
+	"os"
+	"strconv"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Cursorのテスト", func() {
+	var (
+		btree *BPlustTree
+		dm    DiskManager
+		max   uint32
+
+		cursor *Cursor
+		limit  int
+
+		keys   []uint32
+		values []uint32
+	)
+	BeforeEach(func() {
+		f := createTestFile("cursor_test_table")
+		dm, _ = NewDiskManager(f)
+		NewTable2(dm, ColumnSize)
+		os.Setenv(BytesSizeLimitKey, strconv.Itoa(84))
+		max = 30
+		limit = -1
+	})
+	JustBeforeEach(func() {
+		btree, _ = NewBPlustTree(dm)
+		var i uint32
+		for i = 0; i < max; i++ {
+			btree.InsertPair(dm, NewBytes(i), NewBytes(i*10))
+		}
+	})
+	// limitが0以上の場合はその件数で走査を打ち切る
+	collect := func() {
+		keys = []uint32{}
+		values = []uint32{}
+		for cursor.Next() {
+			if limit >= 0 && len(keys) >= limit {
+				break
+			}
+			keys = append(keys, cursor.Key().Uint32(0))
+			values = append(values, cursor.Value().Uint32(0))
+		}
+	}
+	collectReverse := func() {
+		keys = []uint32{}
+		for cursor.Prev() {
+			if limit >= 0 && len(keys) >= limit {
+				break
+			}
+			keys = append(keys, cursor.Key().Uint32(0))
+		}
+	}
+	rangeOf := func(from, to uint32) []uint32 {
+		res := []uint32{}
+		for i := from; i < to; i++ {
+			res = append(res, i)
+		}
+		return res
+	}
+	reverseRangeOf := func(from, to uint32) []uint32 {
+		res := rangeOf(from, to)
+		for i, j := 0, len(res)-1; i < j; i, j = i+1, j-1 {
+			res[i], res[j] = res[j], res[i]
+		}
+		return res
+	}
+
+	Describe("Seek", func() {
+		var (
+			start uint32
+		)
+		JustBeforeEach(func() {
+			cursor = btree.Seek(dm, NewBytes(start))
+			collect()
+		})
+		Context("途中のキーから走査する場合", func() {
+			BeforeEach(func() {
+				start = 10
+			})
+			It("startKey以上のペアが昇順に返る", func() {
+				Expect(cursor.Err()).To(BeNil())
+				Expect(keys).To(Equal(rangeOf(10, 30)))
+				Expect(values[0]).To(Equal(uint32(100)))
+			})
+		})
+		Context("startKeyが全てのキーより大きい場合", func() {
+			BeforeEach(func() {
+				start = 100
+			})
+			It("何も返らない", func() {
+				Expect(cursor.Err()).To(BeNil())
+				Expect(keys).To(BeEmpty())
+			})
+		})
+		Context("途中で打ち切る場合", func() {
+			BeforeEach(func() {
+				start = 3
+				limit = 4
+			})
+			It("打ち切るまでのペアだけ返る", func() {
+				Expect(keys).To(Equal([]uint32{3, 4, 5, 6}))
+			})
+		})
+		Context("rootがない場合", func() {
+			BeforeEach(func() {
+				max = 0
+			})
+			It("何も返らない", func() {
+				Expect(cursor.Err()).To(BeNil())
+				Expect(keys).To(BeEmpty())
+			})
+		})
+	})
+	Describe("Scan", func() {
+		var (
+			lower, upper *Bound
+		)
+		JustBeforeEach(func() {
+			cursor = btree.Scan(dm, lower, upper)
+			collect()
+		})
+		Context("下限・上限ともに指定しない場合", func() {
+			BeforeEach(func() {
+				lower, upper = nil, nil
+			})
+			It("全てのペアが返る", func() {
+				Expect(keys).To(Equal(rangeOf(0, 30)))
+			})
+		})
+		Context("両端を含む場合", func() {
+			BeforeEach(func() {
+				lower = &Bound{NewBytes(5), true}
+				upper = &Bound{NewBytes(15), true}
+			})
+			It("5以上15以下のペアが返る", func() {
+				Expect(keys).To(Equal(rangeOf(5, 16)))
+			})
+		})
+		Context("両端を含まない場合", func() {
+			BeforeEach(func() {
+				lower = &Bound{NewBytes(5), false}
+				upper = &Bound{NewBytes(15), false}
+			})
+			It("5より大きく15未満のペアが返る", func() {
+				Expect(keys).To(Equal(rangeOf(6, 15)))
+			})
+		})
+		Context("ページの末尾のキーを含まない下限の場合", func() {
+			BeforeEach(func() {
+				lower = &Bound{NewBytes(1), false}
+				upper = &Bound{NewBytes(3), true}
+			})
+			It("次のページから返る", func() {
+				Expect(keys).To(Equal([]uint32{2, 3}))
+			})
+		})
+		Context("上限が下限より小さい場合", func() {
+			BeforeEach(func() {
+				lower = &Bound{NewBytes(10), true}
+				upper = &Bound{NewBytes(5), true}
+			})
+			It("何も返らない", func() {
+				Expect(keys).To(BeEmpty())
+			})
+		})
+	})
+	Describe("SeekLast", func() {
+		JustBeforeEach(func() {
+			cursor = btree.SeekLast(dm)
+			collectReverse()
+		})
+		Context("全てのペアを走査する場合", func() {
+			It("降順に全てのペアが返る", func() {
+				Expect(cursor.Err()).To(BeNil())
+				Expect(keys).To(Equal(reverseRangeOf(0, 30)))
+			})
+		})
+		Context("最新のN件だけ取得する場合", func() {
+			BeforeEach(func() {
+				limit = 5
+			})
+			It("大きい方から5件返る", func() {
+				Expect(keys).To(Equal([]uint32{29, 28, 27, 26, 25}))
+			})
+		})
+		Context("rootがない場合", func() {
+			BeforeEach(func() {
+				max = 0
+			})
+			It("何も返らない", func() {
+				Expect(cursor.Err()).To(BeNil())
+				Expect(keys).To(BeEmpty())
+			})
+		})
+	})
+	Describe("SeekLE", func() {
+		var (
+			key uint32
+		)
+		JustBeforeEach(func() {
+			cursor = btree.SeekLE(dm, NewBytes(key))
+			collectReverse()
+		})
+		Context("キーが存在する場合", func() {
+			BeforeEach(func() {
+				key = 12
+			})
+			It("そのキーから降順に返る", func() {
+				Expect(keys).To(Equal(reverseRangeOf(0, 13)))
+			})
+		})
+		Context("キーが存在しない場合", func() {
+			BeforeEach(func() {
+				max = 10
+				key = 100
+			})
+			It("それより小さい最大のキーから返る", func() {
+				Expect(keys).To(Equal(reverseRangeOf(0, 10)))
+			})
+		})
+		Context("FindLeafで見つかるページの先頭のキーより小さい場合", func() {
+			JustBeforeEach(func() {
+				Expect(btree.Delete(dm, NewBytes(2))).To(Succeed())
+				cursor = btree.SeekLE(dm, NewBytes(2))
+				collectReverse()
+			})
+			It("前のページに戻って返る", func() {
+				Expect(keys).To(Equal([]uint32{1, 0}))
+			})
+		})
+		Context("全てのキーより小さい場合", func() {
+			JustBeforeEach(func() {
+				Expect(btree.Delete(dm, NewBytes(0))).To(Succeed())
+				cursor = btree.SeekLE(dm, NewBytes(0))
+				collectReverse()
+			})
+			It("何も返らない", func() {
+				Expect(cursor.Err()).To(BeNil())
+				Expect(keys).To(BeEmpty())
+			})
+		})
+	})
+	Describe("Prev", func() {
+		var (
+			lower, upper *Bound
+		)
+		JustBeforeEach(func() {
+			cursor = btree.Scan(dm, lower, upper)
+		})
+		Context("範囲を指定して降順に走査する場合", func() {
+			BeforeEach(func() {
+				lower = &Bound{NewBytes(5), false}
+				upper = &Bound{NewBytes(15), false}
+			})
+			It("範囲内のペアが降順に返る", func() {
+				collectReverse()
+				Expect(keys).To(Equal(reverseRangeOf(6, 15)))
+			})
+		})
+		Context("Nextの後に呼んだ場合", func() {
+			BeforeEach(func() {
+				lower = &Bound{NewBytes(1), true}
+				upper = nil
+			})
+			It("前のペアに戻る", func() {
+				Expect(cursor.Next()).To(BeTrue())
+				Expect(cursor.Next()).To(BeTrue())
+				Expect(cursor.Next()).To(BeTrue())
+				Expect(cursor.Key()).To(Equal(NewBytes(3)))
+				Expect(cursor.Prev()).To(BeTrue())
+				Expect(cursor.Key()).To(Equal(NewBytes(2)))
+				Expect(cursor.Prev()).To(BeTrue())
+				Expect(cursor.Key()).To(Equal(NewBytes(1)))
+				Expect(cursor.Prev()).To(BeFalse())
+			})
+		})
+	})
+})
@@ -1,74 +1,221 @@
 package storage
 
 import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
 	"os"
 )
 
 type (
 	DiskManager interface {
-		AllocatePage() PageID
-		ReadPageData(pageID PageID) [PageSize]byte
-		WritePageData(pageID PageID, data [PageSize]byte)
-		FSize() int64
+		AllocatePage() PageID // 解放済みのページがあればそれを優先して返す
+		DeallocatePage(pageID PageID) error
+		ReadPageData(pageID PageID) ([PageSize]byte, error)
+		WritePageData(pageID PageID, data [PageSize]byte) error
+		FSize() (int64, error)
+		Sync() error  // それまでに書き込んだページを永続化する
+		Close() error // 永続化してからファイルを閉じる
 	}
 
+	// DiskManagerが使うファイルの操作。*os.Fileが満たす
+	HeapFile interface {
+		io.ReaderAt
+		io.WriterAt
+		Stat() (os.FileInfo, error)
+		Truncate(size int64) error
+		Sync() error
+		Close() error
+	}
+
+	// どのタイミングでfsyncするか
+	SyncMode uint8
+
+	// 解放済みのページはページ自体にNodeTypeFreeの印を付けてファイルに残し、開く時に読んでビットマップにする
+	// 印はWritePageDataで書かれたデータから判断するので、WALから戻したページやBufferPoolManagerから書き戻したページでもビットマップがずれない
 	DiskManagerImpl struct {
-		heapFile   *os.File
+		heapFile   HeapFile
 		nextPageID PageID
+		syncMode   SyncMode
+		free       []uint64 // PageIDごとに解放済みなら1
+	}
+
+	// 解放済みのページと使用中のページの数
+	FreeSpaceReport struct {
+		TotalPages        uint32 // ファイルヘッダーも含む
+		UsedPages         uint32
+		FreePages         uint32
+		TrailingFreePages uint32 // ファイルの末尾に続いていて、TruncateFreePagesで切り詰められるページ
 	}
 )
 
-func NewDiskManager(heapFile *os.File) DiskManager {
+const (
+	SyncModeOnFlush SyncMode = iota // Sync・Closeが呼ばれた時だけfsyncする
+	SyncModeAlways                  // 書き込みのたびにfsyncする
+	SyncModeNever                   // fsyncせずにOSに任せる。クラッシュすると書き込みが失われることがある
+)
+
+func NewDiskManager(heapFile HeapFile) (DiskManager, error) {
+	return NewDiskManagerWithSyncMode(heapFile, SyncModeOnFlush)
+}
+
+func NewDiskManagerWithSyncMode(heapFile HeapFile, syncMode SyncMode) (DiskManager, error) {
 	stat, err := heapFile.Stat()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	fSize := stat.Size()
-	return &DiskManagerImpl{
+	dm := &DiskManagerImpl{
 		heapFile:   heapFile,
 		nextPageID: PageID(fSize / PageSize),
+		syncMode:   syncMode,
+	}
+	// ページのヘッダーだけを読んで解放済みのページを探す
+	// 印が付いていたページは全体を読み、チェックサムとPageIDが合う場合だけ解放済みとする
+	// 書き込みの途中で壊れたページが偶然NodeTypeFreeに読めても、再利用して上書きしないようにする
+	var header [NodeTypeOffset + 4]byte
+	for pageID := PageID(0); pageID < dm.nextPageID; pageID++ {
+		if _, err := heapFile.ReadAt(header[:], int64(pageID)*PageSize); err != nil {
+			return nil, fmt.Errorf("failed to read page %d: %w", pageID, err)
+		}
+		if NodeType(binary.BigEndian.Uint32(header[NodeTypeOffset:])) != NodeTypeFree {
+			continue
+		}
+		data, err := dm.ReadPageData(pageID)
+		if err != nil {
+			return nil, err
+		}
+		if isIntactFreePageData(&data, pageID) {
+			dm.setFree(pageID, true)
+		}
 	}
+	return dm, nil
 }
 
-func Open(path string) DiskManager {
+func Open(path string) (DiskManager, error) {
 	f, err := os.OpenFile(path, os.O_RDWR, 0666)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	return NewDiskManager(f)
 }
 
+// 解放済みのページのうちIDが最も小さいものを返す。無い場合はファイルの末尾に割り当てる
 func (dm *DiskManagerImpl) AllocatePage() PageID {
+	for i, word := range dm.free {
+		if word != 0 {
+			pageID := PageID(i*64 + bits.TrailingZeros64(word))
+			dm.setFree(pageID, false)
+			return pageID
+		}
+	}
 	pageID := dm.nextPageID
 	dm.nextPageID = dm.nextPageID + 1
 	return PageID(pageID)
 }
 
-func (dm *DiskManagerImpl) ReadPageData(pageID PageID) [PageSize]byte {
-	offset := PageSize * pageID
-	data := make([]byte, PageSize)
-	_, err := dm.heapFile.ReadAt(data, int64(offset))
-	if err != nil {
-		panic(err)
-	}
+// 解放済みの印を付けたページを書き込み、次のAllocatePageで割り当てられるようにする
+func (dm *DiskManagerImpl) DeallocatePage(pageID PageID) error {
+	return dm.WritePageData(pageID, freePageData(pageID))
+}
 
-	var bytesArr [PageSize]byte
-	for i, b := range data {
-		bytesArr[i] = b
+// ファイルの末尾を超えるページや途中で途切れたページを読んだ場合はerrを返す
+func (dm *DiskManagerImpl) ReadPageData(pageID PageID) ([PageSize]byte, error) {
+	var data [PageSize]byte
+	offset := int64(PageSize) * int64(pageID)
+	if _, err := dm.heapFile.ReadAt(data[:], offset); err != nil {
+		return data, fmt.Errorf("failed to read page %d: %w", pageID, err)
 	}
-	return bytesArr
+	return data, nil
 }
 
-func (dm *DiskManagerImpl) WritePageData(pageID PageID, data [PageSize]byte) {
-	offset := PageSize * pageID
-	// pageSizeより大きいデータは書き込まないようにする
-	dm.heapFile.WriteAt(data[:], int64(offset))
+// 書き込めたバイト数がPageSizeに満たない場合もerrが返る
+func (dm *DiskManagerImpl) WritePageData(pageID PageID, data [PageSize]byte) error {
+	offset := int64(PageSize) * int64(pageID)
+	if _, err := dm.heapFile.WriteAt(data[:], offset); err != nil {
+		return fmt.Errorf("failed to write page %d: %w", pageID, err)
+	}
+	// 割り当てずに書き込まれたページより後ろから割り当てる
+	if pageID >= dm.nextPageID {
+		dm.nextPageID = pageID + 1
+	}
+	dm.setFree(pageID, isFreePageData(&data))
+	if dm.syncMode == SyncModeAlways {
+		return dm.heapFile.Sync()
+	}
+	return nil
 }
 
-func (dm *DiskManagerImpl) FSize() int64 {
+func (dm *DiskManagerImpl) FSize() (int64, error) {
 	stat, err := dm.heapFile.Stat()
 	if err != nil {
-		panic(err)
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+// SyncModeNeverの場合は何もしない
+func (dm *DiskManagerImpl) Sync() error {
+	if dm.syncMode == SyncModeNever {
+		return nil
+	}
+	return dm.heapFile.Sync()
+}
+
+func (dm *DiskManagerImpl) Close() error {
+	if err := dm.Sync(); err != nil {
+		dm.heapFile.Close()
+		return err
+	}
+	return dm.heapFile.Close()
+}
+
+func (dm *DiskManagerImpl) FreeSpace() FreeSpaceReport {
+	report := FreeSpaceReport{TotalPages: uint32(dm.nextPageID)}
+	for _, word := range dm.free {
+		report.FreePages += uint32(bits.OnesCount64(word))
+	}
+	report.UsedPages = report.TotalPages - report.FreePages
+	for pageID := dm.nextPageID; pageID > 0 && dm.isFree(pageID-1); pageID-- {
+		report.TrailingFreePages += 1
+	}
+	return report
+}
+
+// ファイルの末尾に続いている解放済みのページを切り詰め、切り詰めたページ数を返す
+// 上にBufferPoolManagerやWALDiskManagerを重ねている場合は、書き戻してログを空にしてから呼ぶ
+func (dm *DiskManagerImpl) TruncateFreePages() (uint32, error) {
+	n := dm.FreeSpace().TrailingFreePages
+	if n == 0 {
+		return 0, nil
+	}
+	nextPageID := dm.nextPageID - PageID(n)
+	if err := dm.heapFile.Truncate(int64(nextPageID) * PageSize); err != nil {
+		return 0, err
+	}
+	for pageID := nextPageID; pageID < dm.nextPageID; pageID++ {
+		dm.setFree(pageID, false)
+	}
+	dm.nextPageID = nextPageID
+	return n, dm.Sync()
+}
+
+func (dm *DiskManagerImpl) isFree(pageID PageID) bool {
+	i := int(pageID / 64)
+	return i < len(dm.free) && dm.free[i]&(1<<(pageID%64)) != 0
+}
+
+func (dm *DiskManagerImpl) setFree(pageID PageID, free bool) {
+	i := int(pageID / 64)
+	if !free {
+		if i < len(dm.free) {
+			dm.free[i] &^= 1 << (pageID % 64)
+		}
+		return
+	}
+	for i >= len(dm.free) {
+		dm.free = append(dm.free, 0)
 	}
-	return stat.Size()
+	dm.free[i] |= 1 << (pageID % 64)
 }
@@ -1,7 +1,10 @@
 package storage
 
 import (
+	"errors"
+	"io"
 	"os"
+	"path/filepath"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -20,8 +23,8 @@ var _ = Describe("DiskManagerのテスト", func() {
 		)
 		Context("書き込まれている場合", func() {
 			BeforeEach(func() {
-				f, _ := os.Create(fPath)
-				dm = NewDiskManager(f)
+				f := createTestFile(fPath)
+				dm, _ = NewDiskManager(f)
 
 				var data [PageSize]byte
 				nextPageID := dm.AllocatePage()
@@ -32,12 +35,285 @@ var _ = Describe("DiskManagerのテスト", func() {
 				data[1] = 2
 
 				dm.WritePageData(nextPageID, data)
-				res = dm.ReadPageData(nextPageID)
+				res, _ = dm.ReadPageData(nextPageID)
 			})
 			It("正しいバイトが取得される", func() {
 				Expect(res[0]).To(Equal(byte(1)))
 				Expect(res[1]).To(Equal(byte(2)))
 			})
 		})
+		Context("ファイルの範囲外のページを読んだ場合", func() {
+			var (
+				err error
+			)
+			BeforeEach(func() {
+				f := createTestFile(fPath)
+				dm, _ = NewDiskManager(f)
+				var data [PageSize]byte
+				dm.WritePageData(dm.AllocatePage(), data)
+				_, err = dm.ReadPageData(PageID(3))
+			})
+			It("panicせずにerrが返る", func() {
+				Expect(err).NotTo(BeNil())
+			})
+		})
+	})
+	Describe("WritePageData", func() {
+		Context("ファイルが閉じられている場合", func() {
+			var (
+				err error
+			)
+			BeforeEach(func() {
+				f := createTestFile("test_table")
+				dm, _ = NewDiskManager(f)
+				f.Close()
+				var data [PageSize]byte
+				err = dm.WritePageData(dm.AllocatePage(), data)
+			})
+			It("errが返る", func() {
+				Expect(err).NotTo(BeNil())
+			})
+		})
+	})
+	Describe("Sync・Close", func() {
+		var (
+			f    *crashableFile
+			data [PageSize]byte
+		)
+		BeforeEach(func() {
+			f = newCrashableFile()
+			data[0] = 1
+		})
+		// 書き込んだページがクラッシュ後に残っているか
+		survives := func() bool {
+			f.crash()
+			reopened, _ := NewDiskManager(f)
+			res, err := reopened.ReadPageData(PageID(0))
+			return err == nil && res[0] == 1
+		}
+		Context("SyncModeOnFlushの場合", func() {
+			BeforeEach(func() {
+				dm, _ = NewDiskManagerWithSyncMode(f, SyncModeOnFlush)
+				Expect(dm.WritePageData(dm.AllocatePage(), data)).To(Succeed())
+			})
+			It("Syncする前にクラッシュすると書き込みが失われる", func() {
+				Expect(survives()).To(BeFalse())
+			})
+			It("Syncした後はクラッシュしても書き込みが残る", func() {
+				Expect(dm.Sync()).To(Succeed())
+				Expect(survives()).To(BeTrue())
+			})
+			It("Closeした後はクラッシュしても書き込みが残る", func() {
+				Expect(dm.Close()).To(Succeed())
+				Expect(f.closed).To(BeTrue())
+				Expect(survives()).To(BeTrue())
+			})
+		})
+		Context("SyncModeAlwaysの場合", func() {
+			BeforeEach(func() {
+				dm, _ = NewDiskManagerWithSyncMode(f, SyncModeAlways)
+				Expect(dm.WritePageData(dm.AllocatePage(), data)).To(Succeed())
+			})
+			It("Syncしなくてもクラッシュ後に書き込みが残る", func() {
+				Expect(f.syncs).To(Equal(1))
+				Expect(survives()).To(BeTrue())
+			})
+		})
+		Context("SyncModeNeverの場合", func() {
+			BeforeEach(func() {
+				dm, _ = NewDiskManagerWithSyncMode(f, SyncModeNever)
+				Expect(dm.WritePageData(dm.AllocatePage(), data)).To(Succeed())
+			})
+			It("Syncしてもfsyncされずクラッシュすると書き込みが失われる", func() {
+				Expect(dm.Sync()).To(Succeed())
+				Expect(f.syncs).To(Equal(0))
+				Expect(survives()).To(BeFalse())
+			})
+		})
+	})
+	Describe("DeallocatePage", func() {
+		var (
+			f    *crashableFile
+			impl *DiskManagerImpl
+		)
+		BeforeEach(func() {
+			f = newCrashableFile()
+			dm, _ = NewDiskManager(f)
+			impl = dm.(*DiskManagerImpl)
+			var data [PageSize]byte
+			for i := 0; i < 6; i++ {
+				Expect(dm.WritePageData(dm.AllocatePage(), data)).To(Succeed())
+			}
+			Expect(dm.DeallocatePage(PageID(4))).To(Succeed())
+			Expect(dm.DeallocatePage(PageID(2))).To(Succeed())
+			Expect(dm.DeallocatePage(PageID(5))).To(Succeed())
+		})
+		It("解放したページがIDの小さい順に割り当てられる", func() {
+			Expect(dm.AllocatePage()).To(Equal(PageID(2)))
+			Expect(dm.AllocatePage()).To(Equal(PageID(4)))
+			Expect(dm.AllocatePage()).To(Equal(PageID(5)))
+			Expect(dm.AllocatePage()).To(Equal(PageID(6)))
+		})
+		It("開き直しても解放済みのページが分かる", func() {
+			Expect(dm.Sync()).To(Succeed())
+			f.crash()
+			dm, _ = NewDiskManager(f)
+			Expect(dm.AllocatePage()).To(Equal(PageID(2)))
+		})
+		It("壊れたページは解放済みの印が読めても再利用しない", func() {
+			Expect(dm.Sync()).To(Succeed())
+			// ページ2はチェックサムが合わず、ページ4には別のページの解放済みのデータが書かれている
+			f.durable[2*PageSize+100] ^= 0xff
+			copy(f.durable[4*PageSize:5*PageSize], f.durable[5*PageSize:6*PageSize])
+			f.crash()
+			dm, _ = NewDiskManager(f)
+			Expect(dm.(*DiskManagerImpl).FreeSpace().FreePages).To(Equal(uint32(1)))
+			Expect(dm.AllocatePage()).To(Equal(PageID(5)))
+		})
+		It("解放済みのページを上書きすると使用中に戻る", func() {
+			var data [PageSize]byte
+			Expect(dm.WritePageData(PageID(2), data)).To(Succeed())
+			Expect(dm.AllocatePage()).To(Equal(PageID(4)))
+		})
+		It("空きページの数が集計される", func() {
+			Expect(impl.FreeSpace()).To(Equal(FreeSpaceReport{
+				TotalPages:        6,
+				UsedPages:         3,
+				FreePages:         3,
+				TrailingFreePages: 2,
+			}))
+		})
+		It("末尾の解放済みのページが切り詰められる", func() {
+			n, err := impl.TruncateFreePages()
+			Expect(err).To(BeNil())
+			Expect(n).To(Equal(uint32(2)))
+			Expect(f.data).To(HaveLen(4 * PageSize))
+			Expect(impl.FreeSpace()).To(Equal(FreeSpaceReport{
+				TotalPages: 4,
+				UsedPages:  3,
+				FreePages:  1,
+			}))
+			Expect(dm.AllocatePage()).To(Equal(PageID(2)))
+			Expect(dm.AllocatePage()).To(Equal(PageID(4)))
+		})
+	})
+	Describe("Open", func() {
+		Context("ファイルが存在しない場合", func() {
+			It("errが返る", func() {
+				_, err := Open("not_exist_table")
+				Expect(err).NotTo(BeNil())
+			})
+		})
 	})
 })
+
+// 指定した回数だけ書き込みに成功した後は書き込みに失敗する
+type failingDiskManager struct {
+	DiskManager
+	writesLeft int
+}
+
+var errInjectedWrite = errors.New("injected write error")
+
+func (dm *failingDiskManager) WritePageData(pageID PageID, data [PageSize]byte) error {
+	if dm.writesLeft <= 0 {
+		return errInjectedWrite
+	}
+	dm.writesLeft -= 1
+	return dm.DiskManager.WritePageData(pageID, data)
+}
+
+// OSのページキャッシュを真似て書き込みをメモリに溜め、Syncされた分だけを永続化するファイル
+// crashするとSyncされていない書き込みは失われる
+type crashableFile struct {
+	data       []byte // ページキャッシュも含めた今の中身
+	durable    []byte // Syncで永続化された中身
+	syncs      int
+	closed     bool
+	writesLeft int // 0以上の場合はこの回数だけ書き込みに成功した後、クラッシュしたとみなして書き込みに失敗する
+}
+
+func newCrashableFile() *crashableFile {
+	return &crashableFile{writesLeft: -1}
+}
+
+// テストごとの一時ディレクトリにファイルを作る。リポジトリにあるファイルを書き換えないように、実際のファイルを使うテストはこれで作る
+func createTestFile(name string) *os.File {
+	f, err := os.Create(filepath.Join(GinkgoT().TempDir(), name))
+	Expect(err).To(BeNil())
+	return f
+}
+
+// Size以外は使わない
+type crashableFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (fi crashableFileInfo) Size() int64 {
+	return fi.size
+}
+
+func (f *crashableFile) ReadAt(b []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, f.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *crashableFile) WriteAt(b []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.writesLeft == 0 {
+		return 0, errInjectedWrite
+	}
+	if f.writesLeft > 0 {
+		f.writesLeft -= 1
+	}
+	if end := off + int64(len(b)); end > int64(len(f.data)) {
+		f.data = append(f.data, make([]byte, end-int64(len(f.data)))...)
+	}
+	return copy(f.data[off:], b), nil
+}
+
+func (f *crashableFile) Truncate(size int64) error {
+	if size < int64(len(f.data)) {
+		f.data = f.data[:size]
+	} else {
+		f.data = append(f.data, make([]byte, size-int64(len(f.data)))...)
+	}
+	return nil
+}
+
+func (f *crashableFile) Stat() (os.FileInfo, error) {
+	return crashableFileInfo{size: int64(len(f.data))}, nil
+}
+
+func (f *crashableFile) Sync() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.durable = append([]byte{}, f.data...)
+	f.syncs += 1
+	return nil
+}
+
+func (f *crashableFile) Close() error {
+	f.closed = true
+	return nil
+}
+
+// 永続化されていない書き込みを捨てて、開き直せる状態に戻す
+func (f *crashableFile) crash() {
+	f.data = append([]byte{}, f.durable...)
+	f.closed = false
+	f.writesLeft = -1
+}
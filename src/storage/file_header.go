@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"runtime"
+	"time"
+)
+
+type (
+	Endianness uint8
+
+	// ファイルの先頭ページ(PageID0)に書くヘッダー
+	// ページのヘッダー(PageLSN・チェックサム)の後ろに置くので、WALを通して書き込んでも壊れない
+	FileHeader struct {
+		Version    uint32
+		PageSize   uint32
+		Endianness Endianness // ページ・ヘッダーの数値をどのバイトオーダーで書いたか。FormatVersion2以降は常にビッグエンディアン
+		RootPageID PageID
+		Height     uint32 // rootからleafまでのページ数。rootが無い場合は0
+		KeyCount   uint64
+		KeyLen     uint32 // 可変長のカラムがある場合はVariableKeyLen
+		RowIDLen   uint32
+		KeySchema  KeySchema // 型付きのキーの場合のカラム。NewBytesで作るuint32のカラムの場合はnil
+		Split      SplitConfig
+		CreatedAt  time.Time
+		CreatedBy  string // 作成した環境。最大CreatedByMaxNByteバイト
+	}
+)
+
+const (
+	EndiannessLittle Endianness = iota + 1
+	EndiannessBig
+)
+
+const (
+	FormatVersion uint32 = 3 // ページのヘッダーにスロットの数とデータの先頭を持つ
+	// ホストのバイトオーダー(リトルエンディアン)で書いていた頃のバージョン。MigrateLittleEndianで移行できる
+	FormatVersionLittleEndian uint32 = 1
+	// ビッグエンディアンで書くようになってから、スロットの数をページのヘッダーに持つまでのバージョン。MigrateUnslottedで移行できる
+	FormatVersionUnslotted uint32 = 2
+
+	CreatedByMaxNByte = 64
+
+	// ヘッダーの各値のオフセット。どのバージョンでも同じ位置に置くので、チェックサムの直後から始まる
+	MagicOffset          = ChecksumOffset + 4
+	MagicNByte           = 8
+	VersionOffset        = MagicOffset + MagicNByte
+	PageSizeOffset       = VersionOffset + 4
+	EndiannessOffset     = PageSizeOffset + 4
+	HeaderRootPageOffset = EndiannessOffset + 1
+	KeyLenOffset         = HeaderRootPageOffset + 4
+	RowIDLenOffset       = KeyLenOffset + 4
+	CreatedAtOffset      = RowIDLenOffset + 4
+	CreatedByOffset      = CreatedAtOffset + 8 // 長さ(1) + 文字列
+	HeightOffset         = CreatedByOffset + 1 + CreatedByMaxNByte
+	KeyCountOffset       = HeightOffset + 4
+	KeySchemaOffset      = KeyCountOffset + 8 // カラムの数(1) + カラムごとにKeyColumnNByte
+	SplitPolicyOffset    = KeySchemaOffset + 1 + KeySchemaMaxColumns*KeyColumnNByte
+	FillFactorOffset     = SplitPolicyOffset + 1 // float64のビット列。0の場合は1として扱う
+)
+
+var (
+	Magic = [MagicNByte]byte{'k', 's', 'q', 'l', 'i', 'd', 'x', 0}
+
+	ErrInvalidMagic             = errors.New("not a ksql file")
+	ErrUnsupportedFormatVersion = errors.New("unsupported format version")
+	ErrPageSizeMismatch         = errors.New("page size mismatch")
+)
+
+// 新しく作るファイルのヘッダーを返す。rootはまだ無い
+func NewFileHeader(keyLen, rowIDLen uint32) *FileHeader {
+	return &FileHeader{
+		Version:    FormatVersion,
+		PageSize:   PageSize,
+		Endianness: EndiannessBig,
+		RootPageID: InvalidPageID,
+		KeyLen:     keyLen,
+		RowIDLen:   rowIDLen,
+		Split:      SplitConfig{SplitPolicyMidpoint, 1},
+		CreatedAt:  time.Now(),
+		CreatedBy:  fmt.Sprintf("ksql %s %s/%s", runtime.Version(), runtime.GOOS, runtime.GOARCH),
+	}
+}
+
+// マジックナンバー・バージョン・ページサイズが合わない場合はエラーを返す
+func ReadFileHeader(dm DiskManager) (*FileHeader, error) {
+	b, err := dm.ReadPageData(InvalidPageID)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeFileHeader(b)
+}
+
+func DecodeFileHeader(b [PageSize]byte) (*FileHeader, error) {
+	h, err := decodeFileHeader(b)
+	if err != nil {
+		return nil, err
+	}
+	if h.Version == FormatVersionLittleEndian {
+		return nil, fmt.Errorf("%w: %d (little-endian file, migrate it with MigrateLittleEndian)", ErrUnsupportedFormatVersion, h.Version)
+	}
+	if h.Version == FormatVersionUnslotted {
+		return nil, fmt.Errorf("%w: %d (unslotted file, migrate it with MigrateUnslotted)", ErrUnsupportedFormatVersion, h.Version)
+	}
+	if h.Version != FormatVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedFormatVersion, h.Version)
+	}
+	return h, nil
+}
+
+// バージョンは確認しない。ヘッダー自体はどのバージョンでも同じレイアウトで、Endiannessのバイトオーダーで書かれている
+func decodeFileHeader(b [PageSize]byte) (*FileHeader, error) {
+	if [MagicNByte]byte(b[MagicOffset:MagicOffset+MagicNByte]) != Magic {
+		return nil, ErrInvalidMagic
+	}
+	h := &FileHeader{Endianness: Endianness(b[EndiannessOffset])}
+	order, err := h.Endianness.byteOrder()
+	if err != nil {
+		return nil, err
+	}
+	h.Version = order.Uint32(b[VersionOffset : VersionOffset+4])
+	if order.Uint32(b[ChecksumOffset:ChecksumOffset+4]) != pageChecksum(&b) {
+		return nil, &ErrPageCorrupted{InvalidPageID, "checksum mismatch"}
+	}
+	h.PageSize = order.Uint32(b[PageSizeOffset : PageSizeOffset+4])
+	if h.PageSize != PageSize {
+		return nil, fmt.Errorf("%w: file has %d, expected %d", ErrPageSizeMismatch, h.PageSize, PageSize)
+	}
+	h.RootPageID = PageID(order.Uint32(b[HeaderRootPageOffset : HeaderRootPageOffset+4]))
+	h.Height = order.Uint32(b[HeightOffset : HeightOffset+4])
+	h.KeyCount = order.Uint64(b[KeyCountOffset : KeyCountOffset+8])
+	h.KeyLen = order.Uint32(b[KeyLenOffset : KeyLenOffset+4])
+	h.RowIDLen = order.Uint32(b[RowIDLenOffset : RowIDLenOffset+4])
+	h.CreatedAt = time.Unix(0, int64(order.Uint64(b[CreatedAtOffset:CreatedAtOffset+8])))
+	n := int(b[CreatedByOffset])
+	h.CreatedBy = string(b[CreatedByOffset+1 : CreatedByOffset+1+n])
+	if h.KeySchema, err = decodeKeySchema(b[KeySchemaOffset:], order); err != nil {
+		return nil, err
+	}
+	h.Split.Policy = SplitPolicy(b[SplitPolicyOffset])
+	if h.Split.FillFactor = math.Float64frombits(order.Uint64(b[FillFactorOffset : FillFactorOffset+8])); h.Split.FillFactor == 0 {
+		h.Split.FillFactor = 1
+	}
+	return h, nil
+}
+
+// h.Endiannessに関わらずビッグエンディアンで書く
+func (h *FileHeader) Bytes() [PageSize]byte {
+	var b [PageSize]byte
+	order := binary.BigEndian
+	copy(b[MagicOffset:MagicOffset+MagicNByte], Magic[:])
+	order.PutUint32(b[VersionOffset:VersionOffset+4], h.Version)
+	order.PutUint32(b[PageSizeOffset:PageSizeOffset+4], h.PageSize)
+	b[EndiannessOffset] = byte(EndiannessBig)
+	order.PutUint32(b[HeaderRootPageOffset:HeaderRootPageOffset+4], uint32(h.RootPageID))
+	order.PutUint32(b[HeightOffset:HeightOffset+4], h.Height)
+	order.PutUint64(b[KeyCountOffset:KeyCountOffset+8], h.KeyCount)
+	order.PutUint32(b[KeyLenOffset:KeyLenOffset+4], h.KeyLen)
+	order.PutUint32(b[RowIDLenOffset:RowIDLenOffset+4], h.RowIDLen)
+	order.PutUint64(b[CreatedAtOffset:CreatedAtOffset+8], uint64(h.CreatedAt.UnixNano()))
+	createdBy := h.CreatedBy
+	if len(createdBy) > CreatedByMaxNByte {
+		createdBy = createdBy[:CreatedByMaxNByte]
+	}
+	b[CreatedByOffset] = byte(len(createdBy))
+	copy(b[CreatedByOffset+1:], createdBy)
+	copy(b[KeySchemaOffset:], h.KeySchema.bytes())
+	b[SplitPolicyOffset] = byte(h.Split.Policy)
+	order.PutUint64(b[FillFactorOffset:FillFactorOffset+8], math.Float64bits(h.Split.FillFactor))
+	SetPageChecksum(&b)
+	return b
+}
+
+func (h *FileHeader) Flush(dm DiskManager) error {
+	return dm.WritePageData(InvalidPageID, h.Bytes())
+}
+
+func (e Endianness) byteOrder() (binary.ByteOrder, error) {
+	switch e {
+	case EndiannessLittle:
+		return binary.LittleEndian, nil
+	case EndiannessBig:
+		return binary.BigEndian, nil
+	}
+	return nil, fmt.Errorf("unknown endianness %d", e)
+}
@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"strconv"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("FileHeaderのテスト", func() {
+	var (
+		dm  DiskManager
+		err error
+	)
+	BeforeEach(func() {
+		dm, _ = NewDiskManager(newCrashableFile())
+		Expect(NewNonUniqueTable(dm, ColumnSize, 4)).To(Succeed())
+	})
+	Describe("ReadFileHeader", func() {
+		It("書き込んだ値が読める", func() {
+			header, err := ReadFileHeader(dm)
+			Expect(err).To(BeNil())
+			Expect(header.Version).To(Equal(FormatVersion))
+			Expect(header.PageSize).To(Equal(uint32(PageSize)))
+			Expect(header.Endianness).To(Equal(EndiannessBig))
+			Expect(header.RootPageID).To(Equal(InvalidPageID))
+			Expect(header.KeyLen).To(Equal(uint32(ColumnSize)))
+			Expect(header.RowIDLen).To(Equal(uint32(4)))
+			Expect(header.CreatedAt.IsZero()).To(BeFalse())
+			Expect(header.CreatedBy).To(HavePrefix("ksql "))
+		})
+		It("rootを作るとヘッダーに記録される", func() {
+			btree, _ := NewBPlustTree(dm)
+			Expect(btree.InsertRow(dm, NewBytes(1), NewBytes(1), NewBytes(1))).To(Succeed())
+			header, _ := ReadFileHeader(dm)
+			Expect(header.RootPageID).To(Equal(RootPageID))
+		})
+	})
+	Describe("高さとキーの数", func() {
+		var (
+			btree *BPlustTree
+		)
+		// 高さはSliceで辿ったページの深さと一致し、開き直した木もヘッダーから同じ値を読む
+		expectStats := func(keyCount uint64) {
+			var height uint32
+			for _, p := range sliceOf(btree, dm) {
+				if uint32(p.Depth)+1 > height {
+					height = uint32(p.Depth) + 1
+				}
+			}
+			Expect(btree.Height).To(Equal(height))
+			Expect(btree.KeyCount).To(Equal(keyCount))
+			reopened, err := NewBPlustTree(dm)
+			Expect(err).To(BeNil())
+			Expect(reopened.RootNodeID).To(Equal(RootPageID))
+			Expect(reopened.Height).To(Equal(height))
+			Expect(reopened.KeyCount).To(Equal(keyCount))
+		}
+		BeforeEach(func() {
+			os.Setenv(BytesSizeLimitKey, strconv.Itoa(84))
+			dm, _ = NewDiskManager(newCrashableFile())
+			NewTable2(dm, ColumnSize)
+			btree, _ = NewBPlustTree(dm)
+		})
+		It("rootが無い場合は0", func() {
+			Expect(btree.Height).To(Equal(uint32(0)))
+			Expect(btree.KeyCount).To(Equal(uint64(0)))
+		})
+		It("挿入・削除に合わせて更新される", func() {
+			var i uint32
+			for i = 0; i < 3; i++ {
+				Expect(btree.InsertPair(dm, NewBytes(i), NewBytes(i))).To(Succeed())
+			}
+			expectStats(3)
+			Expect(btree.Height).To(Equal(uint32(2)))
+
+			for i = 3; i < 30; i++ {
+				Expect(btree.InsertPair(dm, NewBytes(i), NewBytes(i))).To(Succeed())
+			}
+			expectStats(30)
+			Expect(btree.Height).To(BeNumerically(">", 2))
+
+			Expect(btree.Put(dm, NewBytes(0), NewBytes(100))).To(Succeed())
+			Expect(btree.Put(dm, NewBytes(100), NewBytes(100))).To(Succeed())
+			Expect(btree.InsertPair(dm, NewBytes(1), NewBytes(1))).To(Equal(ErrDuplicateKey))
+			expectStats(31)
+
+			for i = 0; i < 28; i++ {
+				Expect(btree.Delete(dm, NewBytes(i))).To(Succeed())
+			}
+			expectStats(3)
+		})
+		It("ページ0は読み直さず、値が変わった時だけ書き込む", func() {
+			var i uint32
+			for i = 0; i < 30; i++ {
+				Expect(btree.InsertPair(dm, NewBytes(i), NewBytes(i))).To(Succeed())
+			}
+			counting := &headerCountingDiskManager{DiskManager: dm}
+			Expect(btree.Update(counting, NewBytes(3), NewBytes(4))).To(Succeed())
+			Expect(btree.Put(counting, NewBytes(3), NewBytes(5))).To(Succeed())
+			Expect(btree.Delete(counting, NewBytes(100))).To(Equal(ErrKeyNotFound))
+			Expect(counting.reads).To(BeZero())
+			Expect(counting.writes).To(BeZero())
+
+			Expect(btree.Delete(counting, NewBytes(3))).To(Succeed())
+			Expect(btree.InsertPair(counting, NewBytes(3), NewBytes(3))).To(Succeed())
+			Expect(counting.reads).To(BeZero())
+			Expect(counting.writes).To(Equal(2))
+			expectStats(30)
+		})
+	})
+	Describe("NewBPlustTree", func() {
+		var (
+			b [PageSize]byte
+		)
+		JustBeforeEach(func() {
+			dm.WritePageData(InvalidPageID, b)
+			_, err = NewBPlustTree(dm)
+		})
+		Context("マジックナンバーが違う場合", func() {
+			BeforeEach(func() {
+				b, _ = dm.ReadPageData(InvalidPageID)
+				b[MagicOffset] = 'x'
+			})
+			It("ErrInvalidMagicが返る", func() {
+				Expect(err).To(Equal(ErrInvalidMagic))
+			})
+		})
+		Context("古いヘッダーの無いファイルの場合", func() {
+			BeforeEach(func() {
+				b = [PageSize]byte{}
+				binary.NativeEndian.PutUint32(b[:4], ColumnSize)
+			})
+			It("ErrInvalidMagicが返る", func() {
+				Expect(err).To(Equal(ErrInvalidMagic))
+			})
+		})
+		Context("対応していないバージョンの場合", func() {
+			BeforeEach(func() {
+				header, _ := ReadFileHeader(dm)
+				header.Version = FormatVersion + 1
+				b = header.Bytes()
+			})
+			It("ErrUnsupportedFormatVersionが返る", func() {
+				Expect(errors.Is(err, ErrUnsupportedFormatVersion)).To(BeTrue())
+			})
+		})
+		Context("ページサイズが違う場合", func() {
+			BeforeEach(func() {
+				header, _ := ReadFileHeader(dm)
+				header.PageSize = PageSize * 2
+				b = header.Bytes()
+			})
+			It("ErrPageSizeMismatchが返る", func() {
+				Expect(errors.Is(err, ErrPageSizeMismatch)).To(BeTrue())
+			})
+		})
+		Context("チェックサムが合わない場合", func() {
+			BeforeEach(func() {
+				b, _ = dm.ReadPageData(InvalidPageID)
+				b[KeyLenOffset] ^= 1
+			})
+			It("ErrPageCorruptedが返る", func() {
+				var corrupted *ErrPageCorrupted
+				Expect(errors.As(err, &corrupted)).To(BeTrue())
+			})
+		})
+	})
+})
+
+// ページ0の読み書きを数えるDiskManager
+type headerCountingDiskManager struct {
+	DiskManager
+	reads  int
+	writes int
+}
+
+func (dm *headerCountingDiskManager) ReadPageData(pageID PageID) ([PageSize]byte, error) {
+	if pageID == InvalidPageID {
+		dm.reads += 1
+	}
+	return dm.DiskManager.ReadPageData(pageID)
+}
+
+func (dm *headerCountingDiskManager) WritePageData(pageID PageID, data [PageSize]byte) error {
+	if pageID == InvalidPageID {
+		dm.writes += 1
+	}
+	return dm.DiskManager.WritePageData(pageID, data)
+}
@@ -0,0 +1,309 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+type (
+	ColumnType uint8
+	SortOrder  uint8
+
+	// 型付きのキーのカラム
+	KeyColumn struct {
+		Type  ColumnType
+		Order SortOrder
+		Size  uint32 // ColumnTypeFixedString・ColumnTypeFixedBytesのバイト数。それ以外の型では使わない
+	}
+
+	// キーを構成するカラムの並び
+	// Encodeしたキーはバイト列のまま(memcmpで)比較すると、先頭のカラムから順に各型の大小関係とOrderで比較した結果と一致する
+	// 可変長のカラムはエスケープして終端を付けるので、どのキーも他のキーの先頭部分にならない
+	KeySchema []KeyColumn
+)
+
+const (
+	ColumnTypeInt32 ColumnType = iota + 1
+	ColumnTypeInt64
+	ColumnTypeFloat64
+	ColumnTypeFixedString
+	ColumnTypeString
+	ColumnTypeFixedBytes
+	ColumnTypeBytes
+	ColumnTypeBool
+	ColumnTypeTimestamp // UnixNanoをColumnTypeInt64と同じようにエンコードする
+)
+
+const (
+	SortOrderAsc SortOrder = iota
+	SortOrderDesc
+)
+
+const (
+	// キーの長さが決まっていないことを表すKeyLen。Compareに渡すとキー全体を比較する
+	VariableKeyLen uint32 = math.MaxUint32
+
+	KeySchemaMaxColumns = 32
+	KeyColumnNByte      = 6 // 型(1) + 順序(1) + サイズ(4)
+
+	// 可変長のカラムでは0x00を0x00 0xFFにエスケープし、0x00 0x01で終える
+	escapeByte     byte = 0x00
+	escapedByte    byte = 0xFF
+	terminatorByte byte = 0x01
+)
+
+var (
+	ErrKeySchemaMismatch = errors.New("key does not match schema")
+)
+
+// カラムが全て固定長の場合はキーのバイト数を、可変長のカラムがある場合はVariableKeyLenを返す
+func (s KeySchema) KeyLen() uint32 {
+	var n uint32
+	for _, c := range s {
+		size, ok := c.fixedSize()
+		if !ok {
+			return VariableKeyLen
+		}
+		n += size
+	}
+	return n
+}
+
+// valuesを先頭のカラムから順にエンコードする
+// valuesがカラムより少ない場合は先頭のカラムだけのキーになり、Boundに渡すとそのカラムが一致するキーを全て範囲に含める
+// 型はint32,int64,float64,string,[]byte,bool,time.Timeで、カラムの型と一致しなければならない
+func (s KeySchema) Encode(values ...any) (Bytes, error) {
+	if len(values) > len(s) {
+		return nil, fmt.Errorf("%w: %d values for %d columns", ErrKeySchemaMismatch, len(values), len(s))
+	}
+	var key Bytes
+	for i, v := range values {
+		start := len(key)
+		var err error
+		if key, err = s[i].encode(key, v); err != nil {
+			return nil, fmt.Errorf("column %d: %w", i, err)
+		}
+		if s[i].Order == SortOrderDesc {
+			for j := start; j < len(key); j++ {
+				key[j] = ^key[j]
+			}
+		}
+	}
+	return key, nil
+}
+
+// Encodeしたキーを各カラムの値に戻す。先頭のカラムだけのキーの場合はそのカラムまで返す
+func (s KeySchema) Decode(key Bytes) ([]any, error) {
+	var values []any
+	for i, c := range s {
+		if len(key) == 0 {
+			break
+		}
+		n, err := c.encodedLen(key)
+		if err != nil {
+			return nil, fmt.Errorf("column %d: %w", i, err)
+		}
+		b := append([]byte{}, key[:n]...)
+		if c.Order == SortOrderDesc {
+			for j := range b {
+				b[j] = ^b[j]
+			}
+		}
+		values = append(values, c.decode(b))
+		key = key[n:]
+	}
+	if len(key) > 0 {
+		return nil, fmt.Errorf("%w: %d trailing bytes", ErrKeySchemaMismatch, len(key))
+	}
+	return values, nil
+}
+
+func (c KeyColumn) fixedSize() (uint32, bool) {
+	switch c.Type {
+	case ColumnTypeInt32:
+		return 4, true
+	case ColumnTypeInt64, ColumnTypeFloat64, ColumnTypeTimestamp:
+		return 8, true
+	case ColumnTypeBool:
+		return 1, true
+	case ColumnTypeFixedString, ColumnTypeFixedBytes:
+		return c.Size, true
+	}
+	return 0, false
+}
+
+// 昇順でエンコードしてkeyの後ろに付ける
+func (c KeyColumn) encode(key Bytes, v any) (Bytes, error) {
+	switch c.Type {
+	case ColumnTypeInt32:
+		if n, ok := v.(int32); ok {
+			return binary.BigEndian.AppendUint32(key, uint32(n)^(1<<31)), nil
+		}
+	case ColumnTypeInt64:
+		if n, ok := v.(int64); ok {
+			return binary.BigEndian.AppendUint64(key, uint64(n)^(1<<63)), nil
+		}
+	case ColumnTypeTimestamp:
+		if t, ok := v.(time.Time); ok {
+			return binary.BigEndian.AppendUint64(key, uint64(t.UnixNano())^(1<<63)), nil
+		}
+	case ColumnTypeFloat64:
+		if f, ok := v.(float64); ok {
+			if math.IsNaN(f) {
+				return nil, fmt.Errorf("%w: NaN cannot be compared", ErrKeySchemaMismatch)
+			}
+			// 負の数は全てのビットを、0以上の数は符号ビットだけを反転する。-0は0と同じにする
+			if f == 0 {
+				f = 0
+			}
+			bits := math.Float64bits(f)
+			if bits>>63 == 1 {
+				bits = ^bits
+			} else {
+				bits |= 1 << 63
+			}
+			return binary.BigEndian.AppendUint64(key, bits), nil
+		}
+	case ColumnTypeBool:
+		if b, ok := v.(bool); ok {
+			if b {
+				return append(key, 1), nil
+			}
+			return append(key, 0), nil
+		}
+	case ColumnTypeFixedString, ColumnTypeFixedBytes:
+		b, ok := c.raw(v)
+		if !ok {
+			break
+		}
+		// 固定長の文字列は0x00で埋める。バイト列は長さが一致しなければならない
+		if uint32(len(b)) > c.Size || (c.Type == ColumnTypeFixedBytes && uint32(len(b)) != c.Size) {
+			return nil, fmt.Errorf("%w: %d bytes for size %d", ErrKeySchemaMismatch, len(b), c.Size)
+		}
+		key = append(key, b...)
+		return append(key, make([]byte, c.Size-uint32(len(b)))...), nil
+	case ColumnTypeString, ColumnTypeBytes:
+		b, ok := c.raw(v)
+		if !ok {
+			break
+		}
+		for _, x := range b {
+			key = append(key, x)
+			if x == escapeByte {
+				key = append(key, escapedByte)
+			}
+		}
+		return append(key, escapeByte, terminatorByte), nil
+	default:
+		return nil, fmt.Errorf("%w: unknown column type %d", ErrKeySchemaMismatch, c.Type)
+	}
+	return nil, fmt.Errorf("%w: %T for column type %d", ErrKeySchemaMismatch, v, c.Type)
+}
+
+func (c KeyColumn) raw(v any) ([]byte, bool) {
+	switch c.Type {
+	case ColumnTypeFixedString, ColumnTypeString:
+		s, ok := v.(string)
+		return []byte(s), ok
+	default:
+		b, ok := v.([]byte)
+		return b, ok
+	}
+}
+
+// keyの先頭にあるこのカラムのバイト数を返す
+func (c KeyColumn) encodedLen(key Bytes) (int, error) {
+	if size, ok := c.fixedSize(); ok {
+		if uint32(len(key)) < size {
+			return 0, fmt.Errorf("%w: %d bytes for size %d", ErrKeySchemaMismatch, len(key), size)
+		}
+		return int(size), nil
+	}
+	escape, terminator := escapeByte, terminatorByte
+	if c.Order == SortOrderDesc {
+		escape, terminator = ^escape, ^terminator
+	}
+	for i := 0; i+1 < len(key); i++ {
+		if key[i] != escape {
+			continue
+		}
+		if key[i+1] == terminator {
+			return i + 2, nil
+		}
+		i++
+	}
+	return 0, fmt.Errorf("%w: missing terminator", ErrKeySchemaMismatch)
+}
+
+// 昇順に戻したbをデコードする
+func (c KeyColumn) decode(b []byte) any {
+	switch c.Type {
+	case ColumnTypeInt32:
+		return int32(binary.BigEndian.Uint32(b) ^ (1 << 31))
+	case ColumnTypeInt64:
+		return int64(binary.BigEndian.Uint64(b) ^ (1 << 63))
+	case ColumnTypeTimestamp:
+		return time.Unix(0, int64(binary.BigEndian.Uint64(b)^(1<<63)))
+	case ColumnTypeFloat64:
+		bits := binary.BigEndian.Uint64(b)
+		if bits>>63 == 1 {
+			bits &^= 1 << 63
+		} else {
+			bits = ^bits
+		}
+		return math.Float64frombits(bits)
+	case ColumnTypeBool:
+		return b[0] == 1
+	case ColumnTypeFixedString:
+		return string(bytes.TrimRight(b, "\x00"))
+	case ColumnTypeFixedBytes:
+		return b
+	case ColumnTypeString:
+		return string(unescape(b))
+	default:
+		return unescape(b)
+	}
+}
+
+// 終端を取り除き、エスケープした0x00を戻す
+func unescape(b []byte) []byte {
+	b = b[:len(b)-2]
+	res := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		res = append(res, b[i])
+		if b[i] == escapeByte {
+			i++
+		}
+	}
+	return res
+}
+
+// ファイルヘッダーに書くバイト列。カラムの数(1) + カラムごとにKeyColumnNByte
+func (s KeySchema) bytes() []byte {
+	b := []byte{byte(len(s))}
+	for _, c := range s {
+		b = append(b, byte(c.Type), byte(c.Order))
+		b = binary.BigEndian.AppendUint32(b, c.Size)
+	}
+	return b
+}
+
+func decodeKeySchema(b []byte, order binary.ByteOrder) (KeySchema, error) {
+	n := int(b[0])
+	if n > KeySchemaMaxColumns {
+		return nil, fmt.Errorf("%w: %d columns", ErrKeySchemaMismatch, n)
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	s := make(KeySchema, n)
+	for i := range s {
+		start := 1 + i*KeyColumnNByte
+		s[i] = KeyColumn{ColumnType(b[start]), SortOrder(b[start+1]), order.Uint32(b[start+2 : start+6])}
+	}
+	return s, nil
+}
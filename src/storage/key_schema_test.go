@@ -0,0 +1,234 @@
+package storage
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("KeySchemaのテスト", func() {
+	// valuesを昇順に並べたものとして、エンコードしたキーもその順に並ぶことを確かめる
+	expectOrdered := func(schema KeySchema, values ...any) {
+		var prev Bytes
+		for i, v := range values {
+			key, err := schema.Encode(v)
+			Expect(err).To(BeNil())
+			if i > 0 {
+				Expect(prev.Compare(key, VariableKeyLen)).To(Equal(ComparisonResultSmall), "%v < %v", values[i-1], v)
+			}
+			prev = key
+		}
+	}
+	Describe("Encode", func() {
+		It("int32は負の数も大小の順に並ぶ", func() {
+			expectOrdered(KeySchema{{Type: ColumnTypeInt32}}, int32(math.MinInt32), int32(-1), int32(0), int32(1), int32(math.MaxInt32))
+		})
+		It("int64は負の数も大小の順に並ぶ", func() {
+			expectOrdered(KeySchema{{Type: ColumnTypeInt64}}, int64(math.MinInt64), int64(-1<<40), int64(0), int64(1<<40), int64(math.MaxInt64))
+		})
+		It("float64は負の数と無限大も大小の順に並ぶ", func() {
+			expectOrdered(KeySchema{{Type: ColumnTypeFloat64}}, math.Inf(-1), -1e10, -0.5, 0.0, 1e-300, 0.5, 1e10, math.Inf(1))
+		})
+		It("float64の-0と0は等しい", func() {
+			schema := KeySchema{{Type: ColumnTypeFloat64}}
+			zero, _ := schema.Encode(0.0)
+			negativeZero, _ := schema.Encode(math.Copysign(0, -1))
+			Expect(negativeZero).To(Equal(zero))
+		})
+		It("可変長の文字列は辞書順に並び、短い方が小さい", func() {
+			expectOrdered(KeySchema{{Type: ColumnTypeString}}, "", "a", "a\x00", "a\x00b", "a\x01", "ab", "b")
+		})
+		It("固定長の文字列は辞書順に並ぶ", func() {
+			expectOrdered(KeySchema{{Type: ColumnTypeFixedString, Size: 4}}, "", "a", "ab", "abcd", "b")
+		})
+		It("boolとタイムスタンプは大小の順に並ぶ", func() {
+			expectOrdered(KeySchema{{Type: ColumnTypeBool}}, false, true)
+			expectOrdered(KeySchema{{Type: ColumnTypeTimestamp}}, time.Unix(-1, 0), time.Unix(0, 0), time.Unix(0, 1), time.Unix(1700000000, 0))
+		})
+		It("降順のカラムは逆の順に並ぶ", func() {
+			expectOrdered(KeySchema{{Type: ColumnTypeInt32, Order: SortOrderDesc}}, int32(1), int32(0), int32(-1))
+			expectOrdered(KeySchema{{Type: ColumnTypeString, Order: SortOrderDesc}}, "b", "ab", "a\x00", "a", "")
+		})
+		It("複数のカラムは先頭のカラムから順に比べる", func() {
+			schema := KeySchema{{Type: ColumnTypeString}, {Type: ColumnTypeInt32, Order: SortOrderDesc}}
+			keys := []Bytes{}
+			for _, values := range [][]any{{"a", int32(2)}, {"a", int32(1)}, {"a\x00", int32(5)}, {"b", int32(9)}} {
+				key, err := schema.Encode(values...)
+				Expect(err).To(BeNil())
+				keys = append(keys, key)
+			}
+			for i := 1; i < len(keys); i++ {
+				Expect(keys[i-1].Compare(keys[i], VariableKeyLen)).To(Equal(ComparisonResultSmall))
+			}
+		})
+		It("型が合わない値はErrKeySchemaMismatchが返る", func() {
+			_, err := KeySchema{{Type: ColumnTypeInt32}}.Encode(int64(1))
+			Expect(errors.Is(err, ErrKeySchemaMismatch)).To(BeTrue())
+			_, err = KeySchema{{Type: ColumnTypeFixedString, Size: 2}}.Encode("abc")
+			Expect(errors.Is(err, ErrKeySchemaMismatch)).To(BeTrue())
+			_, err = KeySchema{{Type: ColumnTypeFloat64}}.Encode(math.NaN())
+			Expect(errors.Is(err, ErrKeySchemaMismatch)).To(BeTrue())
+		})
+	})
+	Describe("Decode", func() {
+		It("エンコードした値に戻る", func() {
+			schema := KeySchema{
+				{Type: ColumnTypeInt32},
+				{Type: ColumnTypeInt64, Order: SortOrderDesc},
+				{Type: ColumnTypeFloat64},
+				{Type: ColumnTypeFixedString, Size: 8},
+				{Type: ColumnTypeString, Order: SortOrderDesc},
+				{Type: ColumnTypeFixedBytes, Size: 2},
+				{Type: ColumnTypeBytes},
+				{Type: ColumnTypeBool},
+				{Type: ColumnTypeTimestamp},
+			}
+			values := []any{int32(-5), int64(-1 << 40), -2.5, "abc", "x\x00y", []byte{0, 1}, []byte{0, 0, 255}, true, time.Unix(1700000000, 123)}
+			key, err := schema.Encode(values...)
+			Expect(err).To(BeNil())
+			Expect(schema.KeyLen()).To(Equal(VariableKeyLen))
+			decoded, err := schema.Decode(key)
+			Expect(err).To(BeNil())
+			Expect(decoded[:8]).To(Equal(values[:8]))
+			Expect(decoded[8].(time.Time).Equal(values[8].(time.Time))).To(BeTrue())
+		})
+		It("終端の無いキーはErrKeySchemaMismatchが返る", func() {
+			schema := KeySchema{{Type: ColumnTypeString}}
+			key, _ := schema.Encode("abc")
+			_, err := schema.Decode(key[:len(key)-1])
+			Expect(errors.Is(err, ErrKeySchemaMismatch)).To(BeTrue())
+		})
+	})
+	Describe("型付きのキーを持つ木", func() {
+		var (
+			dm     DiskManager
+			btree  *BPlustTree
+			schema KeySchema
+			names  []string
+		)
+		BeforeEach(func() {
+			os.Setenv(BytesSizeLimitKey, strconv.Itoa(200))
+			schema = KeySchema{{Type: ColumnTypeString}, {Type: ColumnTypeInt32, Order: SortOrderDesc}}
+			names = []string{"", "a", "ab", "b", "bcd", "c\x00", "long name"}
+			dm, _ = NewDiskManager(newCrashableFile())
+			Expect(NewTypedTable(dm, schema, 0)).To(Succeed())
+			btree, _ = NewBPlustTree(dm)
+
+			var keys []Bytes
+			for _, name := range names {
+				for i := int32(-3); i <= 3; i++ {
+					key, _ := schema.Encode(name, i)
+					keys = append(keys, key)
+				}
+			}
+			rand.New(rand.NewSource(1)).Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+			for _, key := range keys {
+				Expect(btree.InsertPair(dm, key, NewBytes(1))).To(Succeed())
+			}
+		})
+		It("スキーマがヘッダーに記録される", func() {
+			Expect(btree.KeyLen).To(Equal(VariableKeyLen))
+			Expect(btree.KeySchema).To(Equal(schema))
+			Expect(btree.Height).To(BeNumerically(">", 1))
+		})
+		It("カラムの型と順序の通りに走査できる", func() {
+			cursor := btree.Scan(dm, nil, nil)
+			var got [][]any
+			for cursor.Next() {
+				values, err := schema.Decode(cursor.Key())
+				Expect(err).To(BeNil())
+				got = append(got, values)
+			}
+			Expect(cursor.Err()).To(BeNil())
+			var expected [][]any
+			for _, name := range names {
+				for i := int32(3); i >= -3; i-- {
+					expected = append(expected, []any{name, i})
+				}
+			}
+			Expect(got).To(Equal(expected))
+		})
+		It("先頭のカラムだけで範囲を指定できる", func() {
+			prefix, _ := schema.Encode("b")
+			cursor := btree.Scan(dm, &Bound{prefix, true}, &Bound{prefix, true})
+			n := 0
+			for cursor.Prev() {
+				values, _ := schema.Decode(cursor.Key())
+				Expect(values).To(Equal([]any{"b", int32(-3 + n)}))
+				n++
+			}
+			Expect(n).To(Equal(7))
+		})
+		It("取得と削除ができる", func() {
+			key, _ := schema.Encode("ab", int32(2))
+			_, found, err := btree.Get(dm, key)
+			Expect(err).To(BeNil())
+			Expect(found).To(BeTrue())
+			Expect(btree.Delete(dm, key)).To(Succeed())
+			_, found, _ = btree.Get(dm, key)
+			Expect(found).To(BeFalse())
+			shorter, _ := schema.Encode("a", int32(2))
+			_, found, _ = btree.Get(dm, shorter)
+			Expect(found).To(BeTrue())
+		})
+		It("重複キーを許すインデックスでは同じキーを全て取得できる", func() {
+			dm, _ = NewDiskManager(newCrashableFile())
+			Expect(NewTypedTable(dm, schema, 4)).To(Succeed())
+			btree, _ = NewBPlustTree(dm)
+			for _, name := range names {
+				for i := uint32(0); i < 5; i++ {
+					key, _ := schema.Encode(name, int32(0))
+					Expect(btree.InsertRow(dm, key, NewBytes(i), NewBytes(i))).To(Succeed())
+				}
+			}
+			key, _ := schema.Encode("a", int32(0))
+			pairs, err := btree.GetAll(dm, key)
+			Expect(err).To(BeNil())
+			Expect(pairs).To(HaveLen(5))
+		})
+	})
+	Describe("4バイトの倍数でない固定長のキーを持つ木", func() {
+		It("9バイトのキーでも順に並び、重複と取得が正しく扱われる", func() {
+			os.Setenv(BytesSizeLimitKey, strconv.Itoa(200))
+			schema := KeySchema{{Type: ColumnTypeInt64}, {Type: ColumnTypeBool}}
+			Expect(schema.KeyLen()).To(Equal(uint32(9)))
+			dm, _ := NewDiskManager(newCrashableFile())
+			Expect(NewTypedTable(dm, schema, 0)).To(Succeed())
+			btree, _ := NewBPlustTree(dm)
+
+			var keys []Bytes
+			for i := int64(-20); i < 20; i++ {
+				for _, b := range []bool{false, true} {
+					key, _ := schema.Encode(i, b)
+					keys = append(keys, key)
+				}
+			}
+			shuffled := append([]Bytes{}, keys...)
+			rand.New(rand.NewSource(1)).Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+			for _, key := range shuffled {
+				Expect(btree.InsertPair(dm, key, NewBytes(1))).To(Succeed())
+			}
+			Expect(btree.InsertPair(dm, keys[7], NewBytes(1))).To(Equal(ErrDuplicateKey))
+			for _, key := range keys {
+				_, found, err := btree.Get(dm, key)
+				Expect(err).To(BeNil())
+				Expect(found).To(BeTrue())
+			}
+			cursor := btree.Scan(dm, nil, nil)
+			var got []Bytes
+			for cursor.Next() {
+				got = append(got, append(Bytes{}, cursor.Key()...))
+			}
+			Expect(got).To(Equal(keys))
+			violations, err := btree.Verify(dm)
+			Expect(err).To(BeNil())
+			Expect(violations).To(BeEmpty())
+		})
+	})
+})
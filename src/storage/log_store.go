@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type (
+	// ディレクトリの中に番号.logという名前でセグメントを置く
+	DirLogStore struct {
+		dir string
+	}
+)
+
+const (
+	logSegmentExt = ".log"
+)
+
+// ディレクトリが存在しない場合は作る
+func NewDirLogStore(dir string) (*DirLogStore, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	return &DirLogStore{dir}, nil
+}
+
+func (s *DirLogStore) Segments() ([]uint64, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	ids := []uint64{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, logSegmentExt) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, logSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// 新しく作った場合はディレクトリもfsyncして、クラッシュしてもセグメントが消えないようにする
+func (s *DirLogStore) Open(segment uint64) (LogFile, error) {
+	path := s.path(segment)
+	_, statErr := os.Stat(path)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if os.IsNotExist(statErr) {
+		if err := s.syncDir(); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (s *DirLogStore) Remove(segment uint64) error {
+	if err := os.Remove(s.path(segment)); err != nil {
+		return err
+	}
+	return s.syncDir()
+}
+
+func (s *DirLogStore) path(segment uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", segment, logSegmentExt))
+}
+
+func (s *DirLogStore) syncDir() error {
+	d, err := os.Open(s.dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
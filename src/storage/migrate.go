@@ -0,0 +1,270 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	// FormatVersionLittleEndian・FormatVersionUnslottedのページのヘッダーの長さ。スロットの数とデータの先頭を持たない
+	unslottedHeaderNByte = ChecksumOffset + 4
+	// ファイルヘッダー・PageLSN・チェックサムを持つ前のページのヘッダーの長さ
+	baselineHeaderNByte = RightPointerOffset + 4
+)
+
+var (
+	ErrNotLittleEndianFile = errors.New("not a little-endian file")
+	ErrNotUnslottedFile    = errors.New("not a format version 2 file")
+)
+
+// FormatVersionLittleEndianのファイルsrcを、現在のフォーマットでdstに書き直す
+// ページのヘッダーとスロットに加えて、キーとブランチのvalue(子のPageID)もNewBytesでエンコードした4バイトのカラムとして並べ替える
+// リーフのvalueの中身は木からは分からないので、leafValueで変換する。nilの場合はそのままコピーする
+// srcは変更しないので、途中で失敗してもdstを捨てればよい。dstは空のファイルを渡す
+// WALのログもリトルエンディアンで書かれているので、移行する前にチェックポイントを作ってログを空にしておくこと
+// ファイルヘッダーを持つ前のファイル(ページ0の先頭にキーの長さだけを書いていた頃のもの)も、リトルエンディアンのホストで書かれたものとして移行する
+func MigrateLittleEndian(src, dst DiskManager, leafValue func(Bytes) (Bytes, error)) error {
+	b, err := src.ReadPageData(InvalidPageID)
+	if err != nil {
+		return err
+	}
+	headerNByte := uint32(unslottedHeaderNByte)
+	header, err := decodeFileHeader(b)
+	if errors.Is(err, ErrInvalidMagic) {
+		if header, err = decodeBaselineHeader(src, b); err != nil {
+			return err
+		}
+		headerNByte = baselineHeaderNByte
+	} else if err != nil {
+		return err
+	} else if header.Version != FormatVersionLittleEndian || header.Endianness != EndiannessLittle {
+		return fmt.Errorf("%w: version %d", ErrNotLittleEndianFile, header.Version)
+	}
+	return migrate(src, dst, header, binary.LittleEndian, headerNByte, func(page *Page) error {
+		for i, item := range page.Items {
+			key, err := SwapColumns(item.Key)
+			if err != nil {
+				return fmt.Errorf("page %d item %d: %w", page.PageID, i, err)
+			}
+			value := item.Value
+			if page.NodeType == NodeTypeBranch {
+				value, err = SwapColumns(value)
+			} else if leafValue != nil {
+				value, err = leafValue(value)
+			}
+			if err != nil {
+				return fmt.Errorf("page %d item %d: %w", page.PageID, i, err)
+			}
+			page.Items[i] = Pair{key, value}
+		}
+		return nil
+	})
+}
+
+// FormatVersionUnslottedのファイルsrcを、現在のフォーマットでdstに書き直す
+// キーやvalueは既にビッグエンディアンなので、そのまま組み立て直す
+// MigrateLittleEndianと同じく、srcは変更せず、移行する前にチェックポイントを作ってログを空にしておくこと
+func MigrateUnslotted(src, dst DiskManager) error {
+	b, err := src.ReadPageData(InvalidPageID)
+	if err != nil {
+		return err
+	}
+	header, err := decodeFileHeader(b)
+	if err != nil {
+		return err
+	}
+	if header.Version != FormatVersionUnslotted || header.Endianness != EndiannessBig {
+		return fmt.Errorf("%w: version %d", ErrNotUnslottedFile, header.Version)
+	}
+	return migrate(src, dst, header, binary.BigEndian, unslottedHeaderNByte, nil)
+}
+
+// ファイルヘッダーを持つ前のページ0を読む。キーの長さだけが先頭にホストのバイトオーダーで書かれていて、残りは0
+// rootは常にPageID1で、ページ0しか無い場合はまだrootが無い
+func decodeBaselineHeader(dm DiskManager, b [PageSize]byte) (*FileHeader, error) {
+	keyLen := binary.LittleEndian.Uint32(b[:4])
+	if keyLen == 0 || keyLen > MaxInlinePairNByte {
+		return nil, ErrInvalidMagic
+	}
+	for _, v := range b[4:] {
+		if v != 0 {
+			return nil, ErrInvalidMagic
+		}
+	}
+	fSize, err := dm.FSize()
+	if err != nil {
+		return nil, err
+	}
+	header := NewFileHeader(keyLen, 0)
+	if fSize > PageSize {
+		header.RootPageID = RootPageID
+	}
+	return header, nil
+}
+
+// headerのファイルsrcのleafを左から順にorderで読み、convertで変換してからdstにBulkLoadで組み立て直す
+// 古いフォーマットはページのヘッダーが小さいので、ページをそのまま移すと上限を超えることがある
+// そのためページのIDは変わり、解放済みのページや併合で使われなくなったページは移さない
+func migrate(src, dst DiskManager, header *FileHeader, order binary.ByteOrder, headerNByte uint32, convert func(*Page) error) error {
+	migrated := *header
+	migrated.Version = FormatVersion
+	migrated.Endianness = EndiannessBig
+	migrated.RootPageID = InvalidPageID
+	migrated.Height = 0
+	migrated.KeyCount = 0
+	if err := dst.WritePageData(dst.AllocatePage(), migrated.Bytes()); err != nil {
+		return err
+	}
+	tree, err := NewBPlustTree(dst)
+	if err != nil {
+		return err
+	}
+	fSize, err := src.FSize()
+	if err != nil {
+		return err
+	}
+	it := &migrateIterator{
+		src:         src,
+		order:       order,
+		headerNByte: headerNByte,
+		convert:     convert,
+		pageID:      header.RootPageID,
+		pagesLeft:   fSize / PageSize,
+	}
+	if err := tree.BulkLoad(dst, it, 1); err != nil {
+		return err
+	}
+	return dst.Sync()
+}
+
+// migrateで古いフォーマットのファイルのpairをキーの昇順に返すPairIterator
+// rootから一番左のleafまで降りてから、NextPageIDを辿る
+type migrateIterator struct {
+	src         DiskManager
+	order       binary.ByteOrder
+	headerNByte uint32
+	convert     func(*Page) error
+	pageID      PageID // 次に読むページ
+	pagesLeft   int64  // リンクが循環していても止まるように、ファイルのページ数までしか読まない
+	items       []Pair
+	index       int
+	err         error
+}
+
+func (it *migrateIterator) Next() bool {
+	it.index += 1
+	for it.index >= len(it.items) {
+		if it.err != nil || it.pageID == InvalidPageID {
+			return false
+		}
+		if it.pagesLeft -= 1; it.pagesLeft < 0 {
+			it.err = &ErrPageCorrupted{it.pageID, "page links form a cycle"}
+			return false
+		}
+		page, err := it.read(it.pageID)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		if page.NodeType == NodeTypeBranch {
+			children := page.Children()
+			if len(children) == 0 {
+				it.err = &ErrPageCorrupted{page.PageID, "branch has no children"}
+				return false
+			}
+			it.pageID = children[0]
+			continue
+		}
+		it.items, it.index, it.pageID = page.Items, 0, page.NextPageID
+	}
+	return true
+}
+
+func (it *migrateIterator) Key() Bytes {
+	return it.items[it.index].Key
+}
+
+func (it *migrateIterator) Value() Bytes {
+	return it.items[it.index].Value
+}
+
+func (it *migrateIterator) Err() error {
+	return it.err
+}
+
+func (it *migrateIterator) read(pageID PageID) (*Page, error) {
+	b, err := it.src.ReadPageData(pageID)
+	if err != nil {
+		return nil, err
+	}
+	page, err := decodeUnslottedPage(b, it.order, it.headerNByte)
+	if err != nil {
+		var corrupted *ErrPageCorrupted
+		if errors.As(err, &corrupted) {
+			corrupted.PageID = pageID
+		}
+		return nil, err
+	}
+	if page.NodeType == NodeTypeFree {
+		return nil, &ErrPageCorrupted{pageID, "page is free"}
+	}
+	if it.convert != nil {
+		if err := it.convert(page); err != nil {
+			return nil, err
+		}
+	}
+	return page, nil
+}
+
+// FormatVersionLittleEndian・FormatVersionUnslottedのページをorderで読む
+// ヘッダーはheaderNByteまでで、スロットはヘッダーの直後からデータの領域とぶつかるか、オフセットが0のスロットまで続く
+// headerNByteがbaselineHeaderNByteのページはチェックサムを持たないので確かめない
+// 解放済みのページはitemを読まずにNodeTypeFreeのまま返す
+func decodeUnslottedPage(b [PageSize]byte, order binary.ByteOrder, headerNByte uint32) (*Page, error) {
+	p := &Page{}
+	p.PageID = PageID(order.Uint32(b[:4]))
+	if headerNByte > ChecksumOffset && order.Uint32(b[ChecksumOffset:ChecksumOffset+4]) != pageChecksum(&b) {
+		return nil, &ErrPageCorrupted{p.PageID, "checksum mismatch"}
+	}
+	p.NodeType = NodeType(order.Uint32(b[NodeTypeOffset : NodeTypeOffset+4]))
+	if p.NodeType == NodeTypeFree {
+		return p, nil
+	}
+	if p.NodeType != NodeTypeBranch && p.NodeType != NodeTypeLeaf {
+		return nil, &ErrPageCorrupted{p.PageID, fmt.Sprintf("unknown node type %d", p.NodeType)}
+	}
+	p.ParentID = PageID(order.Uint32(b[ParentIDOffset : ParentIDOffset+4]))
+	p.PrevPageID = PageID(order.Uint32(b[PrevPageIDOffset : PrevPageIDOffset+4]))
+	p.NextPageID = PageID(order.Uint32(b[NextPageIDOffset : NextPageIDOffset+4]))
+	p.RightPointer = PageID(order.Uint32(b[RightPointerOffset : RightPointerOffset+4]))
+
+	start := headerNByte
+	for start+SlotNByte <= PageSize {
+		offset := order.Uint32(b[start : start+4])
+		keyLen := order.Uint32(b[start+4 : start+8])
+		valueLen := order.Uint32(b[start+8 : start+12])
+		start += SlotNByte
+		if start >= offset {
+			break
+		}
+		if uint64(offset)+uint64(keyLen)+uint64(valueLen) > PageSize {
+			return nil, &ErrPageCorrupted{p.PageID, fmt.Sprintf("item %d is out of page", len(p.Items))}
+		}
+		p.Items = append(p.Items, Pair{Bytes(b[offset : offset+keyLen]), Bytes(b[offset+keyLen : offset+keyLen+valueLen])})
+	}
+	return p, nil
+}
+
+// 4バイトのカラムごとにリトルエンディアンからビッグエンディアンに並べ替える
+// リーフのvalueもNewBytesで作っている場合は、MigrateLittleEndianのleafValueとして渡す
+func SwapColumns(b Bytes) (Bytes, error) {
+	if b.Len()%ColumnSize != 0 {
+		return nil, fmt.Errorf("length %d is not a multiple of column size", b.Len())
+	}
+	swapped := make(Bytes, len(b))
+	for i := 0; i < len(b); i += int(ColumnSize) {
+		binary.BigEndian.PutUint32(swapped[i:i+4], binary.LittleEndian.Uint32(b[i:i+4]))
+	}
+	return swapped, nil
+}
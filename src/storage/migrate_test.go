@@ -0,0 +1,231 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"strconv"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("MigrateLittleEndianのテスト", func() {
+	var (
+		src, dst DiskManager
+		err      error
+	)
+	// 0~29を挿入した木を、リトルエンディアンで書いていた頃のフォーマットに書き直す
+	BeforeEach(func() {
+		os.Setenv(BytesSizeLimitKey, strconv.Itoa(84))
+		src, _ = NewDiskManager(newCrashableFile())
+		NewTable2(src, ColumnSize)
+		btree, _ := NewBPlustTree(src)
+		var i uint32
+		for i = 0; i < 30; i++ {
+			Expect(btree.InsertPair(src, NewBytes(i), NewBytes(i*10))).To(Succeed())
+		}
+		fSize, _ := src.FSize()
+		for pageID := PageID(1); int64(pageID)*PageSize < fSize; pageID++ {
+			page, _ := fetchPage(src, pageID)
+			for i, item := range page.Items {
+				key, _ := SwapColumns(item.Key)
+				value, _ := SwapColumns(item.Value)
+				page.Items[i] = Pair{key, value}
+			}
+			src.WritePageData(pageID, littleEndianPage(page))
+		}
+		header, _ := ReadFileHeader(src)
+		src.WritePageData(InvalidPageID, littleEndianHeader(header))
+		dst, _ = NewDiskManager(newCrashableFile())
+	})
+	It("移行前のファイルはNewBPlustTreeで開けない", func() {
+		_, err = NewBPlustTree(src)
+		Expect(errors.Is(err, ErrUnsupportedFormatVersion)).To(BeTrue())
+	})
+	Context("leafValueにSwapColumnsを渡した場合", func() {
+		It("キーとvalueがそのまま読める", func() {
+			Expect(MigrateLittleEndian(src, dst, SwapColumns)).To(Succeed())
+			btree, err := NewBPlustTree(dst)
+			Expect(err).To(BeNil())
+			res := sliceOf(btree, dst)
+			Expect(leafKeys(res)).To(HaveLen(30))
+			assertLinks(res)
+			Expect(btree.KeyCount).To(Equal(uint64(30)))
+			Expect(btree.Height).To(Equal(uint32(4)))
+			var i uint32
+			for i = 0; i < 30; i++ {
+				value, found, _ := btree.Get(dst, NewBytes(i))
+				Expect(found).To(BeTrue())
+				Expect(value).To(Equal(NewBytes(i * 10)))
+			}
+		})
+	})
+	Context("移行済みのファイルを渡した場合", func() {
+		It("ErrNotLittleEndianFileが返る", func() {
+			Expect(MigrateLittleEndian(src, dst, SwapColumns)).To(Succeed())
+			err = MigrateLittleEndian(dst, src, SwapColumns)
+			Expect(errors.Is(err, ErrNotLittleEndianFile)).To(BeTrue())
+		})
+	})
+})
+
+var _ = Describe("ファイルヘッダーを持つ前のファイルのMigrateLittleEndianのテスト", func() {
+	var src, dst DiskManager
+	// testdata/baseline_tableはファイルヘッダーを持つ前のコードで、LimitBytesSizeを84にして0~29をNewBytes(i*10)のvalueで挿入したもの
+	BeforeEach(func() {
+		os.Setenv(BytesSizeLimitKey, strconv.Itoa(84))
+		data, err := os.ReadFile("testdata/baseline_table")
+		Expect(err).To(BeNil())
+		f := newCrashableFile()
+		f.data = data
+		src, _ = NewDiskManager(f)
+		dst, _ = NewDiskManager(newCrashableFile())
+	})
+	It("移行前のファイルはNewBPlustTreeで開けない", func() {
+		_, err := NewBPlustTree(src)
+		Expect(errors.Is(err, ErrInvalidMagic)).To(BeTrue())
+	})
+	It("ページ0のキーの長さとPageID1のrootから移行できる", func() {
+		Expect(MigrateLittleEndian(src, dst, SwapColumns)).To(Succeed())
+		btree, err := NewBPlustTree(dst)
+		Expect(err).To(BeNil())
+		Expect(btree.KeyLen).To(Equal(ColumnSize))
+		Expect(btree.KeyCount).To(Equal(uint64(30)))
+		res := sliceOf(btree, dst)
+		Expect(leafKeys(res)).To(HaveLen(30))
+		assertLinks(res)
+		var i uint32
+		for i = 0; i < 30; i++ {
+			value, found, _ := btree.Get(dst, NewBytes(i))
+			Expect(found).To(BeTrue())
+			Expect(value).To(Equal(NewBytes(i * 10)))
+		}
+		// 移行した後は挿入できる
+		Expect(btree.InsertPair(dst, NewBytes(30), NewBytes(300))).To(Succeed())
+		violations, err := btree.Verify(dst)
+		Expect(err).To(BeNil())
+		Expect(violations).To(BeEmpty())
+	})
+	It("ksqlのファイルでない場合はErrInvalidMagicが返る", func() {
+		var b [PageSize]byte
+		b[100] = 1
+		src.WritePageData(InvalidPageID, b)
+		err := MigrateLittleEndian(src, dst, SwapColumns)
+		Expect(errors.Is(err, ErrInvalidMagic)).To(BeTrue())
+	})
+})
+
+var _ = Describe("MigrateUnslottedのテスト", func() {
+	var (
+		src, dst DiskManager
+		err      error
+	)
+	// 0~59を挿入してから0~39を削除した木を、スロットの数をページのヘッダーに持たない頃のフォーマットに書き直す
+	BeforeEach(func() {
+		os.Setenv(BytesSizeLimitKey, strconv.Itoa(84))
+		src, _ = NewDiskManager(newCrashableFile())
+		NewTable2(src, ColumnSize)
+		btree, _ := NewBPlustTree(src)
+		var i uint32
+		for i = 0; i < 60; i++ {
+			Expect(btree.InsertPair(src, NewBytes(i), NewBytes(i*10))).To(Succeed())
+		}
+		for i = 0; i < 40; i++ {
+			Expect(btree.Delete(src, NewBytes(i))).To(Succeed())
+		}
+		Expect(src.(*DiskManagerImpl).FreeSpace().FreePages).NotTo(BeZero())
+		fSize, _ := src.FSize()
+		for pageID := PageID(1); int64(pageID)*PageSize < fSize; pageID++ {
+			b, _ := src.ReadPageData(pageID)
+			if isFreePageData(&b) {
+				src.WritePageData(pageID, unslottedPage(&Page{PageID: pageID, NodeType: NodeTypeFree}, binary.BigEndian))
+				continue
+			}
+			page, _ := fetchPage(src, pageID)
+			src.WritePageData(pageID, unslottedPage(page, binary.BigEndian))
+		}
+		header, _ := ReadFileHeader(src)
+		b := header.Bytes()
+		binary.BigEndian.PutUint32(b[VersionOffset:VersionOffset+4], FormatVersionUnslotted)
+		SetPageChecksum(&b)
+		src.WritePageData(InvalidPageID, b)
+		dst, _ = NewDiskManager(newCrashableFile())
+	})
+	It("移行前のファイルはNewBPlustTreeで開けない", func() {
+		_, err = NewBPlustTree(src)
+		Expect(errors.Is(err, ErrUnsupportedFormatVersion)).To(BeTrue())
+	})
+	It("移行するとキーとvalueがそのまま読め、解放済みのページは移さない", func() {
+		Expect(MigrateUnslotted(src, dst)).To(Succeed())
+		btree, err := NewBPlustTree(dst)
+		Expect(err).To(BeNil())
+		res := sliceOf(btree, dst)
+		Expect(leafKeys(res)).To(HaveLen(20))
+		assertLinks(res)
+		Expect(btree.KeyCount).To(Equal(uint64(20)))
+		var i uint32
+		for i = 0; i < 60; i++ {
+			value, found, _ := btree.Get(dst, NewBytes(i))
+			Expect(found).To(Equal(i >= 40))
+			if found {
+				Expect(value).To(Equal(NewBytes(i * 10)))
+			}
+		}
+		violations, err := btree.Verify(dst)
+		Expect(err).To(BeNil())
+		Expect(violations).To(BeEmpty())
+		Expect(dst.(*DiskManagerImpl).FreeSpace().FreePages).To(BeZero())
+	})
+	It("リトルエンディアンのファイルはErrNotUnslottedFileが返る", func() {
+		b, _ := src.ReadPageData(InvalidPageID)
+		header, _ := decodeFileHeader(b)
+		src.WritePageData(InvalidPageID, littleEndianHeader(header))
+		err = MigrateUnslotted(src, dst)
+		Expect(errors.Is(err, ErrNotUnslottedFile)).To(BeTrue())
+	})
+})
+
+// FormatVersionLittleEndianのページを書く
+func littleEndianPage(p *Page) [PageSize]byte {
+	return unslottedPage(p, binary.LittleEndian)
+}
+
+// FormatVersionLittleEndian・FormatVersionUnslottedのページをorderで書く
+func unslottedPage(p *Page, order binary.ByteOrder) [PageSize]byte {
+	var b [PageSize]byte
+	order.PutUint32(b[:4], uint32(p.PageID))
+	order.PutUint32(b[NodeTypeOffset:NodeTypeOffset+4], uint32(p.NodeType))
+	order.PutUint32(b[ParentIDOffset:ParentIDOffset+4], uint32(p.ParentID))
+	order.PutUint32(b[PrevPageIDOffset:PrevPageIDOffset+4], uint32(p.PrevPageID))
+	order.PutUint32(b[NextPageIDOffset:NextPageIDOffset+4], uint32(p.NextPageID))
+	order.PutUint32(b[RightPointerOffset:RightPointerOffset+4], uint32(p.RightPointer))
+	var start uint32 = unslottedHeaderNByte
+	var tail uint32 = PageSize
+	for _, item := range p.Items {
+		tail -= item.Key.Len() + item.Value.Len()
+		order.PutUint32(b[start:start+4], tail)
+		order.PutUint32(b[start+4:start+8], item.Key.Len())
+		order.PutUint32(b[start+8:start+12], item.Value.Len())
+		start += SlotNByte
+		copy(b[tail:], item.Key)
+		copy(b[tail+item.Key.Len():], item.Value)
+	}
+	order.PutUint32(b[ChecksumOffset:ChecksumOffset+4], pageChecksum(&b))
+	return b
+}
+
+// FormatVersionLittleEndianのヘッダーを書く
+func littleEndianHeader(h *FileHeader) [PageSize]byte {
+	b := h.Bytes()
+	order := binary.LittleEndian
+	order.PutUint32(b[VersionOffset:VersionOffset+4], FormatVersionLittleEndian)
+	order.PutUint32(b[PageSizeOffset:PageSizeOffset+4], h.PageSize)
+	b[EndiannessOffset] = byte(EndiannessLittle)
+	order.PutUint32(b[HeaderRootPageOffset:HeaderRootPageOffset+4], uint32(h.RootPageID))
+	order.PutUint32(b[KeyLenOffset:KeyLenOffset+4], h.KeyLen)
+	order.PutUint32(b[RowIDLenOffset:RowIDLenOffset+4], h.RowIDLen)
+	order.PutUint64(b[CreatedAtOffset:CreatedAtOffset+8], uint64(h.CreatedAt.UnixNano()))
+	order.PutUint32(b[ChecksumOffset:ChecksumOffset+4], pageChecksum(&b))
+	return b
+}
@@ -8,14 +8,28 @@ func (dm MockDiskManagerImpl) AllocatePage() PageID {
 	return PageID(3)
 }
 
-func (dm MockDiskManagerImpl) ReadPageData(pageID PageID) [PageSize]byte {
+func (dm MockDiskManagerImpl) DeallocatePage(pageID PageID) error {
+	return nil
+}
+
+func (dm MockDiskManagerImpl) ReadPageData(pageID PageID) ([PageSize]byte, error) {
 	var bs [PageSize]byte
 	bs[0] = 1
-	return bs
+	return bs, nil
+}
+
+func (dm MockDiskManagerImpl) WritePageData(pageID PageID, data [PageSize]byte) error {
+	return nil
 }
 
-func (dm MockDiskManagerImpl) WritePageData(pageID PageID, data [PageSize]byte) {}
+func (dm MockDiskManagerImpl) FSize() (int64, error) {
+	return 0, nil
+}
+
+func (dm MockDiskManagerImpl) Sync() error {
+	return nil
+}
 
-func (dm MockDiskManagerImpl) FSize() int64 {
-	return 0
+func (dm MockDiskManagerImpl) Close() error {
+	return nil
 }
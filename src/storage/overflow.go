@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	// キー・valueとスロットを合わせてこれを超えるpairは、valueをオーバーフローページに書く
+	// 数で分けた位置では片方のページに大きいpairが集まって上限を超えることがあるので、分割はsplitIndexでバイト数も確かめる
+	MaxInlinePairNByte = (PageSize - HeaderNByte) / 4
+
+	// オーバーフローページのヘッダーのうち、このページに書いたvalueのバイト数
+	OverflowLenOffset = SlotCountOffset
+	// オーバーフローページ1つに書けるvalueのバイト数
+	OverflowDataNByte = PageSize - HeaderNByte
+
+	// leafにvalueの代わりに書く参照。マジックナンバー(8) + 先頭のオーバーフローページ(4) + valueの長さ(4)
+	OverflowRefNByte = MagicNByte + 4 + 4
+)
+
+var (
+	overflowMagic = [MagicNByte]byte{'k', 's', 'q', 'l', 'o', 'v', 'f', 0}
+
+	ErrKeyTooLarge = errors.New("key too large")
+)
+
+// leafに書くvalueを返す。大きいvalueはオーバーフローページに書き、参照を返す
+// 参照と同じ形のvalueもそのままでは区別できないので、オーバーフローページに書く
+func writeValue(dm DiskManager, key, value Bytes) (Bytes, error) {
+	if SlotNByte+key.Len()+OverflowRefNByte > MaxInlinePairNByte {
+		return nil, fmt.Errorf("%w: %d bytes", ErrKeyTooLarge, key.Len())
+	}
+	if SlotNByte+key.Len()+value.Len() <= maxInlinePairNByte() && !isOverflowRef(value) {
+		return value, nil
+	}
+	return writeOverflow(dm, value)
+}
+
+// leafにそのまま書けるpairのバイト数。LimitBytesSizeを小さくしている場合は、上限に合わせて小さくする
+// pairが上限の半分以下であれば、収まっていたページに1つ加えてもバイト数で分けると左右どちらも上限に収まる
+func maxInlinePairNByte() uint32 {
+	return min(MaxInlinePairNByte, (LimitBytesSize()-HeaderNByte)/2)
+}
+
+// leafから読んだvalueが参照の場合は、オーバーフローページから読んで元のvalueに戻す
+func readValue(dm DiskManager, value Bytes) (Bytes, error) {
+	if !isOverflowRef(value) {
+		return value, nil
+	}
+	return readOverflow(dm, value)
+}
+
+// leafから取り除いたvalueが参照の場合は、オーバーフローページを解放する
+func freeValue(dm DiskManager, value Bytes) error {
+	if !isOverflowRef(value) {
+		return nil
+	}
+	pageID, _ := decodeOverflowRef(value)
+	for pageID != InvalidPageID {
+		b, err := readOverflowPage(dm, pageID)
+		if err != nil {
+			return err
+		}
+		if err := dm.DeallocatePage(pageID); err != nil {
+			return err
+		}
+		pageID = PageID(binary.BigEndian.Uint32(b[NextPageIDOffset : NextPageIDOffset+4]))
+	}
+	return nil
+}
+
+// valueをOverflowDataNByteずつ、NextPageIDで繋いだページに書いて参照を返す
+func writeOverflow(dm DiskManager, value Bytes) (Bytes, error) {
+	n := (len(value) + OverflowDataNByte - 1) / OverflowDataNByte
+	if n == 0 {
+		n = 1
+	}
+	pageIDs := make([]PageID, n)
+	for i := range pageIDs {
+		pageIDs[i] = dm.AllocatePage()
+	}
+	for i, pageID := range pageIDs {
+		chunk := value[min(i*OverflowDataNByte, len(value)):min((i+1)*OverflowDataNByte, len(value))]
+		var b [PageSize]byte
+		binary.BigEndian.PutUint32(b[:4], uint32(pageID))
+		binary.BigEndian.PutUint32(b[NodeTypeOffset:NodeTypeOffset+4], uint32(NodeTypeOverflow))
+		next := InvalidPageID
+		if i+1 < n {
+			next = pageIDs[i+1]
+		}
+		binary.BigEndian.PutUint32(b[NextPageIDOffset:NextPageIDOffset+4], uint32(next))
+		binary.BigEndian.PutUint32(b[OverflowLenOffset:OverflowLenOffset+4], uint32(len(chunk)))
+		copy(b[HeaderNByte:], chunk)
+		SetPageChecksum(&b)
+		if err := dm.WritePageData(pageID, b); err != nil {
+			return nil, err
+		}
+	}
+	ref := make(Bytes, OverflowRefNByte)
+	copy(ref, overflowMagic[:])
+	binary.BigEndian.PutUint32(ref[MagicNByte:MagicNByte+4], uint32(pageIDs[0]))
+	binary.BigEndian.PutUint32(ref[MagicNByte+4:], value.Len())
+	return ref, nil
+}
+
+func readOverflow(dm DiskManager, ref Bytes) (Bytes, error) {
+	pageID, valueLen := decodeOverflowRef(ref)
+	value := make(Bytes, 0, valueLen)
+	for pageID != InvalidPageID {
+		b, err := readOverflowPage(dm, pageID)
+		if err != nil {
+			return nil, err
+		}
+		chunkLen := binary.BigEndian.Uint32(b[OverflowLenOffset : OverflowLenOffset+4])
+		if chunkLen > OverflowDataNByte || value.Len()+chunkLen > valueLen {
+			return nil, &ErrPageCorrupted{pageID, fmt.Sprintf("overflow chunk of %d bytes is too long", chunkLen)}
+		}
+		value = append(value, b[HeaderNByte:HeaderNByte+chunkLen]...)
+		pageID = PageID(binary.BigEndian.Uint32(b[NextPageIDOffset : NextPageIDOffset+4]))
+	}
+	if value.Len() != valueLen {
+		return nil, fmt.Errorf("overflow value has %d bytes, expected %d", value.Len(), valueLen)
+	}
+	return value, nil
+}
+
+func readOverflowPage(dm DiskManager, pageID PageID) ([PageSize]byte, error) {
+	b, err := dm.ReadPageData(pageID)
+	if err != nil {
+		return b, err
+	}
+	if binary.BigEndian.Uint32(b[ChecksumOffset:ChecksumOffset+4]) != pageChecksum(&b) {
+		return b, &ErrPageCorrupted{pageID, "checksum mismatch"}
+	}
+	if nodeType := NodeType(binary.BigEndian.Uint32(b[NodeTypeOffset : NodeTypeOffset+4])); nodeType != NodeTypeOverflow {
+		return b, &ErrPageCorrupted{pageID, fmt.Sprintf("node type %d is not overflow", nodeType)}
+	}
+	return b, nil
+}
+
+func isOverflowRef(value Bytes) bool {
+	return value.Len() == OverflowRefNByte && bytes.Equal(value[:MagicNByte], overflowMagic[:])
+}
+
+func decodeOverflowRef(ref Bytes) (PageID, uint32) {
+	return PageID(binary.BigEndian.Uint32(ref[MagicNByte : MagicNByte+4])), binary.BigEndian.Uint32(ref[MagicNByte+4:])
+}
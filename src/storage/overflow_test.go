@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("オーバーフローページのテスト", func() {
+	var (
+		dm    DiskManager
+		btree *BPlustTree
+	)
+	// nバイトのJSONドキュメント
+	document := func(id uint32, n int) Bytes {
+		prefix := fmt.Sprintf(`{"id":%d,"body":"`, id)
+		return Bytes(prefix + strings.Repeat("x", n-len(prefix)-2) + `"}`)
+	}
+	freePages := func() uint32 {
+		return dm.(*DiskManagerImpl).FreeSpace().FreePages
+	}
+	BeforeEach(func() {
+		os.Setenv(BytesSizeLimitKey, strconv.Itoa(PageSize))
+		dm, _ = NewDiskManager(newCrashableFile())
+		NewTable2(dm, ColumnSize)
+		btree, _ = NewBPlustTree(dm)
+	})
+	It("ページより大きいvalueを挿入して読める", func() {
+		var i uint32
+		for i = 0; i < 20; i++ {
+			Expect(btree.InsertPair(dm, NewBytes(i), document(i, 3000+int(i)*500))).To(Succeed())
+		}
+		for i = 0; i < 20; i++ {
+			value, found, err := btree.Get(dm, NewBytes(i))
+			Expect(err).To(BeNil())
+			Expect(found).To(BeTrue())
+			Expect(value).To(Equal(document(i, 3000+int(i)*500)))
+		}
+		cursor := btree.Scan(dm, nil, nil)
+		i = 0
+		for cursor.Next() {
+			Expect(cursor.Value()).To(Equal(document(i, 3000+int(i)*500)))
+			i++
+		}
+		Expect(cursor.Err()).To(BeNil())
+		Expect(i).To(Equal(uint32(20)))
+		// leafには参照だけが書かれる
+		for _, p := range sliceOf(btree, dm) {
+			for _, item := range p.Items {
+				Expect(item.Value.Len()).To(BeNumerically("<=", MaxInlinePairNByte))
+			}
+		}
+	})
+	It("小さいvalueはleafに書く", func() {
+		Expect(btree.InsertPair(dm, NewBytes(1), document(1, 100))).To(Succeed())
+		Expect(sliceOf(btree, dm)[0].Items[0].Value).To(Equal(document(1, 100)))
+	})
+	It("削除するとオーバーフローページが解放され、次の挿入で使われる", func() {
+		Expect(btree.InsertPair(dm, NewBytes(1), document(1, 10000))).To(Succeed())
+		Expect(btree.InsertPair(dm, NewBytes(2), document(2, 40))).To(Succeed())
+		Expect(freePages()).To(Equal(uint32(0)))
+		Expect(btree.Delete(dm, NewBytes(1))).To(Succeed())
+		Expect(freePages()).To(Equal(uint32(3)))
+
+		fSize, _ := dm.FSize()
+		Expect(btree.InsertPair(dm, NewBytes(3), document(3, 10000))).To(Succeed())
+		Expect(freePages()).To(Equal(uint32(0)))
+		after, _ := dm.FSize()
+		Expect(after).To(Equal(fSize))
+	})
+	// 新しいvalueを書いてから元のページを解放するので、元のページは使われない
+	It("置き換えると元のオーバーフローページが解放される", func() {
+		Expect(btree.InsertPair(dm, NewBytes(1), document(1, 10000))).To(Succeed())
+		Expect(btree.Update(dm, NewBytes(1), document(1, 5000))).To(Succeed())
+		Expect(freePages()).To(Equal(uint32(3)))
+		Expect(btree.Put(dm, NewBytes(1), document(1, 40))).To(Succeed())
+		Expect(freePages()).To(Equal(uint32(5)))
+		value, _, _ := btree.Get(dm, NewBytes(1))
+		Expect(value).To(Equal(document(1, 40)))
+	})
+	// 数で半分に分けると、大きいpairが集まった右のページが上限を超えていた
+	It("小さいvalueの後に大きいvalueを挿入しても、分割後のページが上限に収まる", func() {
+		var i uint32
+		for i = 0; i < 20; i++ {
+			Expect(btree.InsertPair(dm, NewBytes(i), make(Bytes, 10))).To(Succeed())
+		}
+		for i = 20; i < 24; i++ {
+			Expect(btree.InsertPair(dm, NewBytes(i), make(Bytes, 990))).To(Succeed())
+		}
+		violations, err := btree.Verify(dm)
+		Expect(err).To(BeNil())
+		Expect(violations).To(BeEmpty())
+		for i = 0; i < 24; i++ {
+			_, found, _ := btree.Get(dm, NewBytes(i))
+			Expect(found).To(BeTrue())
+		}
+	})
+	It("LimitBytesSizeが小さい場合は、上限の半分を超えるpairをオーバーフローページに書く", func() {
+		os.Setenv(BytesSizeLimitKey, strconv.Itoa(200))
+		r := rand.New(rand.NewSource(1))
+		for _, k := range r.Perm(200) {
+			Expect(btree.InsertPair(dm, NewBytes(uint32(k)), make(Bytes, r.Intn(300)))).To(Succeed())
+		}
+		violations, err := btree.Verify(dm)
+		Expect(err).To(BeNil())
+		Expect(violations).To(BeEmpty())
+	})
+	It("参照と同じ形のvalueもそのまま読める", func() {
+		ref, _ := writeOverflow(dm, document(1, 10000))
+		Expect(btree.InsertPair(dm, NewBytes(1), ref)).To(Succeed())
+		value, _, _ := btree.Get(dm, NewBytes(1))
+		Expect(value).To(Equal(ref))
+	})
+	It("オーバーフローページが壊れている場合はErrPageCorruptedが返る", func() {
+		Expect(btree.InsertPair(dm, NewBytes(1), document(1, 10000))).To(Succeed())
+		ref := sliceOf(btree, dm)[0].Items[0].Value
+		pageID, _ := decodeOverflowRef(ref)
+		b, _ := dm.ReadPageData(pageID)
+		b[HeaderNByte] ^= 1
+		dm.WritePageData(pageID, b)
+		_, _, err := btree.Get(dm, NewBytes(1))
+		var corrupted *ErrPageCorrupted
+		Expect(errors.As(err, &corrupted)).To(BeTrue())
+		Expect(corrupted.PageID).To(Equal(pageID))
+	})
+	It("大きすぎるキーはErrKeyTooLargeが返る", func() {
+		dm, _ = NewDiskManager(newCrashableFile())
+		NewTypedTable(dm, KeySchema{{Type: ColumnTypeBytes}}, 0)
+		btree, _ = NewBPlustTree(dm)
+		key, _ := btree.KeySchema.Encode(make([]byte, PageSize))
+		err := btree.InsertPair(dm, key, NewBytes(1))
+		Expect(errors.Is(err, ErrKeyTooLarge)).To(BeTrue())
+	})
+})
@@ -2,8 +2,11 @@ package storage
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"os"
+	"sort"
 	"strconv"
 )
 
@@ -40,6 +43,8 @@ const (
 const (
 	NodeTypeBranch NodeType = iota
 	NodeTypeLeaf
+	NodeTypeFree     // DeallocatePageで解放されたページ。木からは参照されない
+	NodeTypeOverflow // leafに収まらないvalueを分割して書くページ。NextPageIDで続きのページを指す
 )
 
 const (
@@ -58,8 +63,12 @@ const (
 	PrevPageIDOffset   = 12
 	NextPageIDOffset   = 16
 	RightPointerOffset = 20
+	PageLSNOffset      = 24 // 最後にこのページを変更したログレコードのLSN。WALを使わない場合は0のまま
+	ChecksumOffset     = 32 // チェックサム自身を除いたページ全体のCRC32C
+	SlotCountOffset    = 36 // スロットの数
+	DataStartOffset    = 40 // キーとバリューを書いている領域の先頭。ここからPageSizeまでに書く
 
-	HeaderNByte = RightPointerOffset + 4
+	HeaderNByte = DataStartOffset + 4
 
 	// キーのオフセット、長さとバリューの長さをそれぞれ何バイトで保存しているか
 	KeyOffsetNByte = 4
@@ -75,6 +84,22 @@ const (
 	BytesSizeLimitKey = "BYTES_SIZE_LIMIT"
 )
 
+var (
+	ErrKeyNotFound  = errors.New("key not found")
+	ErrDuplicateKey = errors.New("duplicate key")
+	ErrPageTooLarge = errors.New("page too large")
+)
+
+// ディスクから読んだページが壊れている
+type ErrPageCorrupted struct {
+	PageID PageID
+	Reason string
+}
+
+func (e *ErrPageCorrupted) Error() string {
+	return fmt.Sprintf("page %d is corrupted: %s", e.PageID, e.Reason)
+}
+
 func LimitBytesSize() uint32 {
 	if size, ok := os.LookupEnv(BytesSizeLimitKey); ok {
 		if sizei, err := strconv.Atoi(size); err == nil {
@@ -84,39 +109,27 @@ func LimitBytesSize() uint32 {
 	return PageSize
 }
 
-func NewPage(b [PageSize]byte) (*Page, error) {
-	p := &Page{}
-	p.PageID = PageID(binary.NativeEndian.Uint32(b[:4]))
-	p.NodeType = NodeType(binary.NativeEndian.Uint32(b[NodeTypeOffset : NodeTypeOffset+4]))
-	p.ParentID = PageID(binary.NativeEndian.Uint32(b[ParentIDOffset : ParentIDOffset+4]))
-	p.PrevPageID = PageID(binary.NativeEndian.Uint32(b[PrevPageIDOffset : PrevPageIDOffset+4]))
-	p.NextPageID = PageID(binary.NativeEndian.Uint32(b[NextPageIDOffset : NextPageIDOffset+4]))
-	p.RightPointer = PageID(binary.NativeEndian.Uint32(b[RightPointerOffset : RightPointerOffset+4]))
-
-	var (
-		start uint32 = HeaderNByte
-	)
-	for {
-		// キーが始まるバイト数
-		offset := binary.NativeEndian.Uint32(b[start : start+4])
-		start += 4
-
-		// キーの長さ
-		keyLen := binary.NativeEndian.Uint32(b[start : start+4])
-		start += 4
-		// バリューの長さ
-		valueLen := binary.NativeEndian.Uint32(b[start : start+4])
-		start += 4
-
-		if start >= offset {
-			break
-		}
+// ヘッダーを除いた領域の半分を下回ったらページの使用量が少なすぎると判断する
+func MinBytesSize() uint32 {
+	return HeaderNByte + (LimitBytesSize()-HeaderNByte)/2
+}
 
-		// キーの値
-		key := b[offset : offset+keyLen]
-		// バリューの値
-		value := b[offset+keyLen : offset+keyLen+valueLen]
-		p.Items = append(p.Items, Pair{key, value})
+// チェックサムが合わない場合や、オフセットがページの外を指している場合はErrPageCorruptedを返す
+func NewPage(b [PageSize]byte) (*Page, error) {
+	s := NewSlottedPage(&b)
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	p := &Page{
+		PageID:       s.PageID(),
+		NodeType:     s.NodeType(),
+		ParentID:     s.ParentID(),
+		PrevPageID:   PageID(binary.BigEndian.Uint32(b[PrevPageIDOffset : PrevPageIDOffset+4])),
+		NextPageID:   PageID(binary.BigEndian.Uint32(b[NextPageIDOffset : NextPageIDOffset+4])),
+		RightPointer: s.RightPointer(),
+	}
+	for i := 0; i < s.NumSlots(); i++ {
+		p.Items = append(p.Items, Pair{s.Key(i), s.Value(i)})
 	}
 	return p, nil
 }
@@ -148,47 +161,52 @@ func (p *Page) searchByV3(dm DiskManager, minTargetVal, maxTargetVal Bytes, res
 			return *res, nil
 		}
 		// Page内の全てのKeyがmaxTargetValより小さいなら次のページも見る
-		bytes := dm.ReadPageData(p.NextPageID)
-		nextPage, err := NewPage(bytes)
+		nextPage, err := fetchPage(dm, p.NextPageID)
 		if err != nil {
 			return nil, err
 		}
 		return nextPage.searchByV3(dm, minTargetVal, maxTargetVal, res, len)
 	}
 	// internal nodeの場合、対象のchildIDを探す
-	nextPageID := InvalidPageID
-	for _, pair := range p.Items {
-		if pair.Key.Compare(minTargetVal, len) != ComparisonResultSmall {
-			nextPageID = PageID(pair.Value.Uint32(0))
-			break
-		}
-	}
-	if nextPageID == InvalidPageID {
-		nextPageID = PageID(p.RightPointer)
-	}
-	bytes := dm.ReadPageData(nextPageID)
-	nextPage, err := NewPage(bytes)
+	nextPage, err := fetchPage(dm, p.child(minTargetVal, len))
 	if err != nil {
 		return nil, err
 	}
 	return nextPage.searchByV3(dm, minTargetVal, maxTargetVal, res, len)
 }
 
+// keyが含まれうるleafまで降りてそのページを返す
+// SearchByV3と違い範囲内のページを集めずに1ページだけ返す
+func (p *Page) FindLeaf(dm DiskManager, key Bytes, len uint32) (*Page, error) {
+	page := p
+	for page.NodeType == NodeTypeBranch {
+		nextPageID := page.child(key, len)
+		if nextPageID == InvalidPageID {
+			return nil, fmt.Errorf("page %d has no child for the key", page.PageID)
+		}
+		nextPage, err := fetchPage(dm, nextPageID)
+		if err != nil {
+			return nil, err
+		}
+		page = nextPage
+	}
+	return page, nil
+}
+
 // 対象のページに新しくkey-valueを追加する
 // 前提として正しいページに挿入されるものとする
 func (p *Page) InsertPair(dm DiskManager, key, value Bytes) error {
-	var hasInserted bool
-	for i, item := range p.Items {
-		if item.Key.Compare(key, item.Key.Len()) == ComparisonResultBig {
-			p.Items = append(p.Items[:i+1], p.Items[i:]...)
-			p.Items[i] = Pair{key, value}
-			hasInserted = true
-			break
-		}
-	}
-	if !hasInserted {
-		p.Items = append(p.Items, Pair{key, value})
-	}
+	return p.InsertPairWith(dm, key, value, SplitConfig{SplitPolicyMidpoint, 1})
+}
+
+// InsertPairと同じく追加し、上限を超えた場合はsplitの方法で分割する。親に分割が伝わる場合も同じ方法を使う
+func (p *Page) InsertPairWith(dm DiskManager, key, value Bytes, split SplitConfig) error {
+	i := sort.Search(len(p.Items), func(i int) bool {
+		return p.Items[i].Key.Compare(key, VariableKeyLen) == ComparisonResultBig
+	})
+	p.Items = append(p.Items, Pair{})
+	copy(p.Items[i+1:], p.Items[i:])
+	p.Items[i] = Pair{key, value}
 	if p.NBytes() > LimitBytesSize() {
 		// 新しいページを割り当てる
 		newPageID := dm.AllocatePage()
@@ -205,20 +223,23 @@ func (p *Page) InsertPair(dm DiskManager, key, value Bytes) error {
 		}
 		// 元のページのprevを修正
 		p.PrevPageID = newPageID
-		itemLen := len(p.Items)
-		l.Items = p.Items[:itemLen/2+1]
-		p.Items = p.Items[itemLen/2+1:]
+		mid := split.splitIndex(p, i)
+		l.Items = p.Items[:mid]
+		p.Items = p.Items[mid:]
 		// left-siblingがいた場合nextPageIDを更新する
 		if l.PrevPageID != InvalidPageID {
-			bytes := dm.ReadPageData(l.PrevPageID)
-			prevPage, err := NewPage(bytes)
+			prevPage, err := fetchPage(dm, l.PrevPageID)
 			if err != nil {
 				return err
 			}
 			prevPage.NextPageID = l.PageID
-			prevPage.Flush(dm)
+			if err := prevPage.Flush(dm); err != nil {
+				return err
+			}
+		}
+		if err := l.LinkToChild(dm); err != nil {
+			return err
 		}
-		l.LinkToChild(dm)
 		// 子が親のPageIDを参照できるようにする
 		// rootの場合は中間ノードにして左右に振り分ける
 		if p.ParentID == InvalidPageID {
@@ -250,11 +271,12 @@ func (p *Page) InsertPair(dm DiskManager, key, value Bytes) error {
 			if err := r.Flush(dm); err != nil {
 				return err
 			}
-			r.LinkToChild(dm)
+			if err := r.LinkToChild(dm); err != nil {
+				return err
+			}
 		}
 		if p.ParentID != InvalidPageID {
-			bytes := dm.ReadPageData(p.ParentID)
-			parentPage, err := NewPage(bytes)
+			parentPage, err := fetchPage(dm, p.ParentID)
 			if err != nil {
 				return err
 			}
@@ -264,13 +286,249 @@ func (p *Page) InsertPair(dm DiskManager, key, value Bytes) error {
 			if err := l.Flush(dm); err != nil {
 				return err
 			}
-			return parentPage.InsertPair(dm, l.Items[len(l.Items)-1].Key, NewBytes(uint32(l.PageID)))
+			return parentPage.InsertPairWith(dm, l.Items[len(l.Items)-1].Key, NewBytes(uint32(l.PageID)), split)
 		}
 	}
 
 	return p.Flush(dm)
 }
 
+// index番目のpairのvalueを置き換える
+// 置き換えによってページに収まらなくなった場合はInsertPairWithと同様にsplitの方法で分割する
+func (p *Page) UpdatePair(dm DiskManager, index int, value Bytes, split SplitConfig) error {
+	key := p.Items[index].Key
+	p.Items = append(p.Items[:index], p.Items[index+1:]...)
+	return p.InsertPairWith(dm, key, value, split)
+}
+
+// 対象のページからkeyに一致するpairを削除する
+// 前提として正しいページ(leaf)から削除されるものとする
+func (p *Page) DeletePair(dm DiskManager, key Bytes, keyLen uint32) error {
+	index := p.IndexOf(key, keyLen)
+	if index < 0 {
+		return ErrKeyNotFound
+	}
+	p.Items = append(p.Items[:index], p.Items[index+1:]...)
+	return p.rebalance(dm)
+}
+
+// ページの使用量が下限を下回った場合に兄弟ページから借りるか併合する
+// 親のitemが減った場合は親に対しても再帰的に呼び出す
+func (p *Page) rebalance(dm DiskManager) error {
+	if p.ParentID == InvalidPageID {
+		return p.collapseRoot(dm)
+	}
+	if !p.IsUnderflow() {
+		return p.Flush(dm)
+	}
+
+	parent, err := fetchPage(dm, p.ParentID)
+	if err != nil {
+		return err
+	}
+	children := parent.Children()
+	index := -1
+	for i, child := range children {
+		if child == p.PageID {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return fmt.Errorf("page %d is not a child of page %d", p.PageID, parent.PageID)
+	}
+
+	// 同じ親を持つ左隣(PrevPageID)を優先し、いなければ右隣(NextPageID)と組み合わせる
+	// 常にlが左、rが右になるようにし、親のindex番目のitemがlを指す
+	var l, r *Page
+	switch {
+	case index > 0:
+		l, err = fetchPage(dm, children[index-1])
+		if err != nil {
+			return err
+		}
+		r = p
+		index -= 1
+	case index+1 < len(children):
+		r, err = fetchPage(dm, children[index+1])
+		if err != nil {
+			return err
+		}
+		l = p
+	default:
+		// 兄弟がいない場合は空になった時だけ親から取り除く
+		if len(p.Children()) > 0 || (p.NodeType == NodeTypeLeaf && len(p.Items) > 0) {
+			return p.Flush(dm)
+		}
+		if err := p.unlinkSiblings(dm); err != nil {
+			return err
+		}
+		if err := dm.DeallocatePage(p.PageID); err != nil {
+			return err
+		}
+		parent.removeChild(index)
+		return parent.rebalance(dm)
+	}
+
+	// 中間ノードの場合、lのRightPointerは親のseparatorをキーとしたitemに変換して結合する
+	separator := parent.Items[index].Key
+	items := make([]Pair, 0, len(l.Items)+len(r.Items)+1)
+	items = append(items, l.Items...)
+	if l.NodeType == NodeTypeBranch && l.RightPointer != InvalidPageID {
+		items = append(items, Pair{separator, NewBytes(uint32(l.RightPointer))})
+	}
+	items = append(items, r.Items...)
+
+	merged := Page{Items: items}
+	if merged.NBytes() <= LimitBytesSize() {
+		// 右のページに併合してlは親とsiblingのリンクから外す
+		r.Items = items
+		if err := l.unlinkSiblings(dm); err != nil {
+			return err
+		}
+		r.PrevPageID = l.PrevPageID
+		if err := r.Flush(dm); err != nil {
+			return err
+		}
+		if err := r.LinkToChild(dm); err != nil {
+			return err
+		}
+		if err := dm.DeallocatePage(l.PageID); err != nil {
+			return err
+		}
+		parent.removeChild(index)
+		return parent.rebalance(dm)
+	}
+
+	// 1ページに収まらない場合は左右に再分配して親のseparatorを更新する
+	half := (len(items) + 1) / 2
+	l.Items = items[:half]
+	r.Items = items[half:]
+	if l.NodeType == NodeTypeBranch {
+		l.RightPointer = InvalidPageID
+	}
+	parent.Items[index].Key = l.Items[len(l.Items)-1].Key
+	for _, page := range []*Page{l, r} {
+		if err := page.Flush(dm); err != nil {
+			return err
+		}
+		if err := page.LinkToChild(dm); err != nil {
+			return err
+		}
+	}
+	return parent.Flush(dm)
+}
+
+// rootの子が1つだけになった場合はその子の内容をrootに引き上げる
+// rootのPageIDは変わらないのでRootPageIDのままになる
+func (p *Page) collapseRoot(dm DiskManager) error {
+	for p.NodeType == NodeTypeBranch {
+		children := p.Children()
+		if len(children) > 1 {
+			break
+		}
+		if len(children) == 0 {
+			p.NodeType = NodeTypeLeaf
+			p.Items = []Pair{}
+			p.RightPointer = InvalidPageID
+			break
+		}
+		child, err := fetchPage(dm, children[0])
+		if err != nil {
+			return err
+		}
+		p.NodeType = child.NodeType
+		p.Items = child.Items
+		p.RightPointer = child.RightPointer
+		p.PrevPageID = InvalidPageID
+		p.NextPageID = InvalidPageID
+		if err := p.LinkToChild(dm); err != nil {
+			return err
+		}
+		if err := dm.DeallocatePage(child.PageID); err != nil {
+			return err
+		}
+	}
+	return p.Flush(dm)
+}
+
+// 親からindex番目の子を取り除く
+func (p *Page) removeChild(index int) {
+	if index < len(p.Items) {
+		p.Items = append(p.Items[:index], p.Items[index+1:]...)
+		return
+	}
+	p.RightPointer = InvalidPageID
+}
+
+// 左右のsiblingが自身を飛ばして互いを指すようにする
+func (p *Page) unlinkSiblings(dm DiskManager) error {
+	if p.PrevPageID != InvalidPageID {
+		prevPage, err := fetchPage(dm, p.PrevPageID)
+		if err != nil {
+			return err
+		}
+		prevPage.NextPageID = p.NextPageID
+		if err := prevPage.Flush(dm); err != nil {
+			return err
+		}
+	}
+	if p.NextPageID != InvalidPageID {
+		nextPage, err := fetchPage(dm, p.NextPageID)
+		if err != nil {
+			return err
+		}
+		nextPage.PrevPageID = p.PrevPageID
+		if err := nextPage.Flush(dm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keyに一致するpairのindexを返す。見つからない場合は-1を返す
+func (p *Page) IndexOf(key Bytes, keyLen uint32) int {
+	i := p.search(key, keyLen)
+	if i < len(p.Items) && p.Items[i].Key.Compare(key, keyLen) == ComparisonResultEqual {
+		return i
+	}
+	return -1
+}
+
+// 先頭keyLenバイトがkey以上になる最初のitemの位置を返す。SlottedPage.Searchと同じ
+func (p *Page) search(key Bytes, keyLen uint32) int {
+	return sort.Search(len(p.Items), func(i int) bool {
+		return p.Items[i].Key.Compare(key, keyLen) != ComparisonResultSmall
+	})
+}
+
+// 中間ノードでkeyが含まれうる子のPageIDを返す
+func (p *Page) child(key Bytes, keyLen uint32) PageID {
+	if i := p.search(key, keyLen); i < len(p.Items) {
+		return PageID(p.Items[i].Value.Uint32(0))
+	}
+	return p.RightPointer
+}
+
+// 中間ノードが持つ子のPageIDを左から順に返す
+func (p *Page) Children() []PageID {
+	if p.NodeType == NodeTypeLeaf {
+		return nil
+	}
+	children := make([]PageID, 0, len(p.Items)+1)
+	for _, item := range p.Items {
+		children = append(children, PageID(item.Value.Uint32(0)))
+	}
+	if p.RightPointer != InvalidPageID {
+		children = append(children, p.RightPointer)
+	}
+	return children
+}
+
+func (p *Page) IsUnderflow() bool {
+	return p.NBytes() < MinBytesSize()
+}
+
 // ノードの分割などで親と子の結びつきに変更があった際に呼び出す
 func (p *Page) LinkToChild(dm DiskManager) error {
 	// leafは子ノードを持たないのでreturn
@@ -279,8 +537,7 @@ func (p *Page) LinkToChild(dm DiskManager) error {
 	}
 
 	for _, item := range p.Items {
-		bytes := dm.ReadPageData(PageID(item.Value.Uint32(0)))
-		child, err := NewPage(bytes)
+		child, err := fetchPage(dm, PageID(item.Value.Uint32(0)))
 		if err != nil {
 			return err
 		}
@@ -290,8 +547,7 @@ func (p *Page) LinkToChild(dm DiskManager) error {
 		}
 	}
 	if p.RightPointer != InvalidPageID {
-		bytes := dm.ReadPageData(p.RightPointer)
-		child, err := NewPage(bytes)
+		child, err := fetchPage(dm, p.RightPointer)
 		if err != nil {
 			return err
 		}
@@ -303,52 +559,102 @@ func (p *Page) LinkToChild(dm DiskManager) error {
 	return nil
 }
 
+// ページをデコードせずに読む。fetchPageと同じく壊れていた場合はErrPageCorruptedを返す
+func readSlottedPage(dm DiskManager, pageID PageID) (SlottedPage, error) {
+	data, err := dm.ReadPageData(pageID)
+	if err != nil {
+		return SlottedPage{}, err
+	}
+	page := NewSlottedPage(&data)
+	if err := page.Validate(); err != nil {
+		var corrupted *ErrPageCorrupted
+		if errors.As(err, &corrupted) {
+			corrupted.PageID = pageID
+		}
+		return SlottedPage{}, err
+	}
+	return page, nil
+}
+
+// ページが壊れていた場合、ErrPageCorruptedのPageIDは読もうとしたページのIDになる
+func fetchPage(dm DiskManager, pageID PageID) (*Page, error) {
+	bytes, err := dm.ReadPageData(pageID)
+	if err != nil {
+		return nil, err
+	}
+	page, err := NewPage(bytes)
+	var corrupted *ErrPageCorrupted
+	if errors.As(err, &corrupted) {
+		corrupted.PageID = pageID
+	}
+	return page, err
+}
+
 func (p *Page) Flush(dm DiskManager) error {
-	dm.WritePageData(p.PageID, p.Bytes())
-	return nil
+	b, err := p.Bytes()
+	if err != nil {
+		return err
+	}
+	return dm.WritePageData(p.PageID, b)
 }
 
-func (p *Page) Bytes() [PageSize]byte {
+// itemがPageSizeに収まらない場合はErrPageTooLargeを返す
+func (p *Page) Bytes() ([PageSize]byte, error) {
 	var b [PageSize]byte
-	binary.NativeEndian.PutUint32(b[:4], uint32(p.PageID))
-	binary.NativeEndian.PutUint32(b[NodeTypeOffset:NodeTypeOffset+4], uint32(p.NodeType))
-	binary.NativeEndian.PutUint32(b[ParentIDOffset:ParentIDOffset+4], uint32(p.ParentID))
-	binary.NativeEndian.PutUint32(b[PrevPageIDOffset:PrevPageIDOffset+4], uint32(p.PrevPageID))
-	binary.NativeEndian.PutUint32(b[NextPageIDOffset:NextPageIDOffset+4], uint32(p.NextPageID))
-	binary.NativeEndian.PutUint32(b[RightPointerOffset:RightPointerOffset+4], uint32(p.RightPointer))
-
-	var start uint32 = HeaderNByte // 24バイト目までは固定のヘッダー
-	var tail uint32 = PageSize
-	for _, item := range p.Items {
-		// キーが何バイト目から始まるか
+	binary.BigEndian.PutUint32(b[:4], uint32(p.PageID))
+	binary.BigEndian.PutUint32(b[NodeTypeOffset:NodeTypeOffset+4], uint32(p.NodeType))
+	binary.BigEndian.PutUint32(b[ParentIDOffset:ParentIDOffset+4], uint32(p.ParentID))
+	binary.BigEndian.PutUint32(b[PrevPageIDOffset:PrevPageIDOffset+4], uint32(p.PrevPageID))
+	binary.BigEndian.PutUint32(b[NextPageIDOffset:NextPageIDOffset+4], uint32(p.NextPageID))
+	binary.BigEndian.PutUint32(b[RightPointerOffset:RightPointerOffset+4], uint32(p.RightPointer))
+
+	// キーの順に末尾から詰めて書く
+	s := NewSlottedPage(&b)
+	tail := uint32(PageSize)
+	for i, item := range p.Items {
 		itemLen := item.Key.Len() + item.Value.Len()
-		binary.NativeEndian.PutUint32(b[start:start+4], tail-itemLen)
-		start += 4
-		// キーの長さ
-		binary.NativeEndian.PutUint32(b[start:start+4], item.Key.Len())
-		start += 4
-		// バリューの長さ
-		binary.NativeEndian.PutUint32(b[start:start+4], item.Value.Len())
-		start += 4
-
-		// バリューの値を入れる
-		index := 0
-		for i := tail - item.Value.Len(); i < tail; i++ {
-			b[i] = item.Value[index]
-			index += 1
-		}
-		tail -= item.Value.Len()
-		// キーの値を入れる
-		index = 0
-		for i := tail - item.Key.Len(); i < tail; i++ {
-			b[i] = item.Key[index]
-			index += 1
-		}
-		tail -= item.Key.Len()
+		if tail < uint32(HeaderNByte+(i+1)*SlotNByte)+itemLen {
+			return b, fmt.Errorf("%w: page %d does not fit in %d bytes", ErrPageTooLarge, p.PageID, PageSize)
+		}
+		tail -= itemLen
+		copy(b[tail:], item.Key)
+		copy(b[tail+item.Key.Len():], item.Value)
+		s.setSlot(i, tail, item.Key.Len(), item.Value.Len())
 	}
+	s.setNumSlots(len(p.Items))
+	s.setDataStart(tail)
+	s.Finish()
+	return b, nil
+}
+
+// DeallocatePageで書き込む、解放済みの印を付けたページ
+func freePageData(pageID PageID) [PageSize]byte {
+	// itemの無いページは必ず収まる
+	b, _ := (&Page{PageID: pageID, NodeType: NodeTypeFree}).Bytes()
 	return b
 }
 
+func isFreePageData(data *[PageSize]byte) bool {
+	return NodeType(binary.BigEndian.Uint32(data[NodeTypeOffset:NodeTypeOffset+4])) == NodeTypeFree
+}
+
+// ファイルから読んだページが、pageIDに書いた解放済みのページのまま壊れていないか
+func isIntactFreePageData(data *[PageSize]byte, pageID PageID) bool {
+	return isFreePageData(data) &&
+		PageID(binary.BigEndian.Uint32(data[:4])) == pageID &&
+		binary.BigEndian.Uint32(data[ChecksumOffset:ChecksumOffset+4]) == pageChecksum(data)
+}
+
+// チェックサムを書き込んだ後にヘッダーを書き換えた場合は、もう一度呼んで計算し直す
+func SetPageChecksum(b *[PageSize]byte) {
+	binary.BigEndian.PutUint32(b[ChecksumOffset:ChecksumOffset+4], pageChecksum(b))
+}
+
+func pageChecksum(b *[PageSize]byte) uint32 {
+	crc := crc32.Checksum(b[:ChecksumOffset], crc32cTable)
+	return crc32.Update(crc, crc32cTable, b[ChecksumOffset+4:])
+}
+
 // 現在ページ内で使われているバイト数を返す
 func (p *Page) NBytes() uint32 {
 	var totalBytes uint32
@@ -365,53 +671,33 @@ func (p *Page) NBytes() uint32 {
 
 // とりあえずデバッグ用で実装する
 // 自身と子ノードを全て表示。in-order
-func (p *Page) PrintAll(dm DiskManager, prefix string) {
+func (p *Page) PrintAll(dm DiskManager, prefix string) error {
 	fmt.Printf("%s page: %+v \n", prefix, p)
-	if p.NodeType == NodeTypeLeaf {
-		return
-	}
 	// internal nodeの時のみchild nodeの確認をする
-	for _, i := range p.Items {
-		prefix := prefix + "-"
-		bytes := dm.ReadPageData(PageID(i.Value.Uint32(0)))
-		nextPage, err := NewPage(bytes)
+	for _, childID := range p.Children() {
+		nextPage, err := fetchPage(dm, childID)
 		if err != nil {
-			panic(err)
+			return err
 		}
-		nextPage.PrintAll(dm, prefix)
-	}
-	if p.RightPointer != InvalidPageID {
-		newprefix := prefix + "-"
-		bytes := dm.ReadPageData(PageID(p.RightPointer))
-		nextPage, err := NewPage(bytes)
-		if err != nil {
-			panic(err)
+		if err := nextPage.PrintAll(dm, prefix+"-"); err != nil {
+			return err
 		}
-		nextPage.PrintAll(dm, newprefix)
 	}
+	return nil
 }
 
-func (p *Page) Walk(dm DiskManager, ps *[]Page, depth int32) {
+func (p *Page) Walk(dm DiskManager, ps *[]Page, depth int32) error {
 	p.Depth = depth
 	*ps = append(*ps, *p)
-	if p.NodeType == NodeTypeLeaf {
-		return
-	}
 	// internal nodeの時のみchild nodeの確認をする
-	for _, i := range p.Items {
-		bytes := dm.ReadPageData(PageID(i.Value.Uint32(0)))
-		nextPage, err := NewPage(bytes)
+	for _, childID := range p.Children() {
+		nextPage, err := fetchPage(dm, childID)
 		if err != nil {
-			panic(err)
+			return err
 		}
-		nextPage.Walk(dm, ps, 1+depth)
-	}
-	if p.RightPointer != InvalidPageID {
-		bytes := dm.ReadPageData(PageID(p.RightPointer))
-		nextPage, err := NewPage(bytes)
-		if err != nil {
-			panic(err)
+		if err := nextPage.Walk(dm, ps, 1+depth); err != nil {
+			return err
 		}
-		nextPage.Walk(dm, ps, 1+depth)
 	}
+	return nil
 }
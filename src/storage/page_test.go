@@ -1,7 +1,8 @@
 package storage
 
 import (
-	"os"
+	"encoding/binary"
+	"errors"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -54,7 +55,7 @@ var _ = Describe("Pageのテスト", func() {
 						},
 					},
 				}
-				bytes = actual.Bytes()
+				bytes, _ = actual.Bytes()
 			})
 			It("デコード後も同じ値になる", func() {
 				Expect(*expected).To(Equal((*actual)))
@@ -94,7 +95,7 @@ var _ = Describe("Pageのテスト", func() {
 						},
 					},
 				}
-				bytes = actual.Bytes()
+				bytes, _ = actual.Bytes()
 			})
 			It("デコード後も同じ値になる", func() {
 				Expect(*expected).To(Equal((*actual)))
@@ -103,6 +104,38 @@ var _ = Describe("Pageのテスト", func() {
 				Expect(err).To(BeNil())
 			})
 		})
+		Context("ページが壊れている場合", func() {
+			BeforeEach(func() {
+				actual = &Page{
+					PageID:       PageID(2),
+					NodeType:     NodeTypeLeaf,
+					RightPointer: InvalidPageID,
+					Items:        []Pair{{NewBytes(1), NewBytes(5)}},
+				}
+				bytes, _ = actual.Bytes()
+			})
+			Context("チェックサムが合わない場合", func() {
+				BeforeEach(func() {
+					bytes[PageSize-1] ^= 1
+				})
+				It("ErrPageCorruptedが返る", func() {
+					var corrupted *ErrPageCorrupted
+					Expect(errors.As(err, &corrupted)).To(BeTrue())
+					Expect(corrupted.PageID).To(Equal(PageID(2)))
+				})
+			})
+			Context("オフセットがページの外を指している場合", func() {
+				BeforeEach(func() {
+					binary.BigEndian.PutUint32(bytes[HeaderNByte+4:HeaderNByte+8], PageSize)
+					SetPageChecksum(&bytes)
+				})
+				It("ErrPageCorruptedが返る", func() {
+					var corrupted *ErrPageCorrupted
+					Expect(errors.As(err, &corrupted)).To(BeTrue())
+					Expect(expected).To(BeNil())
+				})
+			})
+		})
 	})
 	Describe("SearchByV3", func() {
 		var (
@@ -119,7 +152,7 @@ var _ = Describe("Pageのテスト", func() {
 			res []*Page
 		)
 		JustBeforeEach(func() {
-			p, err = NewPage([PageSize]byte(dm.ReadPageData(PageID(1))))
+			p, err = fetchPage(dm, PageID(1))
 			if err != nil {
 				panic(err)
 			}
@@ -129,8 +162,8 @@ var _ = Describe("Pageのテスト", func() {
 		})
 		Context("キーが1カラム", func() {
 			BeforeEach(func() {
-				f, _ := os.Create("test_table")
-				dm = NewDiskManager(f)
+				f := createTestFile("test_table")
+				dm, _ = NewDiskManager(f)
 				NewTable2(dm, ColumnSize)
 				CreateTestPage(dm)
 				len = ColumnSize
@@ -216,8 +249,8 @@ var _ = Describe("Pageのテスト", func() {
 		})
 		Context("キーが2カラムの場合", func() {
 			BeforeEach(func() {
-				f, _ := os.Create("test_multi_column_table")
-				dm = NewDiskManager(f)
+				f := createTestFile("test_multi_column_table")
+				dm, _ = NewDiskManager(f)
 				NewTable2(dm, ColumnSize*2)
 				CreateMultiColumnPage(dm)
 			})
@@ -272,8 +305,8 @@ var _ = Describe("Pageのテスト", func() {
 					RightPointer: PageID(2),
 				}
 			})
-			It("24バイトが返る", func() {
-				Expect(nByte).To(Equal(uint32(24)))
+			It("44バイトが返る", func() {
+				Expect(nByte).To(Equal(uint32(44)))
 			})
 		})
 		Context("キーバリューペアが存在する場合", func() {
@@ -297,11 +330,24 @@ var _ = Describe("Pageのテスト", func() {
 					},
 				}
 			})
-			It("72バイトが返る", func() {
-				Expect(nByte).To(Equal(uint32(72)))
+			It("92バイトが返る", func() {
+				Expect(nByte).To(Equal(uint32(92)))
 			})
 		})
 	})
+	Describe("Bytes", func() {
+		It("PageSizeに収まらない場合はpanicせずErrPageTooLargeが返る", func() {
+			page := &Page{PageID: PageID(3), NodeType: NodeTypeLeaf}
+			for i := uint32(0); i < 5; i++ {
+				page.Items = append(page.Items, Pair{NewBytes(i), make(Bytes, 1000)})
+			}
+			_, err := page.Bytes()
+			Expect(errors.Is(err, ErrPageTooLarge)).To(BeTrue())
+
+			dm, _ := NewDiskManager(newCrashableFile())
+			Expect(errors.Is(page.Flush(dm), ErrPageTooLarge)).To(BeTrue())
+		})
+	})
 })
 
 func CreateRootPage(dm DiskManager) {
@@ -465,6 +511,6 @@ func createTestPage(dm DiskManager, pageID PageID, nodeType NodeType, parentID,
 		kvs,
 		0,
 	}
-	b := page.Bytes()
+	b, _ := page.Bytes()
 	dm.WritePageData(pageID, b)
 }
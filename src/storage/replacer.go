@@ -0,0 +1,251 @@
+package storage
+
+import (
+	"container/list"
+)
+
+type (
+	// バッファプールのどのフレームを追い出すかを決める
+	// pinされているフレームはSetEvictable(false)されるので追い出し対象にしてはいけない
+	Replacer interface {
+		RecordAccess(bufferID BufferID)
+		SetEvictable(bufferID BufferID, evictable bool)
+		Evict() (BufferID, bool)
+		Remove(bufferID BufferID) // フレームが別のページに使い回される時に参照履歴を消す
+	}
+
+	// 追い出し可能なフレームだけを連結リストで持つので全ての操作がO(1)になる
+	LRUReplacer struct {
+		list     *list.List // 先頭が最近使われたフレーム
+		elements map[BufferID]*list.Element
+	}
+
+	// フレームを輪に並べて参照ビットが立っていないものを針が指すまで進める
+	ClockReplacer struct {
+		present   []bool
+		refs      []bool
+		evictable []bool
+		hand      int
+	}
+
+	// 直近k回目の参照が一番古いフレームを追い出す
+	// 参照がk回未満のフレームは無限に古いとみなして優先的に追い出すので、1回しか読まれないスキャンで頻繁に使うページが追い出されない
+	LRUKReplacer struct {
+		k         int
+		clock     uint64
+		history   map[BufferID][]uint64 // 直近k回の参照時刻。先頭が一番古い
+		evictable map[BufferID]bool
+	}
+
+	// 1回だけ参照されたフレームをFIFOのa1に、2回以上参照されたフレームをLRUのamに入れて、a1から先に追い出す
+	// ページIDではなくフレームの履歴だけを持つので、追い出したページの履歴(A1out)を持たない簡易版
+	TwoQueueReplacer struct {
+		a1        *list.List
+		am        *list.List
+		elements  map[BufferID]*list.Element
+		inAm      map[BufferID]bool
+		evictable map[BufferID]bool
+	}
+)
+
+// LRU
+func NewLRUReplacer() *LRUReplacer {
+	return &LRUReplacer{
+		list:     list.New(),
+		elements: map[BufferID]*list.Element{},
+	}
+}
+
+// pinされているフレームはリストにいないので、unpinされた時点が最後に使われた時刻になる
+func (r *LRUReplacer) RecordAccess(bufferID BufferID) {
+	if e, ok := r.elements[bufferID]; ok {
+		r.list.MoveToFront(e)
+	}
+}
+
+func (r *LRUReplacer) SetEvictable(bufferID BufferID, evictable bool) {
+	e, ok := r.elements[bufferID]
+	if evictable && !ok {
+		r.elements[bufferID] = r.list.PushFront(bufferID)
+	}
+	if !evictable && ok {
+		r.list.Remove(e)
+		delete(r.elements, bufferID)
+	}
+}
+
+func (r *LRUReplacer) Evict() (BufferID, bool) {
+	e := r.list.Back()
+	if e == nil {
+		return 0, false
+	}
+	bufferID := r.list.Remove(e).(BufferID)
+	delete(r.elements, bufferID)
+	return bufferID, true
+}
+
+func (r *LRUReplacer) Remove(bufferID BufferID) {
+	r.SetEvictable(bufferID, false)
+}
+
+// Clock
+func NewClockReplacer(cap int) *ClockReplacer {
+	return &ClockReplacer{
+		present:   make([]bool, cap),
+		refs:      make([]bool, cap),
+		evictable: make([]bool, cap),
+	}
+}
+
+func (r *ClockReplacer) RecordAccess(bufferID BufferID) {
+	r.present[bufferID] = true
+	r.refs[bufferID] = true
+}
+
+func (r *ClockReplacer) SetEvictable(bufferID BufferID, evictable bool) {
+	r.evictable[bufferID] = evictable
+}
+
+// 1周目で参照ビットを落とし、2周目までに参照ビットの立っていないフレームを見つける
+func (r *ClockReplacer) Evict() (BufferID, bool) {
+	for i := 0; i < 2*len(r.present); i++ {
+		bufferID := BufferID(r.hand)
+		r.hand = (r.hand + 1) % len(r.present)
+		if !r.present[bufferID] || !r.evictable[bufferID] {
+			continue
+		}
+		if r.refs[bufferID] {
+			r.refs[bufferID] = false
+			continue
+		}
+		r.Remove(bufferID)
+		return bufferID, true
+	}
+	return 0, false
+}
+
+func (r *ClockReplacer) Remove(bufferID BufferID) {
+	r.present[bufferID] = false
+	r.refs[bufferID] = false
+	r.evictable[bufferID] = false
+}
+
+// LRU-K
+func NewLRUKReplacer(k int) *LRUKReplacer {
+	return &LRUKReplacer{
+		k:         k,
+		history:   map[BufferID][]uint64{},
+		evictable: map[BufferID]bool{},
+	}
+}
+
+func (r *LRUKReplacer) RecordAccess(bufferID BufferID) {
+	r.clock += 1
+	history := append(r.history[bufferID], r.clock)
+	if len(history) > r.k {
+		history = history[1:]
+	}
+	r.history[bufferID] = history
+}
+
+func (r *LRUKReplacer) SetEvictable(bufferID BufferID, evictable bool) {
+	if evictable {
+		r.evictable[bufferID] = true
+		return
+	}
+	delete(r.evictable, bufferID)
+}
+
+// 参照がk回未満のフレームの中で最初の参照が一番古いもの、いなければ直近k回目の参照が一番古いものを返す
+func (r *LRUKReplacer) Evict() (BufferID, bool) {
+	var (
+		victimID BufferID
+		hasFound bool
+		victimK  bool // victimの参照がk回に達しているか
+	)
+	for bufferID := range r.evictable {
+		reachedK := len(r.history[bufferID]) >= r.k
+		if !hasFound || (victimK && !reachedK) || (victimK == reachedK && r.oldest(bufferID) < r.oldest(victimID)) {
+			victimID = bufferID
+			victimK = reachedK
+			hasFound = true
+		}
+	}
+	if !hasFound {
+		return 0, false
+	}
+	r.Remove(victimID)
+	return victimID, true
+}
+
+// 保持している参照履歴の中で一番古い時刻
+func (r *LRUKReplacer) oldest(bufferID BufferID) uint64 {
+	if history := r.history[bufferID]; len(history) > 0 {
+		return history[0]
+	}
+	return 0
+}
+
+func (r *LRUKReplacer) Remove(bufferID BufferID) {
+	delete(r.history, bufferID)
+	delete(r.evictable, bufferID)
+}
+
+// 2Q
+func NewTwoQueueReplacer() *TwoQueueReplacer {
+	return &TwoQueueReplacer{
+		a1:        list.New(),
+		am:        list.New(),
+		elements:  map[BufferID]*list.Element{},
+		inAm:      map[BufferID]bool{},
+		evictable: map[BufferID]bool{},
+	}
+}
+
+func (r *TwoQueueReplacer) RecordAccess(bufferID BufferID) {
+	e, ok := r.elements[bufferID]
+	switch {
+	case !ok:
+		r.elements[bufferID] = r.a1.PushFront(bufferID)
+	case r.inAm[bufferID]:
+		r.am.MoveToFront(e)
+	default:
+		r.a1.Remove(e)
+		r.elements[bufferID] = r.am.PushFront(bufferID)
+		r.inAm[bufferID] = true
+	}
+}
+
+func (r *TwoQueueReplacer) SetEvictable(bufferID BufferID, evictable bool) {
+	if evictable {
+		r.evictable[bufferID] = true
+		return
+	}
+	delete(r.evictable, bufferID)
+}
+
+func (r *TwoQueueReplacer) Evict() (BufferID, bool) {
+	for _, queue := range []*list.List{r.a1, r.am} {
+		for e := queue.Back(); e != nil; e = e.Prev() {
+			bufferID := e.Value.(BufferID)
+			if r.evictable[bufferID] {
+				r.Remove(bufferID)
+				return bufferID, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func (r *TwoQueueReplacer) Remove(bufferID BufferID) {
+	if e, ok := r.elements[bufferID]; ok {
+		if r.inAm[bufferID] {
+			r.am.Remove(e)
+		} else {
+			r.a1.Remove(e)
+		}
+	}
+	delete(r.elements, bufferID)
+	delete(r.inAm, bufferID)
+	delete(r.evictable, bufferID)
+}
@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Replacerのテスト", func() {
+	var (
+		replacer Replacer
+
+		victims []BufferID
+	)
+	// 0,1,2の順に参照してunpinし、その後accessesの順に参照する
+	access := func(accesses ...BufferID) {
+		for _, id := range []BufferID{0, 1, 2} {
+			replacer.RecordAccess(id)
+			replacer.SetEvictable(id, true)
+		}
+		for _, id := range accesses {
+			replacer.RecordAccess(id)
+		}
+	}
+	evictAll := func() {
+		victims = []BufferID{}
+		for {
+			id, ok := replacer.Evict()
+			if !ok {
+				return
+			}
+			victims = append(victims, id)
+		}
+	}
+	Describe("LRUReplacer", func() {
+		BeforeEach(func() {
+			replacer = NewLRUReplacer()
+		})
+		Context("参照順に追い出す場合", func() {
+			It("最後の参照が古い順に追い出される", func() {
+				access(0)
+				evictAll()
+				Expect(victims).To(Equal([]BufferID{1, 2, 0}))
+			})
+		})
+		Context("pinされているフレームがある場合", func() {
+			It("pinされているフレームは追い出されない", func() {
+				access()
+				replacer.SetEvictable(0, false)
+				evictAll()
+				Expect(victims).To(Equal([]BufferID{1, 2}))
+			})
+		})
+	})
+	Describe("ClockReplacer", func() {
+		BeforeEach(func() {
+			replacer = NewClockReplacer(3)
+		})
+		Context("全てのフレームの参照ビットが立っている場合", func() {
+			It("1周して参照ビットを落とした後に針の位置から追い出される", func() {
+				access()
+				id, ok := replacer.Evict()
+				Expect(ok).To(BeTrue())
+				Expect(id).To(Equal(BufferID(0)))
+			})
+		})
+		Context("追い出した後に参照されたフレームがある場合", func() {
+			It("参照ビットが立っているフレームは飛ばされる", func() {
+				access()
+				replacer.Evict()
+				replacer.RecordAccess(1)
+				id, _ := replacer.Evict()
+				Expect(id).To(Equal(BufferID(2)))
+			})
+		})
+		Context("pinされているフレームがある場合", func() {
+			It("pinされているフレームは追い出されない", func() {
+				access()
+				replacer.SetEvictable(0, false)
+				evictAll()
+				Expect(victims).To(ConsistOf(BufferID(1), BufferID(2)))
+			})
+		})
+	})
+	Describe("LRUKReplacer", func() {
+		BeforeEach(func() {
+			replacer = NewLRUKReplacer(2)
+		})
+		Context("参照がk回未満のフレームがある場合", func() {
+			It("k回未満のフレームが先に追い出される", func() {
+				access(0, 2)
+				evictAll()
+				Expect(victims).To(Equal([]BufferID{1, 0, 2}))
+			})
+		})
+		Context("全てのフレームがk回参照されている場合", func() {
+			It("最後の参照ではなく直近k回目の参照が古い順に追い出される", func() {
+				access(2, 1, 0)
+				evictAll()
+				Expect(victims).To(Equal([]BufferID{0, 1, 2}))
+			})
+		})
+		Context("pinされているフレームがある場合", func() {
+			It("pinされているフレームは追い出されない", func() {
+				access()
+				replacer.SetEvictable(0, false)
+				evictAll()
+				Expect(victims).To(Equal([]BufferID{1, 2}))
+			})
+		})
+	})
+	Describe("TwoQueueReplacer", func() {
+		BeforeEach(func() {
+			replacer = NewTwoQueueReplacer()
+		})
+		Context("2回以上参照されたフレームがある場合", func() {
+			It("1回だけ参照されたフレームがFIFOで先に追い出される", func() {
+				access(1, 0, 1)
+				evictAll()
+				Expect(victims).To(Equal([]BufferID{2, 0, 1}))
+			})
+		})
+		Context("pinされているフレームがある場合", func() {
+			It("pinされているフレームは追い出されない", func() {
+				access()
+				replacer.SetEvictable(0, false)
+				evictAll()
+				Expect(victims).To(Equal([]BufferID{1, 2}))
+			})
+		})
+	})
+	Describe("スキャンが多い負荷での比較", func() {
+		var (
+			hits map[string]uint64
+		)
+		BeforeEach(func() {
+			hits = map[string]uint64{}
+			for name, replacer := range map[string]Replacer{
+				"lru":   NewLRUReplacer(),
+				"clock": NewClockReplacer(4),
+				"lru-k": NewLRUKReplacer(2),
+				"2q":    NewTwoQueueReplacer(),
+			} {
+				hits[name] = runScanWorkload(replacer, 4).Hits
+			}
+		})
+		It("LRU-Kと2Qはスキャンで頻繁に使うページを追い出さない", func() {
+			Expect(hits["lru-k"]).To(BeNumerically(">", hits["lru"]))
+			Expect(hits["2q"]).To(BeNumerically(">", hits["lru"]))
+			Expect(hits["lru-k"]).To(BeNumerically(">", hits["clock"]))
+		})
+	})
+})
+
+// 頻繁に参照するページ1,2の間に、フレーム数より多いページのスキャンを挟む
+func runScanWorkload(replacer Replacer, cap int) BufferPoolStats {
+	// BenchmarkReplacerからも呼ぶので、Ginkgoのノードの外でも使えるメモリ上のファイルに書く
+	dm, _ := NewDiskManager(newCrashableFile())
+	for i := 0; i < 20; i++ {
+		var data [PageSize]byte
+		dm.WritePageData(dm.AllocatePage(), data)
+	}
+	bpm := NewBufferPoolManager(dm, cap, replacer)
+	for round := 0; round < 10; round++ {
+		for i := 0; i < 3; i++ {
+			bpm.ReadPageData(PageID(1))
+			bpm.ReadPageData(PageID(2))
+		}
+		for pageID := PageID(3); pageID < 20; pageID++ {
+			bpm.ReadPageData(pageID)
+		}
+	}
+	return bpm.Stats()
+}
+
+// go test -bench Replacer でヒット率を比較する
+func BenchmarkReplacer(b *testing.B) {
+	for name, newReplacer := range map[string]func() Replacer{
+		"LRU":   func() Replacer { return NewLRUReplacer() },
+		"Clock": func() Replacer { return NewClockReplacer(4) },
+		"LRU-K": func() Replacer { return NewLRUKReplacer(2) },
+		"2Q":    func() Replacer { return NewTwoQueueReplacer() },
+	} {
+		b.Run(name, func(b *testing.B) {
+			var stats BufferPoolStats
+			for i := 0; i < b.N; i++ {
+				stats = runScanWorkload(newReplacer(), 4)
+			}
+			b.ReportMetric(float64(stats.Hits)/float64(stats.Hits+stats.Misses), "hit-ratio")
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+type (
+	// [PageSize]byteのままページを読み書きする
+	// ヘッダーの後ろにキーの順に並んだスロット(オフセット・キーの長さ・バリューの長さ)を置き、キーとバリューは末尾から詰めて書く
+	// キーはバッファ上で二分探索し、挿入・削除ではスロットの配列だけをずらす
+	// 削除・置き換えで空いた領域は、挿入する場所が足りなくなった時にまとめて詰める
+	SlottedPage struct {
+		b *[PageSize]byte
+	}
+)
+
+const (
+	SlotNByte = KeyOffsetNByte + KeyLenNByte + ValueLenNByte
+)
+
+func NewSlottedPage(b *[PageSize]byte) SlottedPage {
+	return SlottedPage{b}
+}
+
+// ディスクから読んだページをSlottedPageとして扱えるか確認する
+// チェックサムが合わない場合や、オフセットがページの外を指している場合はErrPageCorruptedを返す
+func (s SlottedPage) Validate() error {
+	pageID := s.PageID()
+	if binary.BigEndian.Uint32(s.b[ChecksumOffset:ChecksumOffset+4]) != pageChecksum(s.b) {
+		return &ErrPageCorrupted{pageID, "checksum mismatch"}
+	}
+	nodeType := s.NodeType()
+	if nodeType == NodeTypeFree {
+		return &ErrPageCorrupted{pageID, "page is free"}
+	}
+	if nodeType != NodeTypeBranch && nodeType != NodeTypeLeaf {
+		return &ErrPageCorrupted{pageID, fmt.Sprintf("unknown node type %d", nodeType)}
+	}
+	n := uint64(s.NumSlots())
+	dataStart := uint64(s.dataStart())
+	if HeaderNByte+n*SlotNByte > dataStart || dataStart > PageSize {
+		return &ErrPageCorrupted{pageID, fmt.Sprintf("%d slots overlap data starting at %d", n, dataStart)}
+	}
+	for i := 0; i < int(n); i++ {
+		offset, keyLen, valueLen := s.slot(i)
+		if uint64(offset) < dataStart || uint64(offset)+uint64(keyLen)+uint64(valueLen) > PageSize {
+			return &ErrPageCorrupted{pageID, fmt.Sprintf("item %d is out of page", i)}
+		}
+	}
+	return nil
+}
+
+func (s SlottedPage) PageID() PageID {
+	return PageID(binary.BigEndian.Uint32(s.b[:4]))
+}
+
+func (s SlottedPage) NodeType() NodeType {
+	return NodeType(binary.BigEndian.Uint32(s.b[NodeTypeOffset : NodeTypeOffset+4]))
+}
+
+func (s SlottedPage) ParentID() PageID {
+	return PageID(binary.BigEndian.Uint32(s.b[ParentIDOffset : ParentIDOffset+4]))
+}
+
+func (s SlottedPage) RightPointer() PageID {
+	return PageID(binary.BigEndian.Uint32(s.b[RightPointerOffset : RightPointerOffset+4]))
+}
+
+func (s SlottedPage) NumSlots() int {
+	return int(binary.BigEndian.Uint32(s.b[SlotCountOffset : SlotCountOffset+4]))
+}
+
+// i番目のキー。バッファをそのまま参照するので、書き換える前にコピーする必要がある
+func (s SlottedPage) Key(i int) Bytes {
+	offset, keyLen, _ := s.slot(i)
+	return Bytes(s.b[offset : offset+keyLen])
+}
+
+func (s SlottedPage) Value(i int) Bytes {
+	offset, keyLen, valueLen := s.slot(i)
+	return Bytes(s.b[offset+keyLen : offset+keyLen+valueLen])
+}
+
+// 先頭keyLenバイトがkey以上になる最初のスロットの位置を返す。無い場合はNumSlotsを返す
+func (s SlottedPage) Search(key Bytes, keyLen uint32) int {
+	return sort.Search(s.NumSlots(), func(i int) bool {
+		return s.Key(i).Compare(key, keyLen) != ComparisonResultSmall
+	})
+}
+
+// 中間ノードでkeyが含まれうる子のPageIDを返す
+func (s SlottedPage) Child(key Bytes, keyLen uint32) PageID {
+	if i := s.Search(key, keyLen); i < s.NumSlots() {
+		return PageID(s.Value(i).Uint32(0))
+	}
+	return s.RightPointer()
+}
+
+// Page.NBytesと同じく、空いている領域を除いて使っているバイト数を返す
+func (s SlottedPage) NBytes() uint32 {
+	n := s.NumSlots()
+	total := uint32(HeaderNByte + n*SlotNByte)
+	for i := 0; i < n; i++ {
+		_, keyLen, valueLen := s.slot(i)
+		total += keyLen + valueLen
+	}
+	return total
+}
+
+// i番目にスロットを追加する。ページに収まらない場合はfalseを返し、何も変更しない
+func (s SlottedPage) Insert(i int, key, value Bytes) bool {
+	itemLen := key.Len() + value.Len()
+	if s.NBytes()+SlotNByte+itemLen > PageSize {
+		return false
+	}
+	n := s.NumSlots()
+	if s.dataStart() < uint32(HeaderNByte+(n+1)*SlotNByte)+itemLen {
+		s.compact()
+	}
+	offset := s.dataStart() - itemLen
+	copy(s.b[offset:], key)
+	copy(s.b[offset+key.Len():], value)
+	s.setDataStart(offset)
+
+	start := HeaderNByte + i*SlotNByte
+	end := HeaderNByte + n*SlotNByte
+	copy(s.b[start+SlotNByte:end+SlotNByte], s.b[start:end])
+	s.setSlot(i, offset, key.Len(), value.Len())
+	s.setNumSlots(n + 1)
+	return true
+}
+
+// i番目のスロットを取り除く。キーとバリューの領域は次に詰めるまで残る
+func (s SlottedPage) Delete(i int) {
+	n := s.NumSlots()
+	start := HeaderNByte + i*SlotNByte
+	end := HeaderNByte + n*SlotNByte
+	copy(s.b[start:end-SlotNByte], s.b[start+SlotNByte:end])
+	s.setNumSlots(n - 1)
+	if n == 1 {
+		s.setDataStart(PageSize)
+	}
+}
+
+// 書き込む前に呼んでチェックサムを計算し直す
+func (s SlottedPage) Finish() {
+	SetPageChecksum(s.b)
+}
+
+// キーとバリューをスロットの順に末尾から詰め直す
+func (s SlottedPage) compact() {
+	n := s.NumSlots()
+	items := make([]Pair, n)
+	for i := 0; i < n; i++ {
+		items[i] = Pair{append(Bytes{}, s.Key(i)...), append(Bytes{}, s.Value(i)...)}
+	}
+	tail := uint32(PageSize)
+	for i, item := range items {
+		tail -= item.Key.Len() + item.Value.Len()
+		copy(s.b[tail:], item.Key)
+		copy(s.b[tail+item.Key.Len():], item.Value)
+		s.setSlot(i, tail, item.Key.Len(), item.Value.Len())
+	}
+	s.setDataStart(tail)
+}
+
+func (s SlottedPage) slot(i int) (offset, keyLen, valueLen uint32) {
+	start := HeaderNByte + i*SlotNByte
+	return binary.BigEndian.Uint32(s.b[start : start+4]),
+		binary.BigEndian.Uint32(s.b[start+4 : start+8]),
+		binary.BigEndian.Uint32(s.b[start+8 : start+12])
+}
+
+func (s SlottedPage) setSlot(i int, offset, keyLen, valueLen uint32) {
+	start := HeaderNByte + i*SlotNByte
+	binary.BigEndian.PutUint32(s.b[start:start+4], offset)
+	binary.BigEndian.PutUint32(s.b[start+4:start+8], keyLen)
+	binary.BigEndian.PutUint32(s.b[start+8:start+12], valueLen)
+}
+
+func (s SlottedPage) setNumSlots(n int) {
+	binary.BigEndian.PutUint32(s.b[SlotCountOffset:SlotCountOffset+4], uint32(n))
+}
+
+func (s SlottedPage) dataStart() uint32 {
+	return binary.BigEndian.Uint32(s.b[DataStartOffset : DataStartOffset+4])
+}
+
+func (s SlottedPage) setDataStart(offset uint32) {
+	binary.BigEndian.PutUint32(s.b[DataStartOffset:DataStartOffset+4], offset)
+}
@@ -0,0 +1,200 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SlottedPageのテスト", func() {
+	var (
+		b    [PageSize]byte
+		page SlottedPage
+	)
+	// 0,2,4,...,18をキーに、キーの10倍をvalueに持つleaf
+	BeforeEach(func() {
+		p := &Page{PageID: PageID(3), NodeType: NodeTypeLeaf, ParentID: PageID(1)}
+		var i uint32
+		for i = 0; i < 10; i++ {
+			p.Items = append(p.Items, Pair{NewBytes(i * 2), NewBytes(i * 20)})
+		}
+		b, _ = p.Bytes()
+		page = NewSlottedPage(&b)
+	})
+	It("Pageと同じヘッダーとitemが読める", func() {
+		Expect(page.Validate()).To(Succeed())
+		Expect(page.PageID()).To(Equal(PageID(3)))
+		Expect(page.NodeType()).To(Equal(NodeTypeLeaf))
+		Expect(page.ParentID()).To(Equal(PageID(1)))
+		Expect(page.NumSlots()).To(Equal(10))
+		Expect(page.Key(4)).To(Equal(NewBytes(8)))
+		Expect(page.Value(4)).To(Equal(NewBytes(80)))
+		p, _ := NewPage(b)
+		Expect(page.NBytes()).To(Equal(p.NBytes()))
+	})
+	Describe("Search", func() {
+		It("key以上になる最初の位置を返す", func() {
+			Expect(page.Search(NewBytes(0), ColumnSize)).To(Equal(0))
+			Expect(page.Search(NewBytes(8), ColumnSize)).To(Equal(4))
+			Expect(page.Search(NewBytes(9), ColumnSize)).To(Equal(5))
+			Expect(page.Search(NewBytes(100), ColumnSize)).To(Equal(10))
+		})
+	})
+	Describe("Insert", func() {
+		It("スロットの順にキーが並ぶ", func() {
+			Expect(page.Insert(page.Search(NewBytes(9), ColumnSize), NewBytes(9), NewBytes(90))).To(BeTrue())
+			page.Finish()
+			p, err := NewPage(b)
+			Expect(err).To(BeNil())
+			Expect(p.Items).To(HaveLen(11))
+			Expect(p.Items[5]).To(Equal(Pair{NewBytes(9), NewBytes(90)}))
+			Expect(p.Items[6]).To(Equal(Pair{NewBytes(10), NewBytes(100)}))
+		})
+		It("削除で空いた領域は詰めてから使う", func() {
+			var i uint32
+			for i = 0; page.Insert(page.NumSlots(), NewBytes(100+i), NewBytes(i)); i++ {
+			}
+			n := page.NumSlots()
+			Expect(page.NBytes() + SlotNByte + 2*ColumnSize).To(BeNumerically(">", PageSize))
+			page.Delete(0)
+			page.Delete(0)
+			Expect(page.Insert(0, NewBytes(1), NewBytes(10))).To(BeTrue())
+			page.Finish()
+			Expect(page.Validate()).To(Succeed())
+			Expect(page.NumSlots()).To(Equal(n - 1))
+			Expect(page.Key(0)).To(Equal(NewBytes(1)))
+			Expect(page.Key(1)).To(Equal(NewBytes(4)))
+			Expect(page.Value(n - 2)).To(Equal(NewBytes(i - 1)))
+		})
+		It("ページに収まらない場合はfalseを返し、何も変更しない", func() {
+			before := b
+			Expect(page.Insert(0, make(Bytes, PageSize), NewBytes(0))).To(BeFalse())
+			Expect(b).To(Equal(before))
+		})
+	})
+	Describe("Delete", func() {
+		It("全て削除すると空のleafになる", func() {
+			for page.NumSlots() > 0 {
+				page.Delete(page.NumSlots() - 1)
+			}
+			page.Finish()
+			p, err := NewPage(b)
+			Expect(err).To(BeNil())
+			Expect(p.Items).To(BeEmpty())
+			Expect(page.NBytes()).To(Equal(uint32(HeaderNByte)))
+		})
+	})
+	Describe("Validate", func() {
+		It("スロットがページの外を指している場合はErrPageCorruptedを返す", func() {
+			page.setSlot(2, PageSize-2, ColumnSize, ColumnSize)
+			page.Finish()
+			var corrupted *ErrPageCorrupted
+			Expect(errors.As(page.Validate(), &corrupted)).To(BeTrue())
+		})
+		It("スロットの数がデータの領域と重なる場合はErrPageCorruptedを返す", func() {
+			page.setNumSlots(PageSize)
+			page.Finish()
+			var corrupted *ErrPageCorrupted
+			Expect(errors.As(page.Validate(), &corrupted)).To(BeTrue())
+		})
+	})
+})
+
+// go test -bench Page で、1ページに収まるだけのitemを持つleafの検索と挿入を比べる
+// Decodeは以前のように全itemをPairにデコードして先頭から探し、Bytesで書き直す
+func BenchmarkPageSearch(b *testing.B) {
+	data, keys := fullLeaf()
+	b.Run("Decode", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			p, _ := NewPage(data)
+			key := keys[i%len(keys)]
+			for _, item := range p.Items {
+				if item.Key.Compare(key, ColumnSize) == ComparisonResultEqual {
+					break
+				}
+			}
+		}
+	})
+	b.Run("Slotted", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			page := NewSlottedPage(&data)
+			page.Validate()
+			page.Search(keys[i%len(keys)], ColumnSize)
+		}
+	})
+}
+
+func BenchmarkPageInsert(b *testing.B) {
+	data, keys := fullLeaf()
+	// 真ん中のキーを抜いておき、毎回そこに挿入する
+	mid := len(keys) / 2
+	p, _ := NewPage(data)
+	p.Items = append(p.Items[:mid], p.Items[mid+1:]...)
+	data, _ = p.Bytes()
+	key, value := keys[mid], NewBytes(0)
+	b.Run("Decode", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			p, _ := NewPage(data)
+			index := len(p.Items)
+			for j, item := range p.Items {
+				if item.Key.Compare(key, ColumnSize) == ComparisonResultBig {
+					index = j
+					break
+				}
+			}
+			p.Items = append(p.Items[:index], append([]Pair{{key, value}}, p.Items[index:]...)...)
+			p.Bytes()
+		}
+	})
+	b.Run("Slotted", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			buf := data
+			page := NewSlottedPage(&buf)
+			page.Validate()
+			page.Insert(page.Search(key, ColumnSize), key, value)
+			page.Finish()
+		}
+	})
+}
+
+// go test -bench BPlustTree で、木全体の挿入と検索の速さを測る
+func BenchmarkBPlustTree(b *testing.B) {
+	os.Setenv(BytesSizeLimitKey, strconv.Itoa(PageSize))
+	b.Run("InsertPair", func(b *testing.B) {
+		dm, _ := NewDiskManager(newCrashableFile())
+		NewTable2(dm, ColumnSize)
+		btree, _ := NewBPlustTree(dm)
+		for i := 0; i < b.N; i++ {
+			btree.InsertPair(dm, NewBytes(uint32(i)), NewBytes(uint32(i)))
+		}
+	})
+	b.Run("Get", func(b *testing.B) {
+		dm, _ := NewDiskManager(newCrashableFile())
+		NewTable2(dm, ColumnSize)
+		btree, _ := NewBPlustTree(dm)
+		const n = 10000
+		for i := 0; i < n; i++ {
+			btree.InsertPair(dm, NewBytes(uint32(i)), NewBytes(uint32(i)))
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			btree.Get(dm, NewBytes(uint32(i%n)))
+		}
+	})
+}
+
+// PageSizeに収まるだけの4バイトのキーとvalueを持つleafと、そのキーを返す
+func fullLeaf() ([PageSize]byte, []Bytes) {
+	p := &Page{PageID: PageID(1), NodeType: NodeTypeLeaf}
+	var keys []Bytes
+	for i := uint32(0); p.NBytes()+SlotNByte+2*ColumnSize <= PageSize; i++ {
+		keys = append(keys, NewBytes(i))
+		p.Items = append(p.Items, Pair{NewBytes(i), NewBytes(i)})
+	}
+	b, _ := p.Bytes()
+	return b, keys
+}
@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+)
+
+type (
+	// ページが上限を超えた時に、どこで左右に分けるか。ファイルヘッダーに書く
+	SplitPolicy uint8
+
+	// 分割の方法と、SplitPolicyRightmostAppendで左のページに残す割合
+	SplitConfig struct {
+		Policy     SplitPolicy
+		FillFactor float64 // 0の場合は1として扱う
+	}
+)
+
+const (
+	// itemの数で半分に分ける
+	SplitPolicyMidpoint SplitPolicy = iota
+	// 左右のバイト数が近くなるように分ける。valueの大きさがばらつく場合に向く
+	SplitPolicyByteBalanced
+	// 同じ深さの一番右のページで最大のキーの後ろに挿入した場合は、左のページをFillFactorまで詰めたまま残して新しいページを始める
+	// それ以外の場合はSplitPolicyMidpointと同じ
+	// 昇順に挿入する場合に、左のページが半分ずつしか使われないのを避ける
+	SplitPolicyRightmostAppend
+)
+
+var (
+	ErrInvalidSplitPolicy = errors.New("unknown split policy")
+)
+
+func (s SplitPolicy) String() string {
+	switch s {
+	case SplitPolicyMidpoint:
+		return "midpoint"
+	case SplitPolicyByteBalanced:
+		return "byte-balanced"
+	case SplitPolicyRightmostAppend:
+		return "rightmost-append"
+	}
+	return fmt.Sprintf("SplitPolicy(%d)", s)
+}
+
+// 木の分割の方法を変えてファイルヘッダーに書く。既にあるページはそのままで、以降の挿入から使う
+func (b *BPlustTree) SetSplit(dm DiskManager, split SplitConfig) error {
+	if split.Policy > SplitPolicyRightmostAppend {
+		return fmt.Errorf("%w: %d", ErrInvalidSplitPolicy, split.Policy)
+	}
+	if split.FillFactor <= 0 || split.FillFactor > 1 {
+		return fmt.Errorf("%w: %v", ErrInvalidFillFactor, split.FillFactor)
+	}
+	return b.atomically(dm, func() error {
+		header := b.header
+		header.Split = split
+		if err := header.Flush(dm); err != nil {
+			return err
+		}
+		b.header, b.Split = header, split
+		return nil
+	})
+}
+
+// FillFactorの割合でLimitBytesSizeまで詰めた時のバイト数
+// 下限を下回るページは削除の度に再分配されるので、FillFactorが小さくても下限までは詰める
+func fillTarget(fillFactor float64) uint32 {
+	if fillFactor == 0 {
+		fillFactor = 1
+	}
+	return max(HeaderNByte+uint32(float64(LimitBytesSize()-HeaderNByte)*fillFactor), MinBytesSize())
+}
+
+// 上限を超えたpのitemのうち、分割して左のページに残す数を返す。iは挿入したitemの位置
+// 大きなvalueへの置き換えでitemが2つの場合も左右どちらも空にならないように、1からlen(p.Items)-1の間に収める
+// itemの大きさがばらついていると数で分けた位置では片方が上限を超えることがあるので、その場合はバイト数で分ける
+func (c SplitConfig) splitIndex(p *Page, i int) int {
+	itemLen := len(p.Items)
+	var mid int
+	switch {
+	case c.Policy == SplitPolicyByteBalanced:
+		mid = byteBalancedIndex(p.Items)
+	case c.Policy == SplitPolicyRightmostAppend && i == itemLen-1 && p.NextPageID == InvalidPageID:
+		target := fillTarget(c.FillFactor)
+		nBytes := uint32(HeaderNByte)
+		for _, item := range p.Items {
+			nBytes += SlotNByte + item.Key.Len() + item.Value.Len()
+			if nBytes > target {
+				break
+			}
+			mid += 1
+		}
+	default:
+		mid = itemLen/2 + 1
+	}
+	if mid = min(max(mid, 1), itemLen-1); !splitFits(p.Items, mid) {
+		mid = min(max(byteBalancedIndex(p.Items), 1), itemLen-1)
+	}
+	return mid
+}
+
+// itemsをmidで分けた時に、左右どちらのページもLimitBytesSizeに収まるか
+func splitFits(items []Pair, mid int) bool {
+	l, r := Page{Items: items[:mid]}, Page{Items: items[mid:]}
+	return l.NBytes() <= LimitBytesSize() && r.NBytes() <= LimitBytesSize()
+}
+
+// 左右のitemのバイト数の差が最も小さくなる位置
+func byteBalancedIndex(items []Pair) int {
+	sizes := make([]uint32, len(items))
+	var total uint32
+	for i, item := range items {
+		sizes[i] = SlotNByte + item.Key.Len() + item.Value.Len()
+		total += sizes[i]
+	}
+	var left uint32
+	for i, size := range sizes {
+		// i番目を右に置いた場合と左に置いた場合で、差が小さい方を選ぶ
+		if (left+size)*2 >= total {
+			if total-2*left <= 2*(left+size)-total {
+				return i
+			}
+			return i + 1
+		}
+		left += size
+	}
+	return len(items)
+}
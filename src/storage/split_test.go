@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"errors"
+	"math/rand"
+	"os"
+	"strconv"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("分割の方法のテスト", func() {
+	var (
+		dm    DiskManager
+		btree *BPlustTree
+	)
+	newTree := func(split SplitConfig) {
+		dm, _ = NewDiskManager(newCrashableFile())
+		NewTable2(dm, ColumnSize)
+		btree, _ = NewBPlustTree(dm)
+		Expect(btree.SetSplit(dm, split)).To(Succeed())
+	}
+	insertSequence := func(n uint32) {
+		for i := uint32(0); i < n; i++ {
+			Expect(btree.InsertPair(dm, NewBytes(i), NewBytes(i))).To(Succeed())
+		}
+	}
+	leafStats := func() PageStats {
+		stats, err := btree.Stats(dm)
+		Expect(err).To(BeNil())
+		return stats.Leaf
+	}
+	BeforeEach(func() {
+		os.Setenv(BytesSizeLimitKey, strconv.Itoa(148))
+	})
+	It("新しいファイルはmidpointで分割する", func() {
+		dm, _ = NewDiskManager(newCrashableFile())
+		NewTable2(dm, ColumnSize)
+		btree, _ = NewBPlustTree(dm)
+		Expect(btree.Split).To(Equal(SplitConfig{SplitPolicyMidpoint, 1}))
+	})
+	It("分割の方法はファイルヘッダーに書かれ、Statsに表れる", func() {
+		newTree(SplitConfig{SplitPolicyRightmostAppend, 0.8})
+		reopened, err := NewBPlustTree(dm)
+		Expect(err).To(BeNil())
+		Expect(reopened.Split).To(Equal(SplitConfig{SplitPolicyRightmostAppend, 0.8}))
+		stats, _ := reopened.Stats(dm)
+		Expect(stats.Split).To(Equal(SplitConfig{SplitPolicyRightmostAppend, 0.8}))
+	})
+	It("範囲外の値はエラーになる", func() {
+		newTree(SplitConfig{SplitPolicyMidpoint, 1})
+		err := btree.SetSplit(dm, SplitConfig{SplitPolicyRightmostAppend + 1, 1})
+		Expect(errors.Is(err, ErrInvalidSplitPolicy)).To(BeTrue())
+		err = btree.SetSplit(dm, SplitConfig{SplitPolicyMidpoint, 0})
+		Expect(errors.Is(err, ErrInvalidFillFactor)).To(BeTrue())
+		Expect(btree.Split).To(Equal(SplitConfig{SplitPolicyMidpoint, 1}))
+	})
+	Context("昇順に挿入する場合", func() {
+		It("rightmost-appendは左のページを詰めたまま残す", func() {
+			newTree(SplitConfig{SplitPolicyMidpoint, 1})
+			insertSequence(500)
+			midpoint := leafStats()
+
+			newTree(SplitConfig{SplitPolicyRightmostAppend, 1})
+			insertSequence(500)
+			appended := leafStats()
+			Expect(appended.Pages).To(BeNumerically("<", midpoint.Pages))
+			Expect(appended.AvgFill).To(BeNumerically(">", midpoint.AvgFill))
+			// 一番右以外のleafは上限まで詰まっている
+			Expect(appended.Items[5]).To(BeNumerically(">=", appended.Pages-1))
+
+			violations, err := btree.Verify(dm)
+			Expect(err).To(BeNil())
+			Expect(violations).To(BeEmpty())
+			Expect(leafKeys(sliceOf(btree, dm))).To(HaveLen(500))
+		})
+		It("rightmost-appendはfillFactorまでしか詰めない", func() {
+			newTree(SplitConfig{SplitPolicyRightmostAppend, 0.8})
+			insertSequence(500)
+			target := fillTarget(0.8)
+			for _, p := range sliceOf(btree, dm) {
+				if p.NodeType == NodeTypeLeaf && p.NextPageID != InvalidPageID {
+					Expect(p.NBytes()).To(BeNumerically("<=", target))
+					Expect(p.IsUnderflow()).To(BeFalse())
+				}
+			}
+		})
+	})
+	It("byte-balancedは左右のバイト数が近くなる位置で分ける", func() {
+		os.Setenv(BytesSizeLimitKey, strconv.Itoa(PageSize))
+		small := Pair{NewBytes(uint32(0)), make(Bytes, 4)}
+		large := Pair{NewBytes(uint32(0)), make(Bytes, 40)}
+		// 数で分けると左が大きくなりすぎる
+		p := &Page{Items: []Pair{large, small, small, small, small, small}}
+		config := SplitConfig{SplitPolicyByteBalanced, 1}
+		Expect(config.splitIndex(p, 0)).To(Equal(2))
+		Expect(SplitConfig{SplitPolicyMidpoint, 1}.splitIndex(p, 0)).To(Equal(4))
+		Expect(config.splitIndex(&Page{Items: []Pair{large, small}}, 0)).To(Equal(1))
+	})
+	Context("rightmost-appendで大きなvalueを挿入する場合", func() {
+		BeforeEach(func() {
+			os.Setenv(BytesSizeLimitKey, strconv.Itoa(PageSize))
+		})
+		It("fillFactorまで詰めると右のページが上限を超える場合はバイト数で分ける", func() {
+			small := Pair{NewBytes(uint32(0)), make(Bytes, 4)}
+			large := Pair{NewBytes(uint32(1)), make(Bytes, 2020)}
+			appended := Pair{NewBytes(uint32(2)), make(Bytes, 2020)}
+			p := &Page{Items: []Pair{small, large, appended}}
+			// fillFactorで詰めるとsmallだけが左に残り、右の2つは上限を超える
+			Expect(splitFits(p.Items, 1)).To(BeFalse())
+			Expect(SplitConfig{SplitPolicyRightmostAppend, 0.5}.splitIndex(p, 2)).To(Equal(2))
+		})
+		It("昇順に挿入しても全てのページが上限に収まる", func() {
+			newTree(SplitConfig{SplitPolicyRightmostAppend, 0.5})
+			r := rand.New(rand.NewSource(1))
+			for i := uint32(0); i < 300; i++ {
+				value := make(Bytes, 10+r.Intn(1000))
+				Expect(btree.InsertPair(dm, NewBytes(i), value)).To(Succeed())
+			}
+			for _, p := range sliceOf(btree, dm) {
+				Expect(p.NBytes()).To(BeNumerically("<=", PageSize))
+			}
+			violations, err := btree.Verify(dm)
+			Expect(err).To(BeNil())
+			Expect(violations).To(BeEmpty())
+			Expect(leafKeys(sliceOf(btree, dm))).To(HaveLen(300))
+		})
+	})
+	for _, policy := range []SplitPolicy{SplitPolicyMidpoint, SplitPolicyByteBalanced, SplitPolicyRightmostAppend} {
+		policy := policy
+		It(policy.String()+"でランダムに挿入・削除しても木が壊れない", func() {
+			newTree(SplitConfig{policy, 0.9})
+			r := rand.New(rand.NewSource(1))
+			keys := r.Perm(400)
+			for _, k := range keys {
+				value := make(Bytes, r.Intn(24))
+				Expect(btree.InsertPair(dm, NewBytes(uint32(k)), value)).To(Succeed())
+			}
+			for _, k := range keys[:150] {
+				Expect(btree.Delete(dm, NewBytes(uint32(k)))).To(Succeed())
+			}
+			violations, err := btree.Verify(dm)
+			Expect(err).To(BeNil())
+			Expect(violations).To(BeEmpty())
+			Expect(leafKeys(sliceOf(btree, dm))).To(HaveLen(250))
+		})
+	}
+})
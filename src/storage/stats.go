@@ -0,0 +1,102 @@
+package storage
+
+type (
+	// 中間ノードかleafのどちらか一方のページの統計
+	PageStats struct {
+		Pages    uint32
+		MinBytes uint32 // ページが無い場合は0
+		MaxBytes uint32
+		AvgBytes float64
+		// MinBytes・MaxBytes・AvgBytesのLimitBytesSizeに対する割合
+		MinFill float64
+		MaxFill float64
+		AvgFill float64
+		// itemの数ごとのページ数。中間ノードのRightPointerは数えない
+		Items map[int]uint32
+
+		totalBytes uint64
+	}
+
+	// Statsが返す木全体の統計
+	TreeStats struct {
+		Height     uint32
+		KeyCount   uint64 // leafのitemを数えた数
+		LimitBytes uint32 // 集計した時のLimitBytesSize
+		Split      SplitConfig
+		Branch     PageStats
+		Leaf       PageStats
+	}
+)
+
+// rootから全てのページを辿って、ページの数や使っているバイト数を集計する
+// ページはデコードせずにバッファのまま読むので、Sliceのように全てのページを持っておくことはない
+func (b *BPlustTree) Stats(dm DiskManager) (TreeStats, error) {
+	stats := TreeStats{
+		LimitBytes: LimitBytesSize(),
+		Split:      b.Split,
+		Branch:     PageStats{Items: map[int]uint32{}},
+		Leaf:       PageStats{Items: map[int]uint32{}},
+	}
+	if b.RootNodeID == InvalidPageID {
+		return stats, nil
+	}
+	type entry struct {
+		pageID PageID
+		depth  uint32
+	}
+	stack := []entry{{b.RootNodeID, 0}}
+	for len(stack) > 0 {
+		e := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		page, err := readSlottedPage(dm, e.pageID)
+		if err != nil {
+			return TreeStats{}, err
+		}
+		if e.depth+1 > stats.Height {
+			stats.Height = e.depth + 1
+		}
+		n := page.NumSlots()
+		if page.NodeType() == NodeTypeLeaf {
+			stats.Leaf.add(page.NBytes(), n)
+			stats.KeyCount += uint64(n)
+			continue
+		}
+		stats.Branch.add(page.NBytes(), n)
+		if rightPointer := page.RightPointer(); rightPointer != InvalidPageID {
+			stack = append(stack, entry{rightPointer, e.depth + 1})
+		}
+		for i := n - 1; i >= 0; i-- {
+			stack = append(stack, entry{PageID(page.Value(i).Uint32(0)), e.depth + 1})
+		}
+	}
+	stats.Branch.finish(stats.LimitBytes)
+	stats.Leaf.finish(stats.LimitBytes)
+	return stats, nil
+}
+
+// 全てのページの数
+func (s TreeStats) Pages() uint32 {
+	return s.Branch.Pages + s.Leaf.Pages
+}
+
+func (s *PageStats) add(nBytes uint32, items int) {
+	if s.Pages == 0 || nBytes < s.MinBytes {
+		s.MinBytes = nBytes
+	}
+	if nBytes > s.MaxBytes {
+		s.MaxBytes = nBytes
+	}
+	s.Pages += 1
+	s.totalBytes += uint64(nBytes)
+	s.Items[items] += 1
+}
+
+func (s *PageStats) finish(limit uint32) {
+	if s.Pages == 0 {
+		return
+	}
+	s.AvgBytes = float64(s.totalBytes) / float64(s.Pages)
+	s.MinFill = float64(s.MinBytes) / float64(limit)
+	s.MaxFill = float64(s.MaxBytes) / float64(limit)
+	s.AvgFill = s.AvgBytes / float64(limit)
+}
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"os"
+	"strconv"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Statsのテスト", func() {
+	var (
+		dm    DiskManager
+		btree *BPlustTree
+	)
+	BeforeEach(func() {
+		os.Setenv(BytesSizeLimitKey, strconv.Itoa(148))
+		dm, _ = NewDiskManager(newCrashableFile())
+		NewTable2(dm, ColumnSize)
+		btree, _ = NewBPlustTree(dm)
+	})
+	It("Sliceで数えた結果と一致する", func() {
+		for i := uint32(0); i < 300; i++ {
+			Expect(btree.InsertPair(dm, NewBytes(i*7%300), NewBytes(i))).To(Succeed())
+		}
+		for i := uint32(0); i < 300; i += 4 {
+			Expect(btree.Delete(dm, NewBytes(i))).To(Succeed())
+		}
+		stats, err := btree.Stats(dm)
+		Expect(err).To(BeNil())
+
+		var leaf, branch PageStats
+		leaf.Items, branch.Items = map[int]uint32{}, map[int]uint32{}
+		for _, p := range sliceOf(btree, dm) {
+			if p.NodeType == NodeTypeLeaf {
+				leaf.add(p.NBytes(), len(p.Items))
+			} else {
+				branch.add(p.NBytes(), len(p.Items))
+			}
+		}
+		Expect(stats.Height).To(Equal(btree.Height))
+		Expect(stats.KeyCount).To(Equal(btree.KeyCount))
+		Expect(stats.LimitBytes).To(Equal(uint32(148)))
+		Expect(stats.Leaf.Pages).To(Equal(leaf.Pages))
+		Expect(stats.Leaf.Items).To(Equal(leaf.Items))
+		Expect(stats.Leaf.MinBytes).To(Equal(leaf.MinBytes))
+		Expect(stats.Leaf.MaxBytes).To(Equal(leaf.MaxBytes))
+		Expect(stats.Branch.Pages).To(Equal(branch.Pages))
+		Expect(stats.Branch.Items).To(Equal(branch.Items))
+		Expect(stats.Pages()).To(Equal(leaf.Pages + branch.Pages))
+
+		Expect(stats.Leaf.AvgBytes).To(BeNumerically(">=", float64(stats.Leaf.MinBytes)))
+		Expect(stats.Leaf.AvgBytes).To(BeNumerically("<=", float64(stats.Leaf.MaxBytes)))
+		Expect(stats.Leaf.MaxFill).To(BeNumerically("~", float64(stats.Leaf.MaxBytes)/148))
+	})
+	It("空の木は全て0になる", func() {
+		stats, err := btree.Stats(dm)
+		Expect(err).To(BeNil())
+		Expect(stats.Height).To(Equal(uint32(0)))
+		Expect(stats.Pages()).To(Equal(uint32(0)))
+		Expect(stats.Leaf.AvgFill).To(Equal(0.0))
+	})
+	It("BulkLoadのfillFactorが平均の充填率に表れる", func() {
+		pairs := make([]Pair, 1000)
+		for i := range pairs {
+			pairs[i] = Pair{NewBytes(uint32(i)), NewBytes(uint32(i))}
+		}
+		Expect(btree.BulkLoad(dm, NewPairIterator(pairs), 1)).To(Succeed())
+		stats, err := btree.Stats(dm)
+		Expect(err).To(BeNil())
+		Expect(stats.KeyCount).To(Equal(uint64(1000)))
+		Expect(stats.Leaf.AvgFill).To(BeNumerically(">", 0.9))
+		Expect(stats.Leaf.Items).To(HaveKey(5))
+	})
+})
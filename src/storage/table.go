@@ -1,29 +1,76 @@
 package storage
 
 import (
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"os"
 )
 
 type ()
 
-func NewTable(fName string, keyLen uint32) {
+var (
+	ErrInvalidKeyLen = errors.New("invalid key length")
+)
+
+func NewTable(fName string, keyLen uint32) error {
 	f, err := os.Create(fmt.Sprintf("../../table/%s", fName))
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	dm := NewDiskManager(f)
-	// メタデータを先頭4KBに書き込む
-	var b [PageSize]byte
-	binary.NativeEndian.PutUint32(b[:4], keyLen)
-	dm.WritePageData(dm.AllocatePage(), b)
+	dm, err := NewDiskManager(f)
+	if err != nil {
+		return err
+	}
+	if err := NewTable2(dm, keyLen); err != nil {
+		dm.Close()
+		return err
+	}
+	return dm.Close()
 }
 
-func NewTable2(dm DiskManager, keyLen uint32) {
-	// メタデータを先頭4KBに書き込む
-	var b [PageSize]byte
-	binary.NativeEndian.PutUint32(b[:4], keyLen)
-	dm.WritePageData(dm.AllocatePage(), b)
+func NewTable2(dm DiskManager, keyLen uint32) error {
+	return NewNonUniqueTable(dm, keyLen, 0)
+}
+
+// 重複キーを許すインデックス用のテーブルを作成する
+// 木の中ではキーの後ろにrowIDLenバイトの行IDを付けて一意なキーとして扱う
+// keyLenが0の場合や、行IDを付けたキーが1つのpairとしてleafに書けない長さの場合はErrInvalidKeyLenを返す
+func NewNonUniqueTable(dm DiskManager, keyLen, rowIDLen uint32) error {
+	if keyLen == 0 {
+		return fmt.Errorf("%w: %d", ErrInvalidKeyLen, keyLen)
+	}
+	if err := validateInternalKeyLen(keyLen, rowIDLen); err != nil {
+		return err
+	}
+	// ファイルヘッダーを先頭4KBに書き込む
+	return dm.WritePageData(dm.AllocatePage(), NewFileHeader(keyLen, rowIDLen).Bytes())
+}
+
+// 型付きのキーを持つテーブルを作成する。キーはschema.Encodeで作る
+// rowIDLenが0より大きい場合は重複キーを許す
+func NewTypedTable(dm DiskManager, schema KeySchema, rowIDLen uint32) error {
+	if len(schema) == 0 || len(schema) > KeySchemaMaxColumns {
+		return fmt.Errorf("%w: %d columns", ErrKeySchemaMismatch, len(schema))
+	}
+	// 可変長のキーの長さは挿入する時に確かめるので、行IDの長さだけを確かめる
+	fixedLen := schema.KeyLen()
+	if fixedLen == VariableKeyLen {
+		fixedLen = 0
+	}
+	if err := validateInternalKeyLen(fixedLen, rowIDLen); err != nil {
+		return err
+	}
+	header := NewFileHeader(schema.KeyLen(), rowIDLen)
+	header.KeySchema = schema
+	return dm.WritePageData(dm.AllocatePage(), header.Bytes())
+}
+
+// 行IDを付けたキーとオーバーフローページへの参照が、1つのpairとしてleafに書けるか
+// 書けない場合は挿入が全てErrKeyTooLargeになるので、作る時点で弾く
+func validateInternalKeyLen(keyLen, rowIDLen uint32) error {
+	if uint64(SlotNByte)+uint64(keyLen)+uint64(rowIDLen)+OverflowRefNByte > MaxInlinePairNByte {
+		return fmt.Errorf("%w: key %d bytes + row ID %d bytes", ErrInvalidKeyLen, keyLen, rowIDLen)
+	}
+	return nil
 }
@@ -0,0 +1,363 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+type (
+	TxnID uint64
+
+	UndoOp uint8
+
+	// トランザクションの中で木に行った変更を1つ取り消すための情報
+	undoEntry struct {
+		lsn   LSN
+		op    UndoOp
+		key   Bytes
+		value Bytes // 削除・更新する前のvalue
+	}
+
+	// WALDiskManagerの上でBPlustTreeへの変更をトランザクションとしてまとめる
+	// 変更するたびに取り消すための情報をページと同じ単位でログに書いておき、Abortやクラッシュ後の復旧では逆の操作で取り消す
+	// 取り消した時はCLRを書くので、取り消しの途中でクラッシュしても同じ変更を2回取り消すことはない
+	// 変更・参照したキーはCommitかAbortまでロックし、他のトランザクションが同じキーを触るとErrTxnConflictを返す
+	TransactionManager struct {
+		dm        *WALDiskManager
+		tree      *BPlustTree
+		nextTxnID TxnID
+		active    map[TxnID]*Txn
+		locks     map[string]TxnID // キーごとにロックしているトランザクション
+	}
+
+	Txn struct {
+		ID    TxnID
+		tm    *TransactionManager
+		undos []undoEntry // 古い順
+		keys  []string    // ロックしているキー
+		done  bool
+	}
+)
+
+const (
+	UndoOpInsert UndoOp = iota // 挿入したキーを削除して取り消す
+	UndoOpDelete               // 削除したキーを元のvalueで挿入し直して取り消す
+	UndoOpUpdate               // 更新したキーのvalueを元に戻して取り消す
+)
+
+var (
+	ErrTxnFinished = errors.New("transaction already finished")
+	ErrTxnConflict = errors.New("key is locked by another transaction")
+)
+
+// ログを読み、CommitもAbortもされずに終わったトランザクションの変更を取り消す
+// dmはNewWALDiskManagerでページを戻した後のものを、treeはそのdmから作ったものを渡す
+func NewTransactionManager(dm *WALDiskManager, tree *BPlustTree) (*TransactionManager, error) {
+	tm := &TransactionManager{
+		dm:        dm,
+		tree:      tree,
+		nextTxnID: 1,
+		active:    map[TxnID]*Txn{},
+		locks:     map[string]TxnID{},
+	}
+	if err := tm.recover(); err != nil {
+		return nil, err
+	}
+	dm.activeTxns = tm.firstLSNs
+	return tm, nil
+}
+
+func (tm *TransactionManager) Begin() *Txn {
+	txn := &Txn{
+		ID: tm.nextTxnID,
+		tm: tm,
+	}
+	tm.nextTxnID += 1
+	tm.active[txn.ID] = txn
+	return txn
+}
+
+// 実行中のトランザクションのIDを昇順に返す
+func (tm *TransactionManager) Active() []TxnID {
+	ids := []TxnID{}
+	for id := range tm.active {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// 実行中のトランザクションごとに最初のUndoのLSNを返す。まだ何も変更していないものは含めない
+// 取り消しに使うので、チェックポイントでこれより新しいセグメントは削除しない
+func (tm *TransactionManager) firstLSNs() map[TxnID]LSN {
+	lsns := map[TxnID]LSN{}
+	for id, txn := range tm.active {
+		if len(txn.undos) > 0 {
+			lsns[id] = txn.undos[0].lsn
+		}
+	}
+	return lsns
+}
+
+// チェックポイントより前のセグメントが削除されていても、実行中だったトランザクションのレコードは残っている
+// 取り消しの途中で終わっていた場合は、最後のCLRが指すUndoから続きを取り消す
+func (tm *TransactionManager) recover() error {
+	losers := map[TxnID]*Txn{}
+	err := tm.dm.wal.ForEach(0, func(record LogRecord) error {
+		if record.Type < LogRecordTypeUndo {
+			return nil
+		}
+		id := decodeTxnID(record.Data)
+		if id >= tm.nextTxnID {
+			tm.nextTxnID = id + 1
+		}
+		txn, ok := losers[id]
+		if !ok {
+			txn = &Txn{ID: id, tm: tm}
+			losers[id] = txn
+		}
+		switch record.Type {
+		case LogRecordTypeUndo:
+			_, entry := decodeUndo(record)
+			txn.undos = append(txn.undos, entry)
+		case LogRecordTypeCLR:
+			undoNext := LSN(binary.BigEndian.Uint64(record.Data[8:16]))
+			for len(txn.undos) > 0 && txn.undos[len(txn.undos)-1].lsn > undoNext {
+				txn.undos = txn.undos[:len(txn.undos)-1]
+			}
+		case LogRecordTypeTxnCommit, LogRecordTypeTxnAbort:
+			delete(losers, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// 同じキーを触った変更が戻る順番を守るため、全てのトランザクションの変更を合わせて新しいものから取り消す
+	for {
+		var latest *Txn
+		for _, txn := range losers {
+			if len(txn.undos) > 0 && (latest == nil || txn.lastLSN() > latest.lastLSN()) {
+				latest = txn
+			}
+		}
+		if latest == nil {
+			break
+		}
+		if err := latest.undoLast(); err != nil {
+			return err
+		}
+	}
+	ids := []TxnID{}
+	for id := range losers {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		tm.active[id] = losers[id]
+		if err := losers[id].finish(LogRecordTypeTxnAbort); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// entryの逆の操作を行う
+// ロックを取る前のログやトランザクションを使わない変更で、キーが既に無い・既にある場合も、元の状態になるように取り消す
+func (tm *TransactionManager) undo(entry undoEntry) error {
+	switch entry.op {
+	case UndoOpInsert:
+		if err := tm.tree.Delete(tm.dm, entry.key); !errors.Is(err, ErrKeyNotFound) {
+			return err
+		}
+		return nil
+	case UndoOpDelete:
+		if err := tm.tree.InsertPair(tm.dm, entry.key, entry.value); !errors.Is(err, ErrDuplicateKey) {
+			return err
+		}
+		return tm.tree.Update(tm.dm, entry.key, entry.value)
+	default:
+		if err := tm.tree.Update(tm.dm, entry.key, entry.value); !errors.Is(err, ErrKeyNotFound) {
+			return err
+		}
+		return tm.tree.InsertPair(tm.dm, entry.key, entry.value)
+	}
+}
+
+// 他のトランザクションがキーをロックしている場合はErrTxnConflictを返す
+func (t *Txn) InsertPair(key, value Bytes) error {
+	if err := t.lock(key); err != nil {
+		return err
+	}
+	return t.apply(undoEntry{op: UndoOpInsert, key: key}, func() error {
+		return t.tm.tree.InsertPair(t.tm.dm, key, value)
+	})
+}
+
+// キーが存在しない場合はErrKeyNotFoundを、他のトランザクションがキーをロックしている場合はErrTxnConflictを返す
+func (t *Txn) Update(key, value Bytes) error {
+	old, err := t.get(key)
+	if err != nil {
+		return err
+	}
+	return t.apply(undoEntry{op: UndoOpUpdate, key: key, value: old}, func() error {
+		return t.tm.tree.Update(t.tm.dm, key, value)
+	})
+}
+
+// キーが存在しない場合はErrKeyNotFoundを、他のトランザクションがキーをロックしている場合はErrTxnConflictを返す
+func (t *Txn) Delete(key Bytes) error {
+	old, err := t.get(key)
+	if err != nil {
+		return err
+	}
+	return t.apply(undoEntry{op: UndoOpDelete, key: key, value: old}, func() error {
+		return t.tm.tree.Delete(t.tm.dm, key)
+	})
+}
+
+// Commitを書いてfsyncした時点で、このトランザクションの変更はクラッシュしても取り消されない
+func (t *Txn) Commit() error {
+	return t.finish(LogRecordTypeTxnCommit)
+}
+
+// 変更を新しい順に取り消す
+// 1つ取り消すたびに逆の操作のページとCLRを同じ単位でログに書くので、途中で失敗しても復旧時に残りだけが取り消される
+func (t *Txn) Abort() error {
+	if t.done {
+		return ErrTxnFinished
+	}
+	for len(t.undos) > 0 {
+		if err := t.undoLast(); err != nil {
+			return err
+		}
+	}
+	return t.finish(LogRecordTypeTxnAbort)
+}
+
+// 最後の変更を取り消し、逆の操作のページとCLRを同じ単位でログに書く
+func (t *Txn) undoLast() error {
+	entry := t.undos[len(t.undos)-1]
+	var undoNext LSN
+	if len(t.undos) > 1 {
+		undoNext = t.undos[len(t.undos)-2].lsn
+	}
+	err := t.tm.tree.atomically(t.tm.dm, func() error {
+		if err := t.tm.undo(entry); err != nil {
+			return err
+		}
+		data := binary.BigEndian.AppendUint64(encodeTxnID(t.ID), uint64(undoNext))
+		t.tm.dm.wal.append(LogRecordTypeCLR, InvalidPageID, data)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	t.undos = t.undos[:len(t.undos)-1]
+	return nil
+}
+
+func (t *Txn) lastLSN() LSN {
+	return t.undos[len(t.undos)-1].lsn
+}
+
+// keyを他のトランザクションがロックしていなければ、このトランザクションでロックする
+func (t *Txn) lock(key Bytes) error {
+	if t.done {
+		return ErrTxnFinished
+	}
+	owner, ok := t.tm.locks[string(key)]
+	if ok && owner != t.ID {
+		return ErrTxnConflict
+	}
+	if !ok {
+		t.tm.locks[string(key)] = t.ID
+		t.keys = append(t.keys, string(key))
+	}
+	return nil
+}
+
+// fnで木を変更し、成功した場合は取り消すための情報をページと同じ単位でログに書く
+// ログに書けなかった場合は、木の中の変更と同じくメモリ上のキーの数なども元に戻す
+func (t *Txn) apply(entry undoEntry, fn func() error) error {
+	if t.done {
+		return ErrTxnFinished
+	}
+	err := t.tm.tree.atomically(t.tm.dm, func() error {
+		if err := fn(); err != nil {
+			return err
+		}
+		entry.lsn = t.tm.dm.wal.append(LogRecordTypeUndo, InvalidPageID, encodeUndo(t.ID, entry))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	t.undos = append(t.undos, entry)
+	return nil
+}
+
+func (t *Txn) get(key Bytes) (Bytes, error) {
+	if err := t.lock(key); err != nil {
+		return nil, err
+	}
+	value, found, err := t.tm.tree.Get(t.tm.dm, key)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrKeyNotFound
+	}
+	return value, nil
+}
+
+func (t *Txn) finish(recordType LogRecordType) error {
+	if t.done {
+		return ErrTxnFinished
+	}
+	err := t.tm.dm.Atomic(func() error {
+		t.tm.dm.wal.append(recordType, InvalidPageID, encodeTxnID(t.ID))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	t.done = true
+	delete(t.tm.active, t.ID)
+	for _, key := range t.keys {
+		delete(t.tm.locks, key)
+	}
+	t.keys = nil
+	return nil
+}
+
+func encodeTxnID(id TxnID) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(id))
+}
+
+func decodeTxnID(data []byte) TxnID {
+	return TxnID(binary.BigEndian.Uint64(data[:8]))
+}
+
+// TxnID(8) + 操作(1) + キーの長さ(4) + キー + value
+func encodeUndo(id TxnID, entry undoEntry) []byte {
+	data := encodeTxnID(id)
+	data = append(data, byte(entry.op))
+	data = binary.BigEndian.AppendUint32(data, entry.key.Len())
+	data = append(data, entry.key...)
+	return append(data, entry.value...)
+}
+
+func decodeUndo(record LogRecord) (TxnID, undoEntry) {
+	keyLen := binary.BigEndian.Uint32(record.Data[9:13])
+	entry := undoEntry{
+		lsn: record.LSN,
+		op:  UndoOp(record.Data[8]),
+		key: Bytes(record.Data[13 : 13+keyLen]),
+	}
+	if value := record.Data[13+keyLen:]; len(value) > 0 {
+		entry.value = Bytes(value)
+	}
+	return decodeTxnID(record.Data), entry
+}
@@ -0,0 +1,217 @@
+package storage
+
+import (
+	"os"
+	"strconv"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("トランザクションのテスト", func() {
+	var (
+		dataFile *crashableFile
+		logFile  *crashableFile
+		dm       *WALDiskManager
+		btree    *BPlustTree
+		tm       *TransactionManager
+		txn      *Txn
+	)
+	open := func() {
+		disk, err := NewDiskManagerWithSyncMode(dataFile, SyncModeAlways)
+		Expect(err).To(BeNil())
+		wal, err := NewWAL(newMemLogStore(logFile))
+		Expect(err).To(BeNil())
+		dm, err = NewWALDiskManager(disk, wal)
+		Expect(err).To(BeNil())
+		btree, err = NewBPlustTree(dm)
+		Expect(err).To(BeNil())
+		tm, err = NewTransactionManager(dm, btree)
+		Expect(err).To(BeNil())
+	}
+	crashAndReopen := func() {
+		dataFile.crash()
+		logFile.crash()
+		open()
+	}
+	// 0~6が元のvalueのまま残っていて、木が壊れていないことを確認する
+	expectOriginal := func() {
+		res := sliceOf(btree, dm)
+		Expect(leafKeys(res)).To(Equal([]uint32{0, 1, 2, 3, 4, 5, 6}))
+		assertLinks(res)
+		var i uint32
+		for i = 0; i < 7; i++ {
+			value, _, _ := btree.Get(dm, NewBytes(i))
+			Expect(value).To(Equal(NewBytes(i)))
+		}
+	}
+	// 分割が起きるように7~29を挿入し、既存のキーを削除・更新する
+	modify := func() {
+		var i uint32
+		for i = 7; i < 30; i++ {
+			Expect(txn.InsertPair(NewBytes(i), NewBytes(i))).To(Succeed())
+		}
+		Expect(txn.Delete(NewBytes(2))).To(Succeed())
+		Expect(txn.Update(NewBytes(5), NewBytes(500))).To(Succeed())
+		Expect(txn.Delete(NewBytes(8))).To(Succeed())
+	}
+	BeforeEach(func() {
+		os.Setenv(BytesSizeLimitKey, strconv.Itoa(84))
+		dataFile = newCrashableFile()
+		logFile = newCrashableFile()
+		disk, _ := NewDiskManagerWithSyncMode(dataFile, SyncModeAlways)
+		wal, _ := NewWAL(newMemLogStore(logFile))
+		dm, _ = NewWALDiskManager(disk, wal)
+		NewTable2(dm, ColumnSize)
+		btree, _ = NewBPlustTree(dm)
+		var i uint32
+		for i = 0; i < 7; i++ {
+			Expect(btree.InsertPair(dm, NewBytes(i), NewBytes(i))).To(Succeed())
+		}
+		tm, _ = NewTransactionManager(dm, btree)
+		txn = tm.Begin()
+	})
+	Describe("Commit", func() {
+		It("クラッシュしても変更が残る", func() {
+			modify()
+			Expect(tm.Active()).To(Equal([]TxnID{txn.ID}))
+			Expect(txn.Commit()).To(Succeed())
+			Expect(tm.Active()).To(BeEmpty())
+
+			crashAndReopen()
+			res := sliceOf(btree, dm)
+			Expect(leafKeys(res)).NotTo(ContainElements(uint32(2), uint32(8)))
+			Expect(leafKeys(res)).To(HaveLen(28))
+			value, _, _ := btree.Get(dm, NewBytes(5))
+			Expect(value).To(Equal(NewBytes(500)))
+			assertLinks(res)
+		})
+		It("終わったトランザクションは使えない", func() {
+			Expect(txn.Commit()).To(Succeed())
+			Expect(txn.InsertPair(NewBytes(7), NewBytes(7))).To(Equal(ErrTxnFinished))
+			Expect(txn.Abort()).To(Equal(ErrTxnFinished))
+		})
+	})
+	Describe("Abort", func() {
+		It("挿入・削除・更新が全て取り消される", func() {
+			modify()
+			Expect(txn.Abort()).To(Succeed())
+			expectOriginal()
+		})
+		It("失敗した操作は取り消す対象にならない", func() {
+			Expect(txn.InsertPair(NewBytes(1), NewBytes(100))).To(Equal(ErrDuplicateKey))
+			Expect(txn.Delete(NewBytes(100))).To(Equal(ErrKeyNotFound))
+			Expect(txn.Abort()).To(Succeed())
+			expectOriginal()
+		})
+		It("他のトランザクションの変更は取り消されない", func() {
+			other := tm.Begin()
+			Expect(other.InsertPair(NewBytes(100), NewBytes(100))).To(Succeed())
+			Expect(other.Commit()).To(Succeed())
+			modify()
+			Expect(txn.Abort()).To(Succeed())
+			_, found, _ := btree.Get(dm, NewBytes(100))
+			Expect(found).To(BeTrue())
+		})
+	})
+	Describe("ロック", func() {
+		It("他のトランザクションが触ったキーはErrTxnConflictになる", func() {
+			Expect(txn.InsertPair(NewBytes(100), NewBytes(100))).To(Succeed())
+			Expect(txn.Update(NewBytes(1), NewBytes(10))).To(Succeed())
+			other := tm.Begin()
+			Expect(other.Delete(NewBytes(100))).To(Equal(ErrTxnConflict))
+			Expect(other.InsertPair(NewBytes(100), NewBytes(100))).To(Equal(ErrTxnConflict))
+			Expect(other.Update(NewBytes(1), NewBytes(11))).To(Equal(ErrTxnConflict))
+			Expect(other.Update(NewBytes(0), NewBytes(11))).To(Succeed())
+
+			// 終わるとロックが外れる
+			Expect(txn.Commit()).To(Succeed())
+			Expect(other.Delete(NewBytes(100))).To(Succeed())
+			Expect(other.Commit()).To(Succeed())
+			_, found, _ := btree.Get(dm, NewBytes(100))
+			Expect(found).To(BeFalse())
+		})
+		It("挿入したキーを他のトランザクションが削除できないので、クラッシュしても開き直せる", func() {
+			Expect(txn.InsertPair(NewBytes(100), NewBytes(100))).To(Succeed())
+			other := tm.Begin()
+			Expect(other.Delete(NewBytes(100))).To(Equal(ErrTxnConflict))
+			Expect(other.Commit()).To(Succeed())
+			crashAndReopen()
+			expectOriginal()
+		})
+	})
+	Describe("クラッシュからの復旧", func() {
+		Context("Commitする前にクラッシュした場合", func() {
+			It("変更が取り消される", func() {
+				modify()
+				crashAndReopen()
+				expectOriginal()
+				Expect(tm.Active()).To(BeEmpty())
+
+				// 取り消しが終わっているので開き直しても同じ状態になる
+				crashAndReopen()
+				expectOriginal()
+				Expect(tm.Begin().ID).To(BeNumerically(">", txn.ID))
+			})
+		})
+		Context("取り消すキーがトランザクションの外で変更されていた場合", func() {
+			It("元の状態に戻す", func() {
+				Expect(txn.InsertPair(NewBytes(100), NewBytes(100))).To(Succeed())
+				Expect(txn.Delete(NewBytes(2))).To(Succeed())
+				Expect(txn.Update(NewBytes(5), NewBytes(500))).To(Succeed())
+				Expect(btree.Delete(dm, NewBytes(100))).To(Succeed())
+				Expect(btree.InsertPair(dm, NewBytes(2), NewBytes(200))).To(Succeed())
+				Expect(btree.Delete(dm, NewBytes(5))).To(Succeed())
+				crashAndReopen()
+				expectOriginal()
+			})
+		})
+		Context("複数のトランザクションが途中だった場合", func() {
+			It("全てのトランザクションの変更を合わせて新しい順に取り消す", func() {
+				other := tm.Begin()
+				Expect(txn.InsertPair(NewBytes(100), NewBytes(100))).To(Succeed())
+				Expect(other.InsertPair(NewBytes(101), NewBytes(101))).To(Succeed())
+				Expect(txn.InsertPair(NewBytes(102), NewBytes(102))).To(Succeed())
+				crashAndReopen()
+				expectOriginal()
+				Expect(tm.Active()).To(BeEmpty())
+				undone := []TxnID{}
+				dm.wal.ForEach(0, func(record LogRecord) error {
+					if record.Type == LogRecordTypeCLR {
+						undone = append(undone, decodeTxnID(record.Data))
+					}
+					return nil
+				})
+				Expect(undone).To(Equal([]TxnID{txn.ID, other.ID, txn.ID}))
+			})
+		})
+		Context("Abortの途中でクラッシュした場合", func() {
+			It("CLRの続きから取り消され、元の状態に戻る", func() {
+				modify()
+				dataDurable := append([]byte{}, dataFile.durable...)
+				logDurable := append([]byte{}, logFile.durable...)
+				for n := 0; ; n++ {
+					dataFile.durable = append([]byte{}, dataDurable...)
+					logFile.durable = append([]byte{}, logDurable...)
+					dataFile.crash()
+					logFile.crash()
+					disk, _ := NewDiskManagerWithSyncMode(dataFile, SyncModeAlways)
+					wal, _ := NewWAL(newMemLogStore(logFile))
+					dm, _ = NewWALDiskManager(disk, wal)
+					btree, _ = NewBPlustTree(dm)
+					// 取り消しを始める前の状態を作るため、復旧はせずに中断したトランザクションを作り直す
+					tm = &TransactionManager{dm: dm, tree: btree, nextTxnID: txn.ID + 1, active: map[TxnID]*Txn{}, locks: map[string]TxnID{}}
+					restarted := &Txn{ID: txn.ID, tm: tm, undos: txn.undos}
+
+					logFile.writesLeft = n
+					err := restarted.Abort()
+					crashAndReopen()
+					expectOriginal()
+					if err == nil {
+						break
+					}
+				}
+			})
+		})
+	})
+})
@@ -0,0 +1,177 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+)
+
+type (
+	ViolationKind uint8
+
+	// Verifyが見つけた木の不整合
+	Violation struct {
+		Kind   ViolationKind
+		PageID PageID
+		Detail string
+	}
+
+	// Verifyの途中経過。depthごとに左から順にページを持ち、PrevPageID・NextPageIDの確認に使う
+	verifier struct {
+		dm        DiskManager
+		keyLen    uint32
+		visited   map[PageID]bool
+		levels    [][]*Page
+		leafDepth int32
+		res       []Violation
+	}
+)
+
+const (
+	ViolationCorruptedPage      ViolationKind = iota + 1 // チェックサムが合わないなどで読めない
+	ViolationNodeType                                    // 木から中間ノードでもleafでもないページを指している
+	ViolationUnsortedKeys                                // ページ内のキーが昇順でない
+	ViolationSeparator                                   // 子のキーが親のseparatorで決まる範囲に収まっていない
+	ViolationParentID                                    // 子のParentIDが親を指していない
+	ViolationSiblingLink                                 // 同じ深さのPrevPageID・NextPageIDが左右のページと一致しない
+	ViolationLeafDepth                                   // leafの深さが揃っていない
+	ViolationDuplicateReference                          // 同じページに複数の経路から辿り着く
+	ViolationPageTooLarge                                // LimitBytesSizeを超えている
+)
+
+func (k ViolationKind) String() string {
+	switch k {
+	case ViolationCorruptedPage:
+		return "corrupted page"
+	case ViolationNodeType:
+		return "invalid node type"
+	case ViolationUnsortedKeys:
+		return "unsorted keys"
+	case ViolationSeparator:
+		return "key out of separator range"
+	case ViolationParentID:
+		return "wrong parent id"
+	case ViolationSiblingLink:
+		return "broken sibling link"
+	case ViolationLeafDepth:
+		return "uneven leaf depth"
+	case ViolationDuplicateReference:
+		return "page reachable twice"
+	case ViolationPageTooLarge:
+		return "page too large"
+	}
+	return fmt.Sprintf("ViolationKind(%d)", k)
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("page %d: %s: %s", v.PageID, v.Kind, v.Detail)
+}
+
+// rootから全てのページを辿って木の構造を確かめ、見つかった不整合を全て返す
+// 壊れたページはViolationCorruptedPageとして記録してその下は辿らない。ページを読めないなどの場合だけerrを返す
+func (b *BPlustTree) Verify(dm DiskManager) ([]Violation, error) {
+	if b.RootNodeID == InvalidPageID {
+		return nil, nil
+	}
+	v := &verifier{
+		dm:        dm,
+		keyLen:    b.internalKeyLen(),
+		visited:   map[PageID]bool{},
+		leafDepth: -1,
+	}
+	if err := v.walk(b.RootNodeID, InvalidPageID, nil, nil, 0); err != nil {
+		return nil, err
+	}
+	for _, level := range v.levels {
+		v.checkSiblings(level)
+	}
+	return v.res, nil
+}
+
+func (v *verifier) report(kind ViolationKind, pageID PageID, format string, args ...any) {
+	v.res = append(v.res, Violation{kind, pageID, fmt.Sprintf(format, args...)})
+}
+
+// pageIDのページとその子孫を確かめる。キーはlower < key <= upperに収まっていなければならない(nilは制限なし)
+func (v *verifier) walk(pageID, parentID PageID, lower, upper Bytes, depth int32) error {
+	if v.visited[pageID] {
+		v.report(ViolationDuplicateReference, pageID, "referenced again from page %d", parentID)
+		return nil
+	}
+	v.visited[pageID] = true
+	page, err := fetchPage(v.dm, pageID)
+	var corrupted *ErrPageCorrupted
+	if errors.As(err, &corrupted) {
+		v.report(ViolationCorruptedPage, pageID, "%s", corrupted.Reason)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if page.NodeType != NodeTypeBranch && page.NodeType != NodeTypeLeaf {
+		v.report(ViolationNodeType, pageID, "node type %d", page.NodeType)
+		return nil
+	}
+	page.Depth = depth
+	for int(depth) >= len(v.levels) {
+		v.levels = append(v.levels, nil)
+	}
+	v.levels[depth] = append(v.levels[depth], page)
+
+	if page.ParentID != parentID {
+		v.report(ViolationParentID, pageID, "parent is %d, but ParentID is %d", parentID, page.ParentID)
+	}
+	if page.NBytes() > LimitBytesSize() {
+		v.report(ViolationPageTooLarge, pageID, "%d bytes exceeds limit %d", page.NBytes(), LimitBytesSize())
+	}
+	for i, item := range page.Items {
+		if i > 0 && page.Items[i-1].Key.Compare(item.Key, v.keyLen) != ComparisonResultSmall {
+			v.report(ViolationUnsortedKeys, pageID, "key %d %x is not greater than key %d %x", i, item.Key, i-1, page.Items[i-1].Key)
+		}
+		if lower != nil && item.Key.Compare(lower, v.keyLen) != ComparisonResultBig {
+			v.report(ViolationSeparator, pageID, "key %d %x is not greater than lower bound %x", i, item.Key, lower)
+		}
+		if upper != nil && item.Key.Compare(upper, v.keyLen) == ComparisonResultBig {
+			v.report(ViolationSeparator, pageID, "key %d %x is greater than upper bound %x", i, item.Key, upper)
+		}
+	}
+
+	if page.NodeType == NodeTypeLeaf {
+		if v.leafDepth < 0 {
+			v.leafDepth = depth
+		} else if depth != v.leafDepth {
+			v.report(ViolationLeafDepth, pageID, "leaf at depth %d, others at depth %d", depth, v.leafDepth)
+		}
+		return nil
+	}
+	// i番目の子は(i-1番目のキー, i番目のキー]、RightPointerは(最後のキー, upper]に収まる
+	childLower := lower
+	for _, item := range page.Items {
+		if err := v.walk(PageID(item.Value.Uint32(0)), pageID, childLower, item.Key, depth+1); err != nil {
+			return err
+		}
+		childLower = item.Key
+	}
+	if page.RightPointer != InvalidPageID {
+		return v.walk(page.RightPointer, pageID, childLower, upper, depth+1)
+	}
+	return nil
+}
+
+// 同じ深さのページが左から順にPrevPageID・NextPageIDで双方向に繋がり、両端がInvalidPageIDであることを確かめる
+func (v *verifier) checkSiblings(level []*Page) {
+	for i, page := range level {
+		prev, next := InvalidPageID, InvalidPageID
+		if i > 0 {
+			prev = level[i-1].PageID
+		}
+		if i+1 < len(level) {
+			next = level[i+1].PageID
+		}
+		if page.PrevPageID != prev {
+			v.report(ViolationSiblingLink, page.PageID, "PrevPageID is %d, but left page at depth %d is %d", page.PrevPageID, page.Depth, prev)
+		}
+		if page.NextPageID != next {
+			v.report(ViolationSiblingLink, page.PageID, "NextPageID is %d, but right page at depth %d is %d", page.NextPageID, page.Depth, next)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"os"
+	"strconv"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Verifyのテスト", func() {
+	var (
+		dm    DiskManager
+		btree *BPlustTree
+	)
+	kinds := func() []ViolationKind {
+		violations, err := btree.Verify(dm)
+		Expect(err).To(BeNil())
+		res := []ViolationKind{}
+		for _, v := range violations {
+			res = append(res, v.Kind)
+		}
+		return res
+	}
+	// Sliceの結果からdepthの深さで左からi番目のページを取り出す
+	pageAt := func(depth int32, i int) *Page {
+		for _, p := range sliceOf(btree, dm) {
+			if p.Depth != depth {
+				continue
+			}
+			if i == 0 {
+				return &p
+			}
+			i--
+		}
+		Fail("page not found")
+		return nil
+	}
+	leafDepth := func() int32 {
+		return int32(btree.Height) - 1
+	}
+	BeforeEach(func() {
+		os.Setenv(BytesSizeLimitKey, strconv.Itoa(148))
+		dm, _ = NewDiskManager(newCrashableFile())
+		NewTable2(dm, ColumnSize)
+		btree, _ = NewBPlustTree(dm)
+		for i := uint32(0); i < 200; i++ {
+			Expect(btree.InsertPair(dm, NewBytes(i), NewBytes(i))).To(Succeed())
+		}
+		Expect(btree.Height).To(BeNumerically(">=", 3))
+	})
+	It("挿入・削除した木には不整合がない", func() {
+		for i := uint32(0); i < 200; i += 3 {
+			Expect(btree.Delete(dm, NewBytes(i))).To(Succeed())
+		}
+		Expect(kinds()).To(BeEmpty())
+	})
+	It("空の木には不整合がない", func() {
+		dm, _ = NewDiskManager(newCrashableFile())
+		NewTable2(dm, ColumnSize)
+		btree, _ = NewBPlustTree(dm)
+		Expect(kinds()).To(BeEmpty())
+	})
+	It("ページ内のキーが昇順でない", func() {
+		leaf := pageAt(leafDepth(), 1)
+		leaf.Items[0], leaf.Items[1] = leaf.Items[1], leaf.Items[0]
+		Expect(leaf.Flush(dm)).To(Succeed())
+		Expect(kinds()).To(Equal([]ViolationKind{ViolationUnsortedKeys}))
+	})
+	It("子のキーが親のseparatorを超えている", func() {
+		leaf := pageAt(leafDepth(), 0)
+		leaf.Items = append(leaf.Items, Pair{NewBytes(uint32(150)), NewBytes(uint32(0))})
+		Expect(leaf.Flush(dm)).To(Succeed())
+		Expect(kinds()).To(ContainElement(ViolationSeparator))
+	})
+	It("子のParentIDが親を指していない", func() {
+		leaf := pageAt(leafDepth(), 1)
+		leaf.ParentID = btree.RootNodeID
+		Expect(leaf.Flush(dm)).To(Succeed())
+		violations, _ := btree.Verify(dm)
+		Expect(violations).To(Equal([]Violation{{ViolationParentID, leaf.PageID, violations[0].Detail}}))
+	})
+	It("leafのPrevPageID・NextPageIDが繋がっていない", func() {
+		leaf := pageAt(leafDepth(), 1)
+		leaf.NextPageID = InvalidPageID
+		Expect(leaf.Flush(dm)).To(Succeed())
+		Expect(kinds()).To(Equal([]ViolationKind{ViolationSiblingLink}))
+	})
+	It("同じページを2つの親が指している", func() {
+		branch := pageAt(leafDepth()-1, 1)
+		branch.Items[0].Value = NewBytes(uint32(pageAt(leafDepth(), 0).PageID))
+		Expect(branch.Flush(dm)).To(Succeed())
+		Expect(kinds()).To(ContainElement(ViolationDuplicateReference))
+	})
+	It("leafの深さが揃っていない", func() {
+		// rootの最初の子を孫に置き換える
+		root := pageAt(0, 0)
+		root.Items[0].Value = NewBytes(uint32(pageAt(1, 0).Children()[0]))
+		Expect(root.Flush(dm)).To(Succeed())
+		Expect(kinds()).To(ContainElement(ViolationLeafDepth))
+	})
+	It("LimitBytesSizeを超えている", func() {
+		os.Setenv(BytesSizeLimitKey, strconv.Itoa(120))
+		Expect(kinds()).To(ContainElement(ViolationPageTooLarge))
+	})
+	It("壊れたページはViolationCorruptedPageになり、残りのページは確かめる", func() {
+		leaf := pageAt(leafDepth(), 1)
+		b, _ := dm.ReadPageData(leaf.PageID)
+		b[HeaderNByte+1] ^= 1
+		dm.WritePageData(leaf.PageID, b)
+		Expect(kinds()).To(ContainElements(ViolationCorruptedPage, ViolationSiblingLink))
+	})
+	It("BulkLoadで組み立てた木には不整合がない", func() {
+		dm, _ = NewDiskManager(newCrashableFile())
+		NewTable2(dm, ColumnSize)
+		btree, _ = NewBPlustTree(dm)
+		pairs := make([]Pair, 1000)
+		for i := range pairs {
+			pairs[i] = Pair{NewBytes(uint32(i)), NewBytes(uint32(i))}
+		}
+		Expect(btree.BulkLoad(dm, NewPairIterator(pairs), 0.7)).To(Succeed())
+		Expect(kinds()).To(BeEmpty())
+	})
+})
@@ -0,0 +1,331 @@
+package storage
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+type (
+	LSN uint64 // ログレコードの通し番号。0はログに書かれていないことを表す
+
+	LogRecordType uint8
+
+	LogRecord struct {
+		LSN    LSN
+		Type   LogRecordType
+		PageID PageID
+		Data   []byte // LogRecordTypePageの場合は書き込んだページ全体
+	}
+
+	// WALのファイルの操作。*os.Fileが満たす
+	LogFile interface {
+		HeapFile
+	}
+
+	// WALのセグメントを置く場所。セグメントは番号の順にレコードが続いている
+	LogStore interface {
+		Segments() ([]uint64, error)          // 存在するセグメントの番号を昇順に返す
+		Open(segment uint64) (LogFile, error) // 存在しない場合は作る
+		Remove(segment uint64) error
+	}
+
+	walSegment struct {
+		id       uint64
+		file     LogFile
+		firstLSN LSN // 最初のレコードのLSN。空の場合は次に書くレコードのLSN
+	}
+
+	// ログレコードを追記していくファイルの列
+	// AppendしたレコードはFlushされるまでメモリにあり、Flushで最後のセグメントにまとめて書き込んでfsyncする
+	// Rotateで新しいセグメントに切り替え、復旧に要らなくなった古いセグメントはRemoveBeforeで削除する
+	WAL struct {
+		store      LogStore
+		segments   []*walSegment // 古い順
+		size       int64         // 最後のセグメントに書き込み済みのバイト数
+		buf        []byte
+		nextLSN    LSN
+		flushedLSN LSN // ここまでのレコードは永続化されている
+	}
+)
+
+const (
+	LogRecordTypePage       LogRecordType = iota // ページ全体を書き込んだ
+	LogRecordTypeCommit                          // 直前のCommitより後のレコードを1つの操作として全て書いた
+	LogRecordTypeCheckpoint                      // チェックポイント。常にセグメントの先頭に書く
+
+	// 以下はトランザクションのレコードで、PageIDは使わない
+	LogRecordTypeUndo      // トランザクションの中で木を変更した。取り消すための情報を持つ
+	LogRecordTypeCLR       // Undoを1つ取り消した(compensation log record)。次に取り消すUndoのLSNを持つ
+	LogRecordTypeTxnCommit // トランザクションをコミットした
+	LogRecordTypeTxnAbort  // トランザクションの取り消しを全て終えた
+)
+
+const (
+	// crc(4) + データの長さ(4) + LSN(8) + 種類(1) + PageID(4)
+	logRecordHeaderNByte = 21
+
+	// 壊れたレコードの長さで大きな領域を確保しないための上限。チェックポイントはdirtyなページの数だけ大きくなる
+	maxLogDataNByte = 16 * 1024 * 1024
+)
+
+var (
+	crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// 既存のログを読み、最後のCommitより後ろに残っている書きかけのレコードを切り捨てる
+// 残るのは全て書き終えた操作のレコードだけなので、Recoverでそのまま再生できる
+func NewWAL(store LogStore) (*WAL, error) {
+	ids, err := store.Segments()
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		ids = []uint64{1}
+	}
+	w := &WAL{
+		store:   store,
+		nextLSN: 1,
+	}
+	for _, id := range ids {
+		file, err := store.Open(id)
+		if err != nil {
+			return nil, err
+		}
+		w.segments = append(w.segments, &walSegment{id: id, file: file})
+	}
+
+	// 最後のCommitがあるセグメントとその終わりの位置を探す
+	// 途中で途切れているセグメントより後ろは、書き込み中にクラッシュした後のものなので読まない
+	var (
+		last int
+		size int64
+	)
+	for i, segment := range w.segments {
+		var offset int64
+		for {
+			record, next, ok := readLogRecord(segment.file, offset)
+			if !ok {
+				break
+			}
+			if offset == 0 {
+				segment.firstLSN = record.LSN
+			}
+			if record.Type == LogRecordTypeCommit {
+				last = i
+				size = next
+				w.nextLSN = record.LSN + 1
+			}
+			offset = next
+		}
+		stat, err := segment.file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if offset < stat.Size() {
+			break
+		}
+	}
+	for _, segment := range w.segments[last+1:] {
+		segment.file.Close()
+		if err := store.Remove(segment.id); err != nil {
+			return nil, err
+		}
+	}
+	w.segments = w.segments[:last+1]
+	current := w.segments[last]
+	if err := current.file.Truncate(size); err != nil {
+		return nil, err
+	}
+	if err := current.file.Sync(); err != nil {
+		return nil, err
+	}
+	if size == 0 {
+		current.firstLSN = w.nextLSN
+	}
+	w.size = size
+	w.flushedLSN = w.nextLSN - 1
+	return w, nil
+}
+
+// ページ全体を書き込んだことを記録する。dataのヘッダーにはこのレコードのLSNをpageLSNとして書き込む
+func (w *WAL) AppendPage(pageID PageID, data *[PageSize]byte) LSN {
+	SetPageLSN(data, w.nextLSN)
+	return w.append(LogRecordTypePage, pageID, data[:])
+}
+
+func (w *WAL) AppendCommit() LSN {
+	return w.append(LogRecordTypeCommit, InvalidPageID, nil)
+}
+
+// Appendしたレコードをファイルに書き込んでfsyncする
+// 失敗した場合はFlushしていないレコードを捨てるので、次のFlushで後から追加したレコードと一緒に書かれることはない
+func (w *WAL) Flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	file := w.segments[len(w.segments)-1].file
+	if _, err := file.WriteAt(w.buf, w.size); err != nil {
+		w.discard()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		w.discard()
+		return err
+	}
+	w.size += int64(len(w.buf))
+	w.buf = w.buf[:0]
+	w.flushedLSN = w.nextLSN - 1
+	return nil
+}
+
+func (w *WAL) FlushedLSN() LSN {
+	return w.flushedLSN
+}
+
+// 書き込み中のセグメントが空でなければ、新しいセグメントに切り替える
+func (w *WAL) Rotate() error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if w.size == 0 {
+		return nil
+	}
+	id := w.segments[len(w.segments)-1].id + 1
+	file, err := w.store.Open(id)
+	if err != nil {
+		return err
+	}
+	w.segments = append(w.segments, &walSegment{id: id, file: file, firstLSN: w.nextLSN})
+	w.size = 0
+	return nil
+}
+
+// lsnより前のレコードしか持たないセグメントを削除する。書き込み中のセグメントは削除しない
+func (w *WAL) RemoveBefore(lsn LSN) error {
+	for len(w.segments) > 1 && w.segments[1].firstLSN <= lsn {
+		segment := w.segments[0]
+		segment.file.Close()
+		if err := w.store.Remove(segment.id); err != nil {
+			return err
+		}
+		w.segments = w.segments[1:]
+	}
+	return nil
+}
+
+// 残っているセグメントの番号を古い順に返す
+func (w *WAL) Segments() []uint64 {
+	ids := []uint64{}
+	for _, segment := range w.segments {
+		ids = append(ids, segment.id)
+	}
+	return ids
+}
+
+// 一番新しいチェックポイントのレコードを返す。チェックポイントはセグメントの先頭にしか書かれない
+func (w *WAL) LastCheckpoint() (LogRecord, bool) {
+	for i := len(w.segments) - 1; i >= 0; i-- {
+		record, _, ok := readLogRecord(w.segments[i].file, 0)
+		if ok && record.Type == LogRecordTypeCheckpoint {
+			return record, true
+		}
+	}
+	return LogRecord{}, false
+}
+
+func (w *WAL) Close() error {
+	err := w.Flush()
+	for _, segment := range w.segments {
+		if closeErr := segment.file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// from以降のレコードを古い順にfnに渡す。fromより前のレコードしか持たないセグメントは読まない
+// 途中で途切れていたりcrcが合わないレコードがあった場合は、書き込み中にクラッシュしたとみなしてそのセグメントの残りは読まない
+func (w *WAL) ForEach(from LSN, fn func(record LogRecord) error) error {
+	for i, segment := range w.segments {
+		if i+1 < len(w.segments) && w.segments[i+1].firstLSN <= from {
+			continue
+		}
+		var offset int64
+		for {
+			record, next, ok := readLogRecord(segment.file, offset)
+			if !ok {
+				break
+			}
+			if record.LSN >= from {
+				if err := fn(record); err != nil {
+					return err
+				}
+			}
+			offset = next
+		}
+	}
+	return nil
+}
+
+func (w *WAL) hasBuffered() bool {
+	return len(w.buf) > 0
+}
+
+// Flushしていないレコードを捨てる
+func (w *WAL) discard() {
+	w.buf = w.buf[:0]
+	w.nextLSN = w.flushedLSN + 1
+}
+
+func (w *WAL) append(recordType LogRecordType, pageID PageID, data []byte) LSN {
+	lsn := w.nextLSN
+	w.nextLSN += 1
+
+	b := make([]byte, logRecordHeaderNByte, logRecordHeaderNByte+len(data))
+	binary.BigEndian.PutUint32(b[4:8], uint32(len(data)))
+	binary.BigEndian.PutUint64(b[8:16], uint64(lsn))
+	b[16] = byte(recordType)
+	binary.BigEndian.PutUint32(b[17:21], uint32(pageID))
+	b = append(b, data...)
+	binary.BigEndian.PutUint32(b[:4], crc32.Checksum(b[4:], crc32cTable))
+	w.buf = append(w.buf, b...)
+	return lsn
+}
+
+func readLogRecord(file LogFile, offset int64) (LogRecord, int64, bool) {
+	header := make([]byte, logRecordHeaderNByte)
+	if _, err := file.ReadAt(header, offset); err != nil {
+		return LogRecord{}, 0, false
+	}
+	dataLen := binary.BigEndian.Uint32(header[4:8])
+	if dataLen > maxLogDataNByte {
+		return LogRecord{}, 0, false
+	}
+	data := make([]byte, dataLen)
+	if _, err := file.ReadAt(data, offset+logRecordHeaderNByte); err != nil && !(err == io.EOF && dataLen == 0) {
+		return LogRecord{}, 0, false
+	}
+	crc := crc32.Checksum(header[4:], crc32cTable)
+	crc = crc32.Update(crc, crc32cTable, data)
+	if crc != binary.BigEndian.Uint32(header[:4]) {
+		return LogRecord{}, 0, false
+	}
+	record := LogRecord{
+		LSN:    LSN(binary.BigEndian.Uint64(header[8:16])),
+		Type:   LogRecordType(header[16]),
+		PageID: PageID(binary.BigEndian.Uint32(header[17:21])),
+		Data:   data,
+	}
+	return record, offset + logRecordHeaderNByte + int64(dataLen), true
+}
+
+func PageLSN(data [PageSize]byte) LSN {
+	return LSN(binary.BigEndian.Uint64(data[PageLSNOffset : PageLSNOffset+8]))
+}
+
+// ヘッダーを書き換えるのでチェックサムも計算し直す
+func SetPageLSN(data *[PageSize]byte, lsn LSN) {
+	binary.BigEndian.PutUint64(data[PageLSNOffset:PageLSNOffset+8], uint64(lsn))
+	SetPageChecksum(data)
+}
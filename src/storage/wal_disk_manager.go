@@ -0,0 +1,206 @@
+package storage
+
+type (
+	// 複数ページへの書き込みをまとめて1つの単位として扱えるDiskManager
+	AtomicDiskManager interface {
+		DiskManager
+		Atomic(fn func() error) error
+	}
+
+	// ページへの書き込みを先にWALに書いてからdiskに書き込むDiskManager
+	// Atomicの中で書き込まれたページはメモリに溜めておき、fnが終わった時にCommitと一緒にログに書いてfsyncしてからdiskに書き込む
+	// ログが永続化される前のページはdiskに書かれないので、途中でクラッシュしてもRecoverで操作の前か後の状態に戻る
+	// diskにはBufferPoolManagerを渡してもよい
+	WALDiskManager struct {
+		disk DiskManager
+		wal  *WAL
+
+		depth   int // Atomicの入れ子の深さ。一番外側が終わった時にログに書く
+		pending map[PageID][PageSize]byte
+		order   []PageID // pendingに書き込まれた順
+
+		dirty      map[PageID]LSN       // diskに書き込んだがまだSyncしていないページと、最初に変更したレコードのLSN
+		activeTxns func() map[TxnID]LSN // TransactionManagerが設定する。チェックポイントに記録する
+	}
+)
+
+// 開く時にRecoverでログを再生する
+func NewWALDiskManager(disk DiskManager, wal *WAL) (*WALDiskManager, error) {
+	dm := &WALDiskManager{
+		disk:    disk,
+		wal:     wal,
+		pending: map[PageID][PageSize]byte{},
+		dirty:   map[PageID]LSN{},
+	}
+	if err := dm.Recover(); err != nil {
+		return nil, err
+	}
+	return dm, nil
+}
+
+// ログに書かれているページのうち、diskのpageLSNがレコードより古いものを書き直す
+// ログには書き終えた操作のレコードしか残っていないので、再生すると最後に書き終えた操作の後の状態になる
+// チェックポイントがある場合は、その時点で永続化されていなかったページを最初に変更したレコードから再生する
+func (dm *WALDiskManager) Recover() error {
+	var from LSN
+	if record, ok := dm.wal.LastCheckpoint(); ok {
+		from = decodeCheckpoint(record.Data).redoLSN(record.LSN)
+	}
+	err := dm.wal.ForEach(from, func(record LogRecord) error {
+		if record.Type != LogRecordTypePage {
+			return nil
+		}
+		fSize, err := dm.disk.FSize()
+		if err != nil {
+			return err
+		}
+		// ファイルの末尾より後ろのページはまだ一度も書かれていない
+		if int64(record.PageID)*PageSize < fSize {
+			data, err := dm.disk.ReadPageData(record.PageID)
+			if err != nil {
+				return err
+			}
+			if PageLSN(data) >= record.LSN {
+				return nil
+			}
+		}
+		var data [PageSize]byte
+		copy(data[:], record.Data)
+		return dm.disk.WritePageData(record.PageID, data)
+	})
+	if err != nil {
+		return err
+	}
+	return dm.disk.Sync()
+}
+
+// fnの中で書き込んだページをまとめてログに書いてからdiskに書き込む
+// fnの中でWALに追加したページ以外のレコードも同じ単位として書く
+// fnがerrを返した場合は書き込んだページとレコードを捨てるので、ログにもdiskにも残らない
+// diskへの書き込みに失敗した場合はログとdiskの状態がずれるので、開き直してRecoverする必要がある
+func (dm *WALDiskManager) Atomic(fn func() error) error {
+	dm.depth += 1
+	err := fn()
+	dm.depth -= 1
+	if dm.depth > 0 {
+		return err
+	}
+	defer dm.discard()
+	if err != nil {
+		dm.wal.discard()
+		return err
+	}
+	return dm.commit()
+}
+
+// Recoverの最後にdiskをSyncしているので、ログから戻したページもdisk側で割り当て済みになっている
+// diskがBufferPoolManagerの場合もSyncで書き戻される
+func (dm *WALDiskManager) AllocatePage() PageID {
+	return dm.disk.AllocatePage()
+}
+
+// 解放済みの印を付けたページを他のページと同じようにログに書き、diskに書き込む時にdiskのDeallocatePageを呼ぶ
+// 印はページに残るので、Recoverで戻した場合もdiskの空きページとして扱われる
+func (dm *WALDiskManager) DeallocatePage(pageID PageID) error {
+	return dm.WritePageData(pageID, freePageData(pageID))
+}
+
+// Atomicの中で書き込んだページはpendingから返す
+func (dm *WALDiskManager) ReadPageData(pageID PageID) ([PageSize]byte, error) {
+	if data, ok := dm.pending[pageID]; ok {
+		return data, nil
+	}
+	return dm.disk.ReadPageData(pageID)
+}
+
+// Atomicの外で呼ばれた場合はこのページだけで1つの操作としてログに書く
+func (dm *WALDiskManager) WritePageData(pageID PageID, data [PageSize]byte) error {
+	if dm.depth == 0 {
+		return dm.Atomic(func() error {
+			return dm.WritePageData(pageID, data)
+		})
+	}
+	if _, ok := dm.pending[pageID]; !ok {
+		dm.order = append(dm.order, pageID)
+	}
+	dm.pending[pageID] = data
+	return nil
+}
+
+// まだdiskに書き込まれていないページも含めたサイズを返す
+func (dm *WALDiskManager) FSize() (int64, error) {
+	fSize, err := dm.disk.FSize()
+	if err != nil {
+		return 0, err
+	}
+	for pageID := range dm.pending {
+		if size := int64(pageID+1) * PageSize; size > fSize {
+			fSize = size
+		}
+	}
+	return fSize, nil
+}
+
+func (dm *WALDiskManager) Sync() error {
+	if err := dm.wal.Flush(); err != nil {
+		return err
+	}
+	if err := dm.disk.Sync(); err != nil {
+		return err
+	}
+	dm.dirty = map[PageID]LSN{}
+	return nil
+}
+
+func (dm *WALDiskManager) Close() error {
+	if err := dm.disk.Close(); err != nil {
+		dm.wal.Close()
+		return err
+	}
+	return dm.wal.Close()
+}
+
+// 書き込んだ順にログに書いてfsyncしてからdiskに書き込む
+func (dm *WALDiskManager) commit() error {
+	if len(dm.order) == 0 && !dm.wal.hasBuffered() {
+		return nil
+	}
+	for _, pageID := range dm.order {
+		data := dm.pending[pageID]
+		dm.wal.AppendPage(pageID, &data)
+		dm.pending[pageID] = data
+	}
+	dm.wal.AppendCommit()
+	if err := dm.wal.Flush(); err != nil {
+		return err
+	}
+	for _, pageID := range dm.order {
+		data := dm.pending[pageID]
+		var err error
+		if isFreePageData(&data) {
+			err = dm.disk.DeallocatePage(pageID)
+		} else {
+			err = dm.disk.WritePageData(pageID, data)
+		}
+		if err != nil {
+			return err
+		}
+		if _, ok := dm.dirty[pageID]; !ok {
+			dm.dirty[pageID] = PageLSN(data)
+		}
+	}
+	return nil
+}
+
+func (dm *WALDiskManager) discard() {
+	dm.pending = map[PageID][PageSize]byte{}
+	dm.order = nil
+}
+
+// dmがAtomicDiskManagerの場合はfnの中で書き込んだページを1つの単位として永続化する
+func atomically(dm DiskManager, fn func() error) error {
+	if adm, ok := dm.(AtomicDiskManager); ok {
+		return adm.Atomic(fn)
+	}
+	return fn()
+}
@@ -0,0 +1,274 @@
+package storage
+
+import (
+	"os"
+	"sort"
+	"strconv"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("WALのテスト", func() {
+	Describe("NewWAL", func() {
+		var (
+			f       *crashableFile
+			w       *WAL
+			records []LogRecord
+		)
+		BeforeEach(func() {
+			f = newCrashableFile()
+			w, _ = NewWAL(newMemLogStore(f))
+			var data [PageSize]byte
+			w.AppendPage(PageID(1), &data)
+			w.AppendCommit()
+			w.AppendPage(PageID(2), &data)
+			w.AppendCommit()
+			Expect(w.Flush()).To(Succeed())
+		})
+		reopen := func() {
+			var err error
+			w, err = NewWAL(newMemLogStore(f))
+			Expect(err).To(BeNil())
+			records = []LogRecord{}
+			w.ForEach(0, func(record LogRecord) error {
+				records = append(records, record)
+				return nil
+			})
+		}
+		Context("全てのレコードがCommitされている場合", func() {
+			It("全てのレコードが読める", func() {
+				reopen()
+				Expect(records).To(HaveLen(4))
+				Expect(records[2].PageID).To(Equal(PageID(2)))
+				Expect(PageLSN([PageSize]byte(records[2].Data))).To(Equal(LSN(3)))
+				Expect(w.AppendCommit()).To(Equal(LSN(5)))
+			})
+		})
+		Context("最後のCommitより後ろにレコードがある場合", func() {
+			It("書きかけのレコードは切り捨てられ、続きのLSNから書き込まれる", func() {
+				var data [PageSize]byte
+				w.AppendPage(PageID(3), &data)
+				Expect(w.Flush()).To(Succeed())
+				reopen()
+				Expect(records).To(HaveLen(4))
+				Expect(w.AppendCommit()).To(Equal(LSN(5)))
+			})
+		})
+		Context("レコードの途中で途切れている場合", func() {
+			It("途切れたレコードを含む操作は切り捨てられる", func() {
+				f.durable = f.durable[:len(f.durable)-1]
+				f.crash()
+				reopen()
+				Expect(records).To(HaveLen(2))
+			})
+		})
+		Context("crcが合わないレコードがある場合", func() {
+			It("そのレコード以降は読まれない", func() {
+				f.durable[logRecordHeaderNByte+PageSize+logRecordHeaderNByte+100] ^= 1
+				f.crash()
+				reopen()
+				Expect(records).To(HaveLen(2))
+			})
+		})
+	})
+	Describe("WALDiskManager", func() {
+		var (
+			dataFile *crashableFile
+			logFile  *crashableFile
+			dm       *WALDiskManager
+			btree    *BPlustTree
+		)
+		// diskは書き込むたびにfsyncするので、書き込みに失敗した時点のページがそのまま残る
+		open := func() {
+			disk, err := NewDiskManagerWithSyncMode(dataFile, SyncModeAlways)
+			Expect(err).To(BeNil())
+			wal, err := NewWAL(newMemLogStore(logFile))
+			Expect(err).To(BeNil())
+			dm, err = NewWALDiskManager(disk, wal)
+			Expect(err).To(BeNil())
+		}
+		crashAndReopen := func() {
+			dataFile.crash()
+			logFile.crash()
+			open()
+			var err error
+			btree, err = NewBPlustTree(dm)
+			Expect(err).To(BeNil())
+		}
+		keysUpTo := func(max uint32) []uint32 {
+			keys := []uint32{}
+			var i uint32
+			for i = 0; i <= max; i++ {
+				keys = append(keys, i)
+			}
+			return keys
+		}
+		// 0~6を挿入した木に7を挿入すると、leaf・branch・rootが分割される
+		BeforeEach(func() {
+			os.Setenv(BytesSizeLimitKey, strconv.Itoa(84))
+			dataFile = newCrashableFile()
+			logFile = newCrashableFile()
+			open()
+			NewTable2(dm, ColumnSize)
+			btree, _ = NewBPlustTree(dm)
+			var i uint32
+			for i = 0; i < 7; i++ {
+				Expect(btree.InsertPair(dm, NewBytes(i), NewBytes(i))).To(Succeed())
+			}
+		})
+		Context("ページの分割中にdiskへの書き込みでクラッシュした場合", func() {
+			It("ログから分割後の状態に戻る", func() {
+				dataDurable := append([]byte{}, dataFile.durable...)
+				logDurable := append([]byte{}, logFile.durable...)
+				for n := 0; ; n++ {
+					dataFile.durable = append([]byte{}, dataDurable...)
+					logFile.durable = append([]byte{}, logDurable...)
+					crashAndReopen()
+
+					dataFile.writesLeft = n
+					err := btree.InsertPair(dm, NewBytes(7), NewBytes(7))
+					crashAndReopen()
+					res := sliceOf(btree, dm)
+					Expect(leafKeys(res)).To(Equal(keysUpTo(7)), "n=%d", n)
+					assertLinks(res)
+					Expect(btree.KeyCount).To(Equal(uint64(8)), "n=%d", n)
+					if err == nil {
+						break
+					}
+				}
+			})
+		})
+		Context("ページの分割中にログへの書き込みでクラッシュした場合", func() {
+			It("Commitまで書かれていなければ分割前の状態に戻る", func() {
+				dataDurable := append([]byte{}, dataFile.durable...)
+				logDurable := append([]byte{}, logFile.durable...)
+				Expect(btree.InsertPair(dm, NewBytes(7), NewBytes(7))).To(Succeed())
+				fullLog := append([]byte{}, logFile.durable...)
+				for cut := len(logDurable); cut < len(fullLog); cut += 97 {
+					// ログが永続化されるまでdiskには書き込まれない
+					dataFile.durable = append([]byte{}, dataDurable...)
+					logFile.durable = append([]byte{}, fullLog[:cut]...)
+					crashAndReopen()
+					res := sliceOf(btree, dm)
+					Expect(leafKeys(res)).To(Equal(keysUpTo(6)), "cut=%d", cut)
+					assertLinks(res)
+					Expect(btree.KeyCount).To(Equal(uint64(7)), "cut=%d", cut)
+				}
+			})
+		})
+		Context("ページの分割中にログへの書き込みに失敗した場合", func() {
+			It("メモリ上の高さやキーの数も分割前に戻り、続けて書き込める", func() {
+				before := *btree
+				logFile.writesLeft = 0
+				Expect(btree.InsertPair(dm, NewBytes(7), NewBytes(7))).NotTo(Succeed())
+				Expect(*btree).To(Equal(before))
+
+				logFile.writesLeft = -1
+				Expect(btree.InsertPair(dm, NewBytes(7), NewBytes(7))).To(Succeed())
+				Expect(btree.KeyCount).To(Equal(uint64(8)))
+				crashAndReopen()
+				res := sliceOf(btree, dm)
+				Expect(leafKeys(res)).To(Equal(keysUpTo(7)))
+				assertLinks(res)
+				Expect(btree.KeyCount).To(Equal(uint64(8)))
+			})
+		})
+		Context("Recoverした後に書き込んだ場合", func() {
+			It("ログから戻したページに続けて書き込める", func() {
+				dataFile.durable = nil
+				crashAndReopen()
+				root, _ := dm.ReadPageData(RootPageID)
+				Expect(PageLSN(root)).NotTo(Equal(LSN(0)))
+
+				Expect(btree.InsertPair(dm, NewBytes(7), NewBytes(7))).To(Succeed())
+				crashAndReopen()
+				res := sliceOf(btree, dm)
+				Expect(leafKeys(res)).To(Equal(keysUpTo(7)))
+				assertLinks(res)
+			})
+		})
+		Context("削除でページを解放した後にクラッシュした場合", func() {
+			It("解放済みの印もログから戻り、再利用される", func() {
+				var i uint32
+				for i = 7; i < 30; i++ {
+					Expect(btree.InsertPair(dm, NewBytes(i), NewBytes(i))).To(Succeed())
+				}
+				for i = 0; i < 27; i++ {
+					Expect(btree.Delete(dm, NewBytes(i))).To(Succeed())
+				}
+				dataFile.durable = nil
+				crashAndReopen()
+				Expect(leafKeys(sliceOf(btree, dm))).To(Equal([]uint32{27, 28, 29}))
+				disk, _ := NewDiskManager(dataFile)
+				Expect(disk.(*DiskManagerImpl).FreeSpace().FreePages).NotTo(BeZero())
+
+				fSize, _ := dm.FSize()
+				for i = 0; i < 27; i++ {
+					Expect(btree.InsertPair(dm, NewBytes(i), NewBytes(i))).To(Succeed())
+				}
+				Expect(dm.FSize()).To(Equal(fSize))
+				res := sliceOf(btree, dm)
+				Expect(leafKeys(res)).To(Equal(keysUpTo(29)))
+				assertLinks(res)
+			})
+		})
+		Context("BufferPoolManagerを挟んでいる場合", func() {
+			It("書き戻す前にクラッシュしてもログから戻る", func() {
+				disk, _ := NewDiskManager(dataFile)
+				bpm := NewBufferPoolManager(disk, 4, NewLRUReplacer())
+				wal, _ := NewWAL(newMemLogStore(logFile))
+				dm, _ = NewWALDiskManager(bpm, wal)
+				var i uint32
+				for i = 7; i < 30; i++ {
+					Expect(btree.InsertPair(dm, NewBytes(i), NewBytes(i))).To(Succeed())
+				}
+				crashAndReopen()
+				res := sliceOf(btree, dm)
+				Expect(leafKeys(res)).To(Equal(keysUpTo(29)))
+				assertLinks(res)
+			})
+		})
+	})
+})
+
+// セグメントをメモリ上のcrashableFileで持つ。削除はすぐに永続化される
+type memLogStore struct {
+	files map[uint64]*crashableFile
+}
+
+// filesを1から順に番号を付けたセグメントとして持つ
+func newMemLogStore(files ...*crashableFile) *memLogStore {
+	s := &memLogStore{map[uint64]*crashableFile{}}
+	for i, f := range files {
+		s.files[uint64(i+1)] = f
+	}
+	return s
+}
+
+func (s *memLogStore) Segments() ([]uint64, error) {
+	ids := []uint64{}
+	for id := range s.files {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+func (s *memLogStore) Open(segment uint64) (LogFile, error) {
+	if _, ok := s.files[segment]; !ok {
+		s.files[segment] = newCrashableFile()
+	}
+	return s.files[segment], nil
+}
+
+func (s *memLogStore) Remove(segment uint64) error {
+	delete(s.files, segment)
+	return nil
+}
+
+func (s *memLogStore) crash() {
+	for _, f := range s.files {
+		f.crash()
+	}
+}